@@ -1,33 +1,240 @@
 package bootstrap
 
 import (
+	"context"
 	"dht/communication"
+	"dht/consensus"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// ErrDuplicatePeer is returned when a peer ID is already taken by a node at another address
+var ErrDuplicatePeer = errors.New("peer ID already in use")
+
+// commitTimeout bounds how long a membership change may take to be recorded
+const commitTimeout = 5 * time.Second
+
 // Bootstrap maintains the peer ring
 type Bootstrap struct {
-	peers        []string                       // Sorted slice of peer IDs
+	peers        []communication.NodeInfo       // Slice of peers sorted by ID
+	joinSecret   []byte                         // Shared secret JOINs must be signed with, nil to accept unsigned joins
+	joinMaxSkew  time.Duration                  // How old or far in the future a signed JOIN may be
+	seenNonces   *communication.ReplayCache     // Nonces of the signed JOINs and LEAVEs already accepted
+	ringLog      *RingLog                       // Durable record of membership changes, nil to keep the ring in memory only
+	replicas     *consensus.Node                // Replicates membership changes to the other bootstrap replicas, nil when running alone
+	nextEntry    int                            // Rotates client requests across peers
 	mu           sync.Mutex                     // Mutex for thread safety
 	communicator *communication.TcpCommunicator // Communicator for messaging peers
+	logger       *slog.Logger
 }
 
-// NewBootstrap initializes the bootstrap server
-func NewBootstrap(communicator *communication.TcpCommunicator) *Bootstrap {
+// NewBootstrap initializes the bootstrap server, starting from the ring recorded in ringLog if there is one
+func NewBootstrap(communicator *communication.TcpCommunicator, joinSecret []byte, joinMaxSkew time.Duration, ringLog *RingLog, logger *slog.Logger) *Bootstrap {
+	peers := append([]communication.NodeInfo{}, ringLog.Peers()...)
+	sort.Slice(peers, func(i, j int) bool {
+		return extractNumber(peers[i].ID) < extractNumber(peers[j].ID)
+	})
+	if len(peers) > 0 {
+		logger.Info("Recovered ring", "peers", peers)
+	}
 	return &Bootstrap{
-		peers:        []string{},
+		peers:        peers,
+		joinSecret:   joinSecret,
+		joinMaxSkew:  joinMaxSkew,
+		seenNonces:   communication.NewReplayCache(),
+		ringLog:      ringLog,
 		communicator: communicator,
+		logger:       logger,
+	}
+}
+
+// Replicate makes this bootstrap one of several replicas that agree on the
+// ring through the consensus package instead of keeping it on its own.
+func (b *Bootstrap) Replicate(id string, options consensus.Options) error {
+	replicas, err := consensus.NewNode(id, options, b.applyCommand, b.communicator, b.logger)
+	if err != nil {
+		return err
+	}
+	b.replicas = replicas
+	return nil
+}
+
+// HandleConsensus passes a message from another bootstrap replica to the consensus node
+func (b *Bootstrap) HandleConsensus(message communication.Message) {
+	if b.replicas != nil {
+		b.replicas.Handle(message)
+	}
+}
+
+// HandleJoin validates a JOIN and registers the peer, or tells it why it was refused.
+// Replicas that are not the leader pass the JOIN on to the leader.
+func (b *Bootstrap) HandleJoin(ctx context.Context, join *communication.JoinMessage) {
+	err := communication.ValidateJoin(b.joinSecret, join, time.Now(), b.joinMaxSkew, b.seenNonces)
+	if err == nil {
+		err = b.RegisterPeer(ctx, communication.NodeInfo{ID: join.PeerID, Address: join.Address})
+	}
+	if errors.Is(err, consensus.ErrNotLeader) || errors.Is(err, consensus.ErrLostLeadership) {
+		b.forwardJoin(ctx, join)
+		return
+	}
+	if err == nil {
+		return
+	}
+
+	b.logger.Warn("Rejecting join", "joiner", join.PeerID, "address", join.Address, "err", err)
+	if _, _, addrErr := net.SplitHostPort(join.Address); addrErr != nil {
+		// Nowhere to send the rejection
+		return
+	}
+	rejectMessage, encodeErr := communication.GetJoinRejectedMessage(join.PeerID, err.Error())
+	if encodeErr != nil {
+		b.logger.Error("Failed to encode message", "msg_type", communication.JOIN_REJECTED, "err", encodeErr)
+		return
+	}
+	if sendErr := b.communicator.SendMessage(ctx, join.Address, rejectMessage); sendErr != nil {
+		b.logger.Warn("Failed to send join rejection", "joiner", join.PeerID, "err", sendErr)
+	}
+}
+
+// forwardJoin passes a JOIN on unchanged to the leader
+func (b *Bootstrap) forwardJoin(ctx context.Context, join *communication.JoinMessage) {
+	joinMessage, err := communication.EncodeJoinMessage(join)
+	if err != nil {
+		b.logger.Error("Failed to encode message", "msg_type", communication.JOIN, "err", err)
+		return
+	}
+	b.forwardToLeader(ctx, joinMessage, "join", join.PeerID)
+}
+
+// forwardToLeader sends a ring change from peerID on to the leader, waiting
+// for an election if there is none, until ctx is done
+func (b *Bootstrap) forwardToLeader(ctx context.Context, message []byte, change, peerID string) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	leader, ok := b.replicas.Leader()
+	for !ok || leader.ID == b.communicator.ID() {
+		select {
+		case <-ctx.Done():
+			b.logger.Warn("Dropping ring change, no leader to forward it to", "change", change, "peer", peerID, "err", ctx.Err())
+			return
+		case <-ticker.C:
+		}
+		leader, ok = b.replicas.Leader()
+	}
+	if err := b.communicator.SendMessage(ctx, leader.Address, message); err != nil {
+		b.logger.Warn("Failed to forward ring change to leader", "change", change, "peer", peerID, "leader", leader.ID, "err", err)
+	}
+}
+
+// HandleLeave removes a peer that is leaving the ring on purpose.
+// Replicas that are not the leader pass the LEAVE on to the leader.
+func (b *Bootstrap) HandleLeave(ctx context.Context, leave *communication.LeaveMessage) {
+	if err := communication.ValidateLeave(b.joinSecret, leave, time.Now(), b.joinMaxSkew, b.seenNonces); err != nil {
+		b.logger.Warn("Ignoring leave", "peer", leave.Node.ID, "err", err)
+		return
+	}
+	err := b.RemovePeer(ctx, leave.Node.ID)
+	if errors.Is(err, consensus.ErrNotLeader) || errors.Is(err, consensus.ErrLostLeadership) {
+		leaveMessage, err := communication.EncodeLeaveMessage(leave)
+		if err != nil {
+			b.logger.Error("Failed to encode message", "msg_type", communication.LEAVE, "err", err)
+			return
+		}
+		b.forwardToLeader(ctx, leaveMessage, "leave", leave.Node.ID)
+		return
+	}
+	if err != nil {
+		b.logger.Error("Failed to remove peer", "peer", leave.Node.ID, "err", err)
+		return
+	}
+	b.logger.Info("Peer left the ring", "peer", leave.Node.ID)
+}
+
+// Close releases the ring state kept on disk
+func (b *Bootstrap) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ringLog.Close()
+}
+
+// NextEntryPeer returns the peer the next client request should enter the
+// ring at. Any peer can route a request to its owner, so requests are spread
+// round-robin across the ring. It returns false while the ring is empty.
+func (b *Bootstrap) NextEntryPeer() (communication.NodeInfo, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.peers) == 0 {
+		return communication.NodeInfo{}, false
 	}
+	b.nextEntry = (b.nextEntry + 1) % len(b.peers)
+	return b.peers[b.nextEntry], true
 }
 
-func (b *Bootstrap) GetFirstPeer() string {
+// HandleNextHopRequest starts an iterative lookup. The bootstrap knows the
+// whole ring, so it names the owner of the object, followed by the peers
+// after it in case the owner does not answer.
+func (b *Bootstrap) HandleNextHopRequest(ctx context.Context, request *communication.NextHopRequestMessage, respond communication.Responder) {
+	next := b.successors(request.ObjectID, 3)
+	replyMessage, err := communication.GetNextHopMessage(request.LookupID, b.self(), false, next)
+	if err != nil {
+		b.logger.Error("Failed to encode message", "msg_type", communication.NEXT_HOP, "err", err)
+		return
+	}
+	if err := respond(ctx, replyMessage); err != nil {
+		b.logger.Warn("Failed to answer next hop request", "req_id", request.LookupID, "err", err)
+	}
+}
+
+// HandleFindSuccessor answers which peer owns a ring position from the ring the bootstrap keeps
+func (b *Bootstrap) HandleFindSuccessor(ctx context.Context, message *communication.FindSuccessorMessage, respond communication.Responder) {
+	successors := b.successors(message.Position, 1)
+	if len(successors) == 0 {
+		b.logger.Warn("No peers to answer find successor with", "req_id", message.RequestID)
+		return
+	}
+	replyMessage, err := communication.GetSuccessorMessage(message.RequestID, message.Position, successors[0])
+	if err != nil {
+		b.logger.Error("Failed to encode message", "msg_type", communication.SUCCESSOR, "err", err)
+		return
+	}
+	if err := respond(ctx, replyMessage); err != nil {
+		b.logger.Warn("Failed to answer find successor", "req_id", message.RequestID, "err", err)
+	}
+}
+
+// successors returns up to count peers starting with the owner of position
+func (b *Bootstrap) successors(position, count int) []communication.NodeInfo {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	return b.peers[0]
+	var successors []communication.NodeInfo
+	if len(b.peers) > 0 {
+		owner := sort.Search(len(b.peers), func(i int) bool {
+			return extractNumber(b.peers[i].ID) >= position
+		})
+		for i := 0; i < min(count, len(b.peers)); i++ {
+			successors = append(successors, b.peers[(owner+i)%len(b.peers)])
+		}
+	}
+	return successors
+}
+
+func (b *Bootstrap) self() communication.NodeInfo {
+	return communication.NodeInfo{ID: b.communicator.ID(), Address: b.communicator.AdvertiseAddress()}
+}
+
+// Peers returns the peers in the ring, sorted by ID
+func (b *Bootstrap) Peers() []communication.NodeInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]communication.NodeInfo{}, b.peers...)
 }
 
 // extractNumber removes the 'n' prefix and converts the rest to an integer
@@ -37,48 +244,216 @@ func extractNumber(peerID string) int {
 	return num
 }
 
-// RegisterPeer adds a new peer while keeping the list numerically sorted
-func (b *Bootstrap) RegisterPeer(peerID string) {
+// RegisterPeer adds a new peer while keeping the list numerically sorted.
+// A peer that registers again from the same address is sent its links again.
+// The peer and its new neighbors are told their links under ctx.
+func (b *Bootstrap) RegisterPeer(ctx context.Context, peer communication.NodeInfo) error {
 	b.mu.Lock()
-	defer b.mu.Unlock()
-
-	// Insert the new peer
-	b.peers = append(b.peers, peerID)
+	for _, existing := range b.peers {
+		if extractNumber(existing.ID) != extractNumber(peer.ID) {
+			continue
+		}
+		if existing.ID != peer.ID || existing.Address != peer.Address {
+			b.mu.Unlock()
+			return fmt.Errorf("%w: %s is registered at %s", ErrDuplicatePeer, existing.ID, existing.Address)
+		}
+		b.mu.Unlock()
+		b.notifyNeighbors(ctx, peer)
+		return nil
+	}
+	b.mu.Unlock()
 
-	// Sort using numeric order by ignoring "n" prefix
-	sort.Slice(b.peers, func(i, j int) bool {
-		return extractNumber(b.peers[i]) < extractNumber(b.peers[j])
-	})
+	// Record the new peer before it becomes visible
+	commitCtx, cancel := context.WithTimeout(ctx, commitTimeout)
+	defer cancel()
+	if err := b.commit(commitCtx, ringRecord{Op: opJoin, ID: peer.ID, Address: peer.Address}); err != nil {
+		return fmt.Errorf("recording join of %s: %w", peer.ID, err)
+	}
 
+	b.mu.Lock()
 	// Find index of the new peer
-	index := sort.Search(len(b.peers), func(i int) bool {
-		return extractNumber(b.peers[i]) >= extractNumber(peerID)
-	})
+	index := b.getIndex(peer.ID)
+	if index == len(b.peers) || b.peers[index].ID != peer.ID {
+		b.mu.Unlock()
+		return fmt.Errorf("%s left the ring while joining", peer.ID)
+	}
+	if existing := b.peers[index]; existing.Address != peer.Address {
+		// A concurrent join with the same ID committed after this one and replaced it
+		b.mu.Unlock()
+		return fmt.Errorf("%w: %s is registered at %s", ErrDuplicatePeer, existing.ID, existing.Address)
+	}
+	b.mu.Unlock()
 
-	// Determine predecessor and successor
+	// Notify affected peers
+	b.notifyNeighbors(ctx, peer)
+	return nil
+}
+
+// RemovePeer takes a peer out of the ring and relinks its former neighbors under ctx
+func (b *Bootstrap) RemovePeer(ctx context.Context, peerID string) error {
+	b.mu.Lock()
+	index := -1
+	for i, existing := range b.peers {
+		if existing.ID == peerID {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		b.mu.Unlock()
+		return nil
+	}
 	predecessor, successor := b.getNeighbors(index)
+	b.mu.Unlock()
 
-	// print the ring once
-	fmt.Println("Ring: ", b.peers)
+	commitCtx, cancel := context.WithTimeout(ctx, commitTimeout)
+	defer cancel()
+	if err := b.commit(commitCtx, ringRecord{Op: opLeave, ID: peerID}); err != nil {
+		return fmt.Errorf("recording leave of %s: %w", peerID, err)
+	}
 
-	// Notify affected peers
-	go b.notifyNeighbors(peerID, predecessor, successor)
+	// The neighbors now point at each other
+	if predecessor.ID != peerID {
+		b.sendLinks(ctx, predecessor)
+	}
+	if successor.ID != peerID && successor.ID != predecessor.ID {
+		b.sendLinks(ctx, successor)
+	}
+	return nil
 }
 
-func (b *Bootstrap) getIndex(peerID string) int {
+// VerifyPeers probes every peer in the ring, for example after recovering it
+// from disk, removes the ones that no longer answer as themselves and sends
+// the survivors their current links.
+func (b *Bootstrap) VerifyPeers(probeTimeout time.Duration) {
+	b.mu.Lock()
+	peers := append([]communication.NodeInfo{}, b.peers...)
+	b.mu.Unlock()
+
+	var wg sync.WaitGroup
+	dead := make(chan string, len(peers))
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer communication.NodeInfo) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+			defer cancel()
+			remoteID, err := b.communicator.Probe(ctx, peer.Address)
+			if err == nil && remoteID != peer.ID {
+				err = fmt.Errorf("answered as %s", remoteID)
+			}
+			if err != nil {
+				b.logger.Warn("Peer is gone", "peer", peer.ID, "address", peer.Address, "err", err)
+				dead <- peer.ID
+			}
+		}(peer)
+	}
+	wg.Wait()
+	close(dead)
+
+	for peerID := range dead {
+		if err := b.RemovePeer(context.Background(), peerID); err != nil {
+			b.logger.Error("Failed to remove peer", "peer", peerID, "err", err)
+		}
+	}
+
+	b.mu.Lock()
+	survivors := append([]communication.NodeInfo{}, b.peers...)
+	b.mu.Unlock()
+	for _, peer := range survivors {
+		b.sendLinks(context.Background(), peer)
+	}
+}
+
+// sendLinks tells a peer its current predecessor and successor
+func (b *Bootstrap) sendLinks(ctx context.Context, peer communication.NodeInfo) {
+	b.mu.Lock()
+	index := -1
+	for i, existing := range b.peers {
+		if existing.ID == peer.ID {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		b.mu.Unlock()
+		return
+	}
+	predecessor, successor := b.getNeighbors(index)
+	b.mu.Unlock()
+
+	b.sendRing(ctx, ringUpdate{peer, predecessor, successor})
+}
+
+// commit makes a membership change durable and applies it to the ring: through
+// the other replicas when the bootstrap is replicated, otherwise through the ring log.
+func (b *Bootstrap) commit(ctx context.Context, record ringRecord) error {
+	if b.replicas != nil {
+		command, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		// The change is applied through applyCommand once committed
+		return b.replicas.Propose(ctx, command)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.ringLog.append(record); err != nil {
+		return err
+	}
+	b.apply(record)
+	b.compactRingLog()
+	return nil
+}
+
+// applyCommand applies a membership change committed by the replicas
+func (b *Bootstrap) applyCommand(command []byte) {
+	var record ringRecord
+	if err := json.Unmarshal(command, &record); err != nil {
+		b.logger.Error("Failed to decode ring change", "err", err)
+		return
+	}
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	b.apply(record)
+}
+
+// apply makes one membership change to the ring. A join for an ID that is
+// already registered replaces its address, as replaying the ring log does, so
+// the live ring, every replica and a restarted bootstrap agree: the last of
+// two concurrent joins wins. Callers hold b.mu.
+func (b *Bootstrap) apply(record ringRecord) {
+	b.peers = applyRecord(b.peers, record)
 
-	// Find index of the peer
-	index := sort.Search(len(b.peers), func(i int) bool {
-		return extractNumber(b.peers[i]) >= extractNumber(peerID)
+	// Sort using numeric order by ignoring "n" prefix
+	sort.Slice(b.peers, func(i, j int) bool {
+		return extractNumber(b.peers[i].ID) < extractNumber(b.peers[j].ID)
 	})
 
-	return index
+	b.logger.Info("Ring updated", "peers", b.peers)
 }
 
-// getNeighbors finds the predecessor and successor for a given index
-func (b *Bootstrap) getNeighbors(index int) (string, string) {
+// compactRingLog folds the write-ahead log into a snapshot once it has grown. Callers hold b.mu.
+func (b *Bootstrap) compactRingLog() {
+	if !b.ringLog.NeedsCompaction() {
+		return
+	}
+	if err := b.ringLog.Compact(b.peers); err != nil {
+		b.logger.Error("Failed to compact ring log", "err", err)
+	}
+}
+
+// getIndex finds where a peer ID is or would be in the ring. Callers hold b.mu.
+func (b *Bootstrap) getIndex(peerID string) int {
+	return sort.Search(len(b.peers), func(i int) bool {
+		return extractNumber(b.peers[i].ID) >= extractNumber(peerID)
+	})
+}
+
+// getNeighbors finds the predecessor and successor for a given index of a
+// ring that is not empty. Callers hold b.mu.
+func (b *Bootstrap) getNeighbors(index int) (communication.NodeInfo, communication.NodeInfo) {
 	n := len(b.peers)
 	if n == 1 {
 		return b.peers[0], b.peers[0] // Only one peer in the ring, points to itself
@@ -88,45 +463,54 @@ func (b *Bootstrap) getNeighbors(index int) (string, string) {
 	return predecessor, successor
 }
 
-// notifyNeighbors informs affected peers of changes
-func (b *Bootstrap) notifyNeighbors(peerID, predecessor, successor string) {
-	// Send message to peerID with predecessor and successor
-	ringMessage, err := communication.GetRingMessage(predecessor, successor)
-	if err == nil {
-		err := b.communicator.SendMessage(peerID, ringMessage)
-		if err != nil {
-			fmt.Println("Error sending ring message:", err)
+// ringUpdate is the links one peer is told about
+type ringUpdate struct {
+	peer, predecessor, successor communication.NodeInfo
+}
+
+// notifyNeighbors tells a peer its links, and its neighbors their links now
+// that it sits between them. The links are read from one snapshot of the
+// ring and sent once the lock is released.
+func (b *Bootstrap) notifyNeighbors(ctx context.Context, peer communication.NodeInfo) {
+	b.mu.Lock()
+	if len(b.peers) == 0 {
+		b.mu.Unlock()
+		return
+	}
+	index := b.getIndex(peer.ID)
+	if index == len(b.peers) || b.peers[index].ID != peer.ID {
+		// Gone again before its neighbors could be told
+		b.mu.Unlock()
+		return
+	}
+	predecessor, successor := b.getNeighbors(index)
+	updates := []ringUpdate{{peer, predecessor, successor}}
+	neighbors := []communication.NodeInfo{predecessor}
+	if successor.ID != predecessor.ID {
+		neighbors = append(neighbors, successor)
+	}
+	for _, neighbor := range neighbors {
+		if neighbor.ID == peer.ID {
+			continue
 		}
-	} else {
-		fmt.Println("Error encoding join message:", err)
+		neighborPredecessor, neighborSuccessor := b.getNeighbors(b.getIndex(neighbor.ID))
+		updates = append(updates, ringUpdate{neighbor, neighborPredecessor, neighborSuccessor})
 	}
+	b.mu.Unlock()
 
-	if predecessor != peerID {
-		predecessorIndex := b.getIndex(predecessor)
-		predecessorPredecessor, predecessorSuccessor := b.getNeighbors(predecessorIndex)
-		ringMessagePredecessorUpdate, err := communication.GetRingMessage(predecessorPredecessor, predecessorSuccessor)
-		if err == nil {
-			err := b.communicator.SendMessage(predecessor, ringMessagePredecessorUpdate)
-			if err != nil {
-				fmt.Println("Error sending ring message:", err)
-			}
-		} else {
-			fmt.Println("Error encoding join message:", err)
-		}
+	for _, update := range updates {
+		b.sendRing(ctx, update)
 	}
+}
 
-	if successor != peerID && successor != predecessor {
-		// Send message to successor with new predecessor
-		successorIndex := b.getIndex(successor)
-		successorPredecessor, successorSuccessor := b.getNeighbors(successorIndex)
-		ringMessagePredecessorUpdate, err := communication.GetRingMessage(successorPredecessor, successorSuccessor)
-		if err == nil {
-			err := b.communicator.SendMessage(successor, ringMessagePredecessorUpdate)
-			if err != nil {
-				fmt.Println("Error sending ring message:", err)
-			}
-		} else {
-			fmt.Println("Error encoding join message:", err)
-		}
+// sendRing sends one peer its links
+func (b *Bootstrap) sendRing(ctx context.Context, update ringUpdate) {
+	ringMessage, err := communication.GetRingMessage(update.predecessor, update.successor)
+	if err != nil {
+		b.logger.Error("Failed to encode message", "msg_type", communication.RING, "err", err)
+		return
+	}
+	if err := b.communicator.SendMessage(ctx, update.peer.Address, ringMessage); err != nil {
+		b.logger.Warn("Failed to send links", "peer", update.peer.ID, "err", err)
 	}
 }
@@ -0,0 +1,40 @@
+package bootstrap
+
+import (
+	"context"
+	"dht/communication"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestNotifyNeighborsOfEmptyRing(t *testing.T) {
+	b := NewBootstrap(nil, nil, 0, nil, discardLogger)
+	// The peer left before its neighbors were told, which emptied the ring
+	b.notifyNeighbors(context.Background(), n5)
+}
+
+func TestLiveRingMatchesReplayedRing(t *testing.T) {
+	dir := t.TempDir()
+	b := NewBootstrap(nil, nil, 0, openRingLog(t, dir), discardLogger)
+	moved := communication.NodeInfo{ID: "n5", Address: "127.0.0.1:9999"}
+	// Two joins of n5 that both passed the duplicate check, and a leave
+	for _, record := range []ringRecord{join(n66), join(n5), join(n30), join(moved), leave(n30)} {
+		if err := b.commit(context.Background(), record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	live := b.Peers()
+	if want := []communication.NodeInfo{moved, n66}; !reflect.DeepEqual(live, want) {
+		t.Errorf("live ring %v, want %v", live, want)
+	}
+	b.Close()
+
+	replayed := NewBootstrap(nil, nil, 0, openRingLog(t, dir), discardLogger).Peers()
+	if !reflect.DeepEqual(replayed, live) {
+		t.Errorf("replayed ring %v, live ring was %v", replayed, live)
+	}
+}
@@ -0,0 +1,200 @@
+package bootstrap
+
+import (
+	"bufio"
+	"dht/communication"
+	"dht/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	snapshotFile = "ring.snapshot"
+	walFile      = "ring.wal"
+
+	// compactAfter is the number of logged changes after which the log is folded into a new snapshot
+	compactAfter = 256
+)
+
+// Membership change operations recorded in the log
+const (
+	opJoin  = "join"
+	opLeave = "leave"
+)
+
+// ringRecord is one membership change, stored as a line of JSON in the write-ahead log
+type ringRecord struct {
+	Op      string `json:"op"`
+	ID      string `json:"id"`
+	Address string `json:"address,omitempty"`
+}
+
+// RingLog persists ring membership in a directory as a snapshot of the whole
+// ring plus a write-ahead log of the changes made since. Every change is
+// synced to disk before it is applied, so the ring survives a crash.
+// A nil *RingLog keeps nothing, which leaves the ring in memory only.
+type RingLog struct {
+	dir       string
+	wal       *os.File
+	records   int                      // Changes in the write-ahead log since the last snapshot
+	recovered []communication.NodeInfo // Peers found on disk when the log was opened
+}
+
+// OpenRingLog opens or creates the ring state in dir, recovering the peers it records.
+func OpenRingLog(dir string) (*RingLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	// Start from the last snapshot
+	var peers []communication.NodeInfo
+	content, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, &peers); err != nil {
+			return nil, fmt.Errorf("reading ring snapshot: %w", err)
+		}
+	}
+
+	// Replay the changes made after it
+	walPath := filepath.Join(dir, walFile)
+	records, validSize, err := readWAL(walPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		peers = applyRecord(peers, record)
+	}
+
+	wal, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// Drop a record torn by a crash mid-write so new records start on a clean line
+	if err := wal.Truncate(validSize); err != nil {
+		wal.Close()
+		return nil, err
+	}
+	if _, err := wal.Seek(validSize, 0); err != nil {
+		wal.Close()
+		return nil, err
+	}
+
+	return &RingLog{dir: dir, wal: wal, records: len(records), recovered: peers}, nil
+}
+
+// Peers returns the ring membership recovered from disk
+func (l *RingLog) Peers() []communication.NodeInfo {
+	if l == nil {
+		return nil
+	}
+	return l.recovered
+}
+
+// readWAL returns the complete records in the log and the byte size they take up.
+func readWAL(path string) ([]ringRecord, int64, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var records []ringRecord
+	var size int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// A line without its newline is a record the crash interrupted
+			break
+		}
+		var record ringRecord
+		if json.Unmarshal(line, &record) != nil {
+			break
+		}
+		records = append(records, record)
+		size += int64(len(line))
+	}
+	return records, size, nil
+}
+
+// applyRecord returns peers with one membership change applied
+func applyRecord(peers []communication.NodeInfo, record ringRecord) []communication.NodeInfo {
+	kept := peers[:0:0]
+	for _, peer := range peers {
+		if peer.ID != record.ID {
+			kept = append(kept, peer)
+		}
+	}
+	if record.Op == opJoin {
+		kept = append(kept, communication.NodeInfo{ID: record.ID, Address: record.Address})
+	}
+	return kept
+}
+
+// append durably records one membership change
+func (l *RingLog) append(record ringRecord) error {
+	if l == nil {
+		return nil
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := l.wal.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := l.wal.Sync(); err != nil {
+		return err
+	}
+	l.records++
+	return nil
+}
+
+// Close closes the write-ahead log. It does nothing on a nil log.
+func (l *RingLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.wal.Close()
+}
+
+// NeedsCompaction reports whether enough changes have piled up to write a new snapshot
+func (l *RingLog) NeedsCompaction() bool {
+	return l != nil && l.records >= compactAfter
+}
+
+// Compact writes peers as the new snapshot and empties the write-ahead log
+func (l *RingLog) Compact(peers []communication.NodeInfo) error {
+	if l == nil {
+		return nil
+	}
+	content, err := json.Marshal(peers)
+	if err != nil {
+		return err
+	}
+
+	if err := util.WriteFileAtomic(filepath.Join(l.dir, snapshotFile), content); err != nil {
+		return err
+	}
+
+	// The snapshot now covers everything in the log. Records are idempotent,
+	// so a crash before the truncate only means replaying them once more.
+	if err := l.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.wal.Seek(0, 0); err != nil {
+		return err
+	}
+	l.records = 0
+	return nil
+}
@@ -0,0 +1,154 @@
+package bootstrap
+
+import (
+	"dht/communication"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var (
+	n5  = communication.NodeInfo{ID: "n5", Address: "127.0.0.1:9005"}
+	n30 = communication.NodeInfo{ID: "n30", Address: "127.0.0.1:9030"}
+	n66 = communication.NodeInfo{ID: "n66", Address: "127.0.0.1:9066"}
+)
+
+// openRingLog opens the ring state in dir and closes it when the test ends
+func openRingLog(t *testing.T, dir string) *RingLog {
+	t.Helper()
+	ringLog, err := OpenRingLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ringLog.Close() })
+	return ringLog
+}
+
+// record appends membership changes to ringLog
+func record(t *testing.T, ringLog *RingLog, records ...ringRecord) {
+	t.Helper()
+	for _, record := range records {
+		if err := ringLog.append(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func join(peer communication.NodeInfo) ringRecord {
+	return ringRecord{Op: opJoin, ID: peer.ID, Address: peer.Address}
+}
+
+func leave(peer communication.NodeInfo) ringRecord {
+	return ringRecord{Op: opLeave, ID: peer.ID}
+}
+
+func assertPeers(t *testing.T, ringLog *RingLog, want ...communication.NodeInfo) {
+	t.Helper()
+	if got := ringLog.Peers(); !reflect.DeepEqual(got, want) && (len(got) != 0 || len(want) != 0) {
+		t.Errorf("recovered %v, want %v", got, want)
+	}
+}
+
+func TestRingLogRecoversFromWAL(t *testing.T) {
+	dir := t.TempDir()
+	ringLog := openRingLog(t, dir)
+	assertPeers(t, ringLog)
+	record(t, ringLog, join(n5), join(n66), join(n30), leave(n66))
+	ringLog.Close()
+
+	assertPeers(t, openRingLog(t, dir), n5, n30)
+}
+
+func TestRingLogRejoinReplacesAddress(t *testing.T) {
+	dir := t.TempDir()
+	moved := communication.NodeInfo{ID: "n5", Address: "127.0.0.1:9999"}
+	ringLog := openRingLog(t, dir)
+	record(t, ringLog, join(n5), join(n66), join(moved))
+	ringLog.Close()
+
+	assertPeers(t, openRingLog(t, dir), n66, moved)
+}
+
+func TestRingLogRecoversFromSnapshotAndWAL(t *testing.T) {
+	dir := t.TempDir()
+	ringLog := openRingLog(t, dir)
+	record(t, ringLog, join(n5), join(n66))
+	if err := ringLog.Compact([]communication.NodeInfo{n5, n66}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, walFile)); err != nil || info.Size() != 0 {
+		t.Fatalf("write-ahead log after compaction: %v, %v", info, err)
+	}
+	record(t, ringLog, leave(n5), join(n30))
+	ringLog.Close()
+
+	assertPeers(t, openRingLog(t, dir), n66, n30)
+}
+
+func TestRingLogDropsTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	ringLog := openRingLog(t, dir)
+	record(t, ringLog, join(n5))
+	ringLog.Close()
+
+	// A crash in the middle of writing the next record
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.WriteString(`{"op":"join","id":"n6`)
+	wal.Close()
+
+	ringLog = openRingLog(t, dir)
+	assertPeers(t, ringLog, n5)
+	record(t, ringLog, join(n66))
+	ringLog.Close()
+
+	assertPeers(t, openRingLog(t, dir), n5, n66)
+}
+
+func TestRingLogRefusesCorruptSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, snapshotFile), []byte("[{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenRingLog(dir); err == nil {
+		t.Error("opened a ring log with a corrupt snapshot")
+	}
+}
+
+func TestRingLogNeedsCompaction(t *testing.T) {
+	ringLog := openRingLog(t, t.TempDir())
+	for i := 0; i < compactAfter; i++ {
+		if ringLog.NeedsCompaction() {
+			t.Fatalf("needs compaction after %d records", i)
+		}
+		record(t, ringLog, join(n5))
+	}
+	if !ringLog.NeedsCompaction() {
+		t.Errorf("no compaction needed after %d records", compactAfter)
+	}
+	if err := ringLog.Compact([]communication.NodeInfo{n5}); err != nil {
+		t.Fatal(err)
+	}
+	if ringLog.NeedsCompaction() {
+		t.Error("still needs compaction after compacting")
+	}
+}
+
+func TestNilRingLogKeepsNothing(t *testing.T) {
+	var ringLog *RingLog
+	if err := ringLog.append(join(n5)); err != nil {
+		t.Error(err)
+	}
+	if err := ringLog.Compact([]communication.NodeInfo{n5}); err != nil {
+		t.Error(err)
+	}
+	if ringLog.Peers() != nil || ringLog.NeedsCompaction() {
+		t.Error("a nil ring log reported state")
+	}
+	if err := ringLog.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,61 +1,239 @@
 package client
 
 import (
+	"context"
 	"dht/communication"
-	"fmt"
+	"log/slog"
+	"math/rand"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	// layoutTimeout bounds how long a request waits for the ring layout before going through the entry instead
+	layoutTimeout = 2 * time.Second
+	// maxRedirects is how many WRONG_OWNER answers a request follows before it is routed through the ring
+	maxRedirects = 3
+	// pendingTimeout is how long a direct request is remembered in case it is redirected
+	pendingTimeout = 30 * time.Second
+)
+
+// pendingRequest is a direct request that may still be redirected
+type pendingRequest struct {
+	request   *communication.RequestMessage
+	redirects int
+}
+
 // Client represents a client interacting with the DHT
 type Client struct {
-	ID               int
-	reqID            int
-	bootstrapAddress string
-	communicator     *communication.TcpCommunicator // Communicator for messaging
-	mu               sync.Mutex
+	ID           int
+	reqID        int
+	entry        *communication.Failover        // Where requests enter the ring: the given peers, or else the bootstrap replicas
+	apiKeyID     string                         // API key requests are signed with, empty to send unsigned requests
+	apiKeySecret []byte                         // Secret of the API key
+	communicator *communication.TcpCommunicator // Communicator for messaging
+	routes       *routeCache                    // Ring layout for sending requests straight to the owner, nil to always use the entry
+	pending      map[int]*pendingRequest        // Direct requests by request ID
+	trace        bool                           // Ask for the path of every request
+	iterative    bool                           // Find owners with iterative lookups when the route cache can't tell
+	lookupID     atomic.Uint64                  // Last NEXT_HOP_REQUEST sent, so each answer can be matched to its question
+	logger       *slog.Logger
+	mu           sync.Mutex
 }
 
-func NewClient(id int, bootstrapAddress string, communicator *communication.TcpCommunicator) *Client {
+// NewClient creates a client that sends its requests to entryPeers, any of
+// which routes them to the owning peer, or to the bootstrap when none are given.
+func NewClient(id int, bootstrapAddresses, entryPeers []string, apiKeyID string, apiKeySecret []byte, communicator *communication.TcpCommunicator, logger *slog.Logger) *Client {
+	entry := bootstrapAddresses
+	if len(entryPeers) > 0 {
+		// Start at a random peer so clients don't all enter the ring at the same place
+		entry = append([]string{}, entryPeers...)
+		rand.Shuffle(len(entry), func(i, j int) { entry[i], entry[j] = entry[j], entry[i] })
+	}
 	return &Client{
-		ID:               id,
-		reqID:            1,
-		bootstrapAddress: bootstrapAddress,
-		communicator:     communicator,
+		ID:           id,
+		reqID:        1,
+		entry:        communication.NewFailover(entry),
+		apiKeyID:     apiKeyID,
+		apiKeySecret: apiKeySecret,
+		communicator: communicator,
+		pending:      make(map[int]*pendingRequest),
+		logger:       logger,
 	}
 }
 
+// requestLogger returns the client's logger with the fields identifying a request
+func (c *Client) requestLogger(request *communication.RequestMessage) *slog.Logger {
+	return c.logger.With("req_id", request.ReqID, "object_id", request.ObjectID)
+}
+
+// CacheRoutes makes the client fetch the ring layout from its entry and send
+// each request straight to the peer that owns the object. Peers that turn out
+// not to own it answer WRONG_OWNER, which updates the cache.
+func (c *Client) CacheRoutes() {
+	c.routes = newRouteCache()
+	c.refreshRoutes()
+}
+
 func (c *Client) RequestStore(objectID int) {
+	c.sendRequest(communication.STORE, objectID)
+}
+
+func (c *Client) RequestRetrieve(objectID int) {
+	c.sendRequest(communication.RETRIEVE, objectID)
+}
+
+// sendRequest builds, signs and sends a request into the ring
+func (c *Client) sendRequest(operationType communication.OperationType, objectID int) {
 	c.mu.Lock()
 	reqID := c.reqID
 	c.reqID++ // Monotonically increasing
 	c.mu.Unlock()
 
-	requestMessage, err := communication.GetRequestMessage(reqID, communication.STORE, objectID, c.ID)
+	request := &communication.RequestMessage{
+		ReqID:         reqID,
+		OperationType: operationType,
+		ObjectID:      objectID,
+		ClientID:      c.ID,
+		ReplyTo:       c.communicator.AdvertiseAddress(),
+	}
+	if c.apiKeyID != "" {
+		communication.SignRequest(request, c.apiKeyID, c.apiKeySecret)
+	}
+	if c.trace {
+		request.StartTrace(c.communicator.ID())
+	}
 
-	if err == nil {
-		err := c.communicator.SendMessage(c.bootstrapAddress, requestMessage)
+	owner, ok := c.cachedOwner(objectID)
+	if !ok && c.iterative {
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		var path []communication.NodeInfo
+		var err error
+		owner, path, err = c.Lookup(ctx, objectID)
+		cancel()
 		if err != nil {
-			fmt.Println("Error sending request message:", err)
+			c.requestLogger(request).Warn("Lookup failed, routing through the ring", "err", err)
+		} else {
+			c.requestLogger(request).Info("Lookup finished", "peer", owner.ID, "hops", len(path))
+			lookupHops.Observe(float64(len(path)))
+			c.routes.add(owner)
+			ok = true
 		}
-	} else {
-		fmt.Println("Error encoding request message:", err)
 	}
-}
+	if !ok {
+		c.sendThroughEntry(context.Background(), request)
+		return
+	}
 
-func (c *Client) RequestRetrieve(objectID int) {
 	c.mu.Lock()
-	reqID := c.reqID
-	c.reqID++ // Monotonically increasing
+	c.pending[reqID] = &pendingRequest{request: request}
 	c.mu.Unlock()
+	time.AfterFunc(pendingTimeout, func() {
+		c.mu.Lock()
+		delete(c.pending, reqID)
+		c.mu.Unlock()
+	})
+	c.sendDirect(context.Background(), request, owner)
+}
 
-	requestMessage, err := communication.GetRequestMessage(reqID, communication.RETRIEVE, objectID, c.ID)
+// cachedOwner returns the owner of objectID according to the route cache, if there is one
+func (c *Client) cachedOwner(objectID int) (communication.NodeInfo, bool) {
+	if c.routes == nil {
+		return communication.NodeInfo{}, false
+	}
+	owner, ok := c.routes.owner(objectID)
+	if !ok {
+		// Nothing cached yet, give the layout asked for at startup a moment to arrive
+		select {
+		case <-c.routes.waitForUpdate():
+		case <-time.After(layoutTimeout):
+		}
+		owner, ok = c.routes.owner(objectID)
+	}
+	return owner, ok
+}
+
+// sendDirect sends a request to the peer believed to own its object
+func (c *Client) sendDirect(ctx context.Context, request *communication.RequestMessage, owner communication.NodeInfo) {
+	direct := *request
+	direct.Flags |= communication.FLAG_DIRECT
+	requestMessage, err := communication.EncodeRequestMessage(&direct)
+	if err != nil {
+		c.requestLogger(request).Error("Failed to encode message", "msg_type", communication.REQUEST, "err", err)
+		return
+	}
+	if err := c.communicator.SendMessage(ctx, owner.Address, requestMessage); err != nil {
+		c.requestLogger(request).Warn("Failed to send request to owner, routing through the ring", "peer", owner.ID, "err", err)
+		if c.routes != nil {
+			c.routes.remove(owner.ID)
+			c.refreshRoutes()
+		}
+		c.sendThroughEntry(ctx, request)
+	}
+}
+
+// sendThroughEntry sends a request to the entry, which routes it to the owner
+func (c *Client) sendThroughEntry(ctx context.Context, request *communication.RequestMessage) {
+	requestMessage, err := communication.EncodeRequestMessage(request)
 
 	if err == nil {
-		err := c.communicator.SendMessage(c.bootstrapAddress, requestMessage)
+		err := c.entry.Send(ctx, c.communicator, requestMessage)
 		if err != nil {
-			fmt.Println("Error sending request message:", err)
+			c.requestLogger(request).Error("Failed to send request", "err", err)
 		}
 	} else {
-		fmt.Println("Error encoding request message:", err)
+		c.requestLogger(request).Error("Failed to encode message", "msg_type", communication.REQUEST, "err", err)
+	}
+}
+
+// refreshRoutes asks the entry for the current ring layout and replaces the cached one
+func (c *Client) refreshRoutes() {
+	layoutRequest, err := communication.GetLayoutRequestMessage(c.communicator.AdvertiseAddress())
+	if err != nil {
+		c.logger.Error("Failed to encode message", "msg_type", communication.LAYOUT_REQUEST, "err", err)
+		return
+	}
+	go func() {
+		answer, err := c.askEntry(context.Background(), layoutRequest)
+		if err != nil {
+			c.logger.Warn("Failed to request ring layout", "err", err)
+			return
+		}
+		layout, ok := answer.(*communication.LayoutMessage)
+		if !ok {
+			c.logger.Warn("Failed to request ring layout", "err", errUnexpectedAnswer)
+			return
+		}
+		if len(layout.Peers) > 0 {
+			c.routes.replace(layout.Peers)
+		}
+	}()
+}
+
+// HandleWrongOwner resends a direct request that reached the wrong peer, to
+// the owner it named or else through the entry, and refreshes the layout.
+func (c *Client) HandleWrongOwner(ctx context.Context, redirect *communication.WrongOwnerMessage) {
+	c.mu.Lock()
+	pending, ok := c.pending[redirect.ReqID]
+	if ok {
+		pending.redirects++
 	}
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if c.routes != nil {
+		c.refreshRoutes()
+	}
+	if redirect.Owner.ID != "" && pending.redirects <= maxRedirects {
+		c.routes.add(redirect.Owner)
+		c.sendDirect(ctx, pending.request, redirect.Owner)
+		return
+	}
+	c.mu.Lock()
+	delete(c.pending, redirect.ReqID)
+	c.mu.Unlock()
+	c.sendThroughEntry(ctx, pending.request)
 }
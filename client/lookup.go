@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"dht/communication"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// lookupTimeout bounds a whole iterative lookup
+	lookupTimeout = 10 * time.Second
+	// lookupHopTimeout is how long one hop has to answer before the next candidate is asked
+	lookupHopTimeout = time.Second
+	// maxLookupHops stops a lookup that keeps going around the ring
+	maxLookupHops = 64
+)
+
+// UseIterativeLookup makes the client find the owner of an object itself,
+// asking one peer after another for the next hop, when the route cache can't
+// tell. The client keeps the timeouts and skips hops that don't answer.
+func (c *Client) UseIterativeLookup() {
+	c.iterative = true
+}
+
+// Lookup walks the ring from the entry to the peer owning objectID, returning
+// the owner and the peers asked along the way.
+func (c *Client) Lookup(ctx context.Context, objectID int) (communication.NodeInfo, []communication.NodeInfo, error) {
+	var candidates []communication.NodeInfo
+	for _, address := range c.entry.Addresses() {
+		candidates = append(candidates, communication.NodeInfo{Address: address})
+	}
+
+	var path []communication.NodeInfo
+	visited := make(map[string]bool)
+	for len(path) < maxLookupHops {
+		reply, err := c.askNextHop(ctx, candidates, objectID)
+		if err != nil {
+			return communication.NodeInfo{}, path, err
+		}
+		if visited[reply.From.ID] {
+			return communication.NodeInfo{}, path, fmt.Errorf("lookup came back to %s without finding the owner", reply.From.ID)
+		}
+		visited[reply.From.ID] = true
+		path = append(path, reply.From)
+		if reply.Owner {
+			return reply.From, path, nil
+		}
+		candidates = reply.Next
+	}
+	return communication.NodeInfo{}, path, fmt.Errorf("no owner found within %d hops", maxLookupHops)
+}
+
+// askNextHop asks the candidates in turn until one answers
+func (c *Client) askNextHop(ctx context.Context, candidates []communication.NodeInfo, objectID int) (*communication.NextHopMessage, error) {
+	if len(candidates) == 0 {
+		return nil, errors.New("no peers to ask")
+	}
+	var errs []error
+	for _, candidate := range candidates {
+		reply, err := c.askOne(ctx, candidate.Address, objectID)
+		if err == nil {
+			return reply, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", candidate.Address, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// askOne sends one NEXT_HOP_REQUEST and waits for its answer
+func (c *Client) askOne(ctx context.Context, address string, objectID int) (*communication.NextHopMessage, error) {
+	hopCtx, cancel := context.WithTimeout(ctx, lookupHopTimeout)
+	defer cancel()
+	lookupID := c.lookupID.Add(1)
+	question, err := communication.GetNextHopRequestMessage(lookupID, objectID, c.communicator.AdvertiseAddress())
+	if err != nil {
+		return nil, err
+	}
+	answer, err := c.ask(hopCtx, address, question)
+	if err != nil {
+		return nil, err
+	}
+	reply, ok := answer.(*communication.NextHopMessage)
+	if !ok {
+		return nil, errUnexpectedAnswer
+	}
+	if reply.LookupID != lookupID {
+		return nil, fmt.Errorf("%w: answers lookup %d, asked %d", errUnexpectedAnswer, reply.LookupID, lookupID)
+	}
+	return reply, nil
+}
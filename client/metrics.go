@@ -0,0 +1,6 @@
+package client
+
+import "dht/metrics"
+
+// lookupHops counts the nodes an iterative lookup asked before finding the owner
+var lookupHops = metrics.Default.Histogram("dht_lookup_hops", "Nodes asked by an iterative lookup before it found the owner.", metrics.LinearBuckets(1, 1, 10))
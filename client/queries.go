@@ -0,0 +1,32 @@
+package client
+
+import (
+	"context"
+	"errors"
+)
+
+// errUnexpectedAnswer is returned when a query is answered with the wrong kind of message
+var errUnexpectedAnswer = errors.New("unexpected answer")
+
+// ask sends a question to address and waits for the answer, which comes back
+// on the same connection
+func (c *Client) ask(ctx context.Context, address string, question []byte) (interface{}, error) {
+	answer, err := c.communicator.Call(ctx, address, question)
+	if err != nil {
+		return nil, err
+	}
+	return answer.Payload, nil
+}
+
+// askEntry asks the entry addresses in turn until one answers
+func (c *Client) askEntry(ctx context.Context, question []byte) (interface{}, error) {
+	var answer interface{}
+	var err error
+	for _, address := range c.entry.Addresses() {
+		answer, err = c.ask(ctx, address, question)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	return answer, err
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"dht/communication"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ringPosition returns where a peer ID sits on the ring
+func ringPosition(id string) int {
+	position, _ := strconv.Atoi(strings.TrimPrefix(id, "n"))
+	return position
+}
+
+// routeCache is the client's copy of the ring layout. A peer owns the objects
+// after the previous peer up to and including its own position, and the lowest
+// peer also owns those past the highest one.
+type routeCache struct {
+	peers   []communication.NodeInfo // Sorted by ring position
+	updated chan struct{}            // Closed and replaced whenever a layout arrives
+	mu      sync.Mutex
+}
+
+func newRouteCache() *routeCache {
+	return &routeCache{updated: make(chan struct{})}
+}
+
+// owner returns the peer believed to own objectID, or false while the cache is empty
+func (r *routeCache) owner(objectID int) (communication.NodeInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.peers) == 0 {
+		return communication.NodeInfo{}, false
+	}
+	index := sort.Search(len(r.peers), func(i int) bool {
+		return ringPosition(r.peers[i].ID) >= objectID
+	})
+	return r.peers[index%len(r.peers)], true
+}
+
+// replace swaps in a layout freshly fetched from the ring
+func (r *routeCache) replace(peers []communication.NodeInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers = append(r.peers[:0:0], peers...)
+	r.sort()
+	close(r.updated)
+	r.updated = make(chan struct{})
+}
+
+// add records a single peer learned from a redirect or lookup. It does nothing on a nil cache.
+func (r *routeCache) add(peer communication.NodeInfo) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removeLocked(peer.ID)
+	r.peers = append(r.peers, peer)
+	r.sort()
+}
+
+// remove drops a peer that could not be reached
+func (r *routeCache) remove(peerID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removeLocked(peerID)
+}
+
+func (r *routeCache) removeLocked(peerID string) {
+	kept := r.peers[:0]
+	for _, peer := range r.peers {
+		if peer.ID != peerID {
+			kept = append(kept, peer)
+		}
+	}
+	r.peers = kept
+}
+
+func (r *routeCache) sort() {
+	sort.Slice(r.peers, func(i, j int) bool {
+		return ringPosition(r.peers[i].ID) < ringPosition(r.peers[j].ID)
+	})
+}
+
+// waitForUpdate returns a channel closed when the next layout arrives
+func (r *routeCache) waitForUpdate() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.updated
+}
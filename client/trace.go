@@ -0,0 +1,24 @@
+package client
+
+import (
+	"dht/communication"
+	"fmt"
+	"strings"
+)
+
+// TraceRequests makes the client ask for the path of every request, which
+// comes back with the result.
+func (c *Client) TraceRequests() {
+	c.trace = true
+}
+
+// FormatTrace renders a request path one hop per line, with the time each
+// hop was reached relative to the first.
+func FormatTrace(trace []communication.Hop) string {
+	var b strings.Builder
+	for i, hop := range trace {
+		elapsed := hop.Time.Sub(trace[0].Time)
+		fmt.Fprintf(&b, "  %2d  %-12s +%v\n", i, hop.Node, elapsed)
+	}
+	return b.String()
+}
@@ -0,0 +1,278 @@
+package communication
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Reasons a JOIN fails authentication.
+var (
+	ErrJoinUnsigned     = errors.New("join is not signed")
+	ErrJoinBadSignature = errors.New("join signature does not match")
+	ErrJoinExpired      = errors.New("join timestamp outside the accepted window")
+)
+
+// Reasons a LEAVE fails authentication.
+var (
+	ErrLeaveUnsigned     = errors.New("leave is not signed")
+	ErrLeaveBadSignature = errors.New("leave signature does not match")
+	ErrLeaveExpired      = errors.New("leave timestamp outside the accepted window")
+)
+
+// Reasons a signed REQUEST fails authentication.
+var (
+	ErrRequestUnsigned     = errors.New("request is not signed")
+	ErrRequestBadSignature = errors.New("request signature does not match")
+	ErrRequestExpired      = errors.New("request timestamp outside the accepted window")
+)
+
+// Reasons a message between bootstrap replicas fails authentication.
+var (
+	ErrConsensusUnsigned     = errors.New("replica message is not signed")
+	ErrConsensusBadSignature = errors.New("replica message signature does not match")
+)
+
+// Reasons a membership gossip message fails authentication.
+var (
+	ErrGossipUnsigned     = errors.New("gossip is not signed")
+	ErrGossipBadSignature = errors.New("gossip signature does not match")
+)
+
+// ErrReplayed is returned for a signed message whose nonce was already seen.
+var ErrReplayed = errors.New("message replayed")
+
+// nonceSize is the length of the random nonce in every signed message
+const nonceSize = 16
+
+// replaySweepInterval is how often a ReplayCache forgets expired nonces
+const replaySweepInterval = time.Minute
+
+// newNonce returns a fresh random nonce for a message about to be signed
+func newNonce() []byte {
+	nonce := make([]byte, nonceSize)
+	rand.Read(nonce)
+	return nonce
+}
+
+// ReplayCache remembers the nonces of signed messages for as long as their
+// timestamps are accepted, so a captured message can't be acted on twice.
+type ReplayCache struct {
+	seen      map[string]time.Time // Expiry by nonce
+	nextSweep time.Time
+	mu        sync.Mutex
+}
+
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{seen: make(map[string]time.Time)}
+}
+
+// check records a nonce until expires, failing if it is recorded already.
+func (c *ReplayCache) check(nonce []byte, expires, now time.Time) error {
+	if len(nonce) != nonceSize {
+		return fmt.Errorf("nonce is %d bytes, expected %d", len(nonce), nonceSize)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.After(c.nextSweep) {
+		for key, until := range c.seen {
+			if now.After(until) {
+				delete(c.seen, key)
+			}
+		}
+		c.nextSweep = now.Add(replaySweepInterval)
+	}
+	if until, ok := c.seen[string(nonce)]; ok && !now.After(until) {
+		return ErrReplayed
+	}
+	c.seen[string(nonce)] = expires
+	return nil
+}
+
+// computeMAC signs the identity, address, timestamp and nonce of a JOIN. The fields
+// are length-prefixed exactly as on the wire so no two JOINs share an input.
+func (m *JoinMessage) computeMAC(secret []byte) []byte {
+	w := &wireWriter{}
+	w.string("JOIN")
+	w.string(m.PeerID)
+	w.string(m.Address)
+	w.int64(m.Timestamp)
+	w.bytes(m.Nonce)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(w.buf)
+	return mac.Sum(nil)
+}
+
+// VerifyJoin checks a JOIN's signature, that it was signed within maxSkew of
+// now and that seen has not been shown its nonce before.
+func VerifyJoin(secret []byte, join *JoinMessage, now time.Time, maxSkew time.Duration, seen *ReplayCache) error {
+	if len(join.MAC) == 0 {
+		return ErrJoinUnsigned
+	}
+	if !hmac.Equal(join.MAC, join.computeMAC(secret)) {
+		return ErrJoinBadSignature
+	}
+	skew := now.Sub(time.Unix(join.Timestamp, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("%w: signed %v away from now", ErrJoinExpired, skew.Round(time.Second))
+	}
+	return seen.check(join.Nonce, time.Unix(join.Timestamp, 0).Add(maxSkew), now)
+}
+
+// ValidateJoin checks a JOIN's signature when a secret is given, and that it
+// carries a peer ID the ring can order and an address it can be reached on.
+func ValidateJoin(secret []byte, join *JoinMessage, now time.Time, maxSkew time.Duration, seen *ReplayCache) error {
+	if len(secret) > 0 {
+		if err := VerifyJoin(secret, join, now, maxSkew, seen); err != nil {
+			return err
+		}
+	}
+	if !ValidPeerID(join.PeerID) {
+		return fmt.Errorf("invalid peer ID %q, expected n<number>", join.PeerID)
+	}
+	if _, _, err := net.SplitHostPort(join.Address); err != nil {
+		return fmt.Errorf("invalid address %q: %w", join.Address, err)
+	}
+	return nil
+}
+
+// computeMAC signs everything in a LEAVE except the MAC itself.
+func (m *LeaveMessage) computeMAC(secret []byte) []byte {
+	w := &wireWriter{}
+	w.string("LEAVE")
+	w.nodeInfo(m.Node)
+	w.nodeInfo(m.Predecessor)
+	w.nodeInfo(m.Successor)
+	w.int64(m.Timestamp)
+	w.bytes(m.Nonce)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(w.buf)
+	return mac.Sum(nil)
+}
+
+// ValidateLeave checks a LEAVE's signature when a secret is given, the same
+// way as for the JOIN that brought the peer in.
+func ValidateLeave(secret []byte, leave *LeaveMessage, now time.Time, maxSkew time.Duration, seen *ReplayCache) error {
+	if len(secret) == 0 {
+		return nil
+	}
+	if len(leave.MAC) == 0 {
+		return ErrLeaveUnsigned
+	}
+	if !hmac.Equal(leave.MAC, leave.computeMAC(secret)) {
+		return ErrLeaveBadSignature
+	}
+	skew := now.Sub(time.Unix(leave.Timestamp, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("%w: signed %v away from now", ErrLeaveExpired, skew.Round(time.Second))
+	}
+	return seen.check(leave.Nonce, time.Unix(leave.Timestamp, 0).Add(maxSkew), now)
+}
+
+// computeSignature signs everything in a REQUEST except the signature itself.
+func (m *RequestMessage) computeSignature(secret []byte) []byte {
+	w := &wireWriter{}
+	w.string("REQUEST")
+	w.int(m.ReqID)
+	w.uint8(uint8(m.OperationType))
+	w.int(m.ObjectID)
+	w.int(m.ClientID)
+	w.string(m.ReplyTo)
+	w.string(m.KeyID)
+	w.int64(m.Timestamp)
+	w.bytes(m.Nonce)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(w.buf)
+	return mac.Sum(nil)
+}
+
+// SignRequest stamps a request with the current time and a nonce and signs it with an API key.
+func SignRequest(request *RequestMessage, keyID string, secret []byte) {
+	request.KeyID = keyID
+	request.Timestamp = time.Now().Unix()
+	request.Nonce = newNonce()
+	request.Signature = request.computeSignature(secret)
+}
+
+// VerifyRequest checks a request's signature against the secret of its key,
+// that it was signed within maxSkew of now and that it is not a replay.
+func VerifyRequest(secret []byte, request *RequestMessage, now time.Time, maxSkew time.Duration, seen *ReplayCache) error {
+	if request.KeyID == "" || len(request.Signature) == 0 {
+		return ErrRequestUnsigned
+	}
+	if !hmac.Equal(request.Signature, request.computeSignature(secret)) {
+		return ErrRequestBadSignature
+	}
+	skew := now.Sub(time.Unix(request.Timestamp, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("%w: signed %v away from now", ErrRequestExpired, skew.Round(time.Second))
+	}
+	return seen.check(request.Nonce, time.Unix(request.Timestamp, 0).Add(maxSkew), now)
+}
+
+// signedMessage is a message authenticated with a MAC: between bootstrap
+// replicas that don't use TLS, or gossip between peers sharing the join secret.
+type signedMessage interface {
+	payload
+	signedFields(w *wireWriter)
+	mac() []byte
+	setMAC(mac []byte)
+}
+
+// messageMAC signs every field of a message but the MAC, behind its type
+func messageMAC(message signedMessage, secret []byte) []byte {
+	w := &wireWriter{}
+	w.uint8(uint8(message.messageType()))
+	message.signedFields(w)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(w.buf)
+	return mac.Sum(nil)
+}
+
+// encodeSigned signs a message when a secret is given and encodes it
+func encodeSigned(message signedMessage, secret []byte) ([]byte, error) {
+	if len(secret) > 0 {
+		message.setMAC(messageMAC(message, secret))
+	}
+	return encodeMessage(message)
+}
+
+// verifyMAC checks the MAC of a signed message, failing with unsigned or bad
+func verifyMAC(secret []byte, message signedMessage, unsigned, bad error) error {
+	if len(message.mac()) == 0 {
+		return unsigned
+	}
+	if !hmac.Equal(message.mac(), messageMAC(message, secret)) {
+		return bad
+	}
+	return nil
+}
+
+// VerifyConsensus checks the MAC of a message between bootstrap replicas.
+func VerifyConsensus(secret []byte, message interface{}) error {
+	switch signed := message.(type) {
+	case *VoteRequestMessage, *VoteResponseMessage, *AppendEntriesMessage, *AppendResponseMessage:
+		return verifyMAC(secret, signed.(signedMessage), ErrConsensusUnsigned, ErrConsensusBadSignature)
+	default:
+		return fmt.Errorf("%T is not a replica message", message)
+	}
+}
+
+// VerifyGossip checks the MAC of a membership gossip message.
+func VerifyGossip(secret []byte, message interface{}) error {
+	switch signed := message.(type) {
+	case *PingMessage, *PingReqMessage, *AckMessage, *SyncMessage:
+		return verifyMAC(secret, signed.(signedMessage), ErrGossipUnsigned, ErrGossipBadSignature)
+	default:
+		return fmt.Errorf("%T is not a gossip message", message)
+	}
+}
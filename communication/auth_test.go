@@ -0,0 +1,261 @@
+package communication
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var (
+	testSecret   = []byte("join secret")
+	testSkew     = 30 * time.Second
+	testSignedAt = time.Unix(1728715564, 0)
+)
+
+// signedJoin returns a JOIN from n5 signed with testSecret at testSignedAt
+func signedJoin() *JoinMessage {
+	join := &JoinMessage{PeerID: "n5", Address: "127.0.0.1:8888", Timestamp: testSignedAt.Unix(), Nonce: newNonce()}
+	join.MAC = join.computeMAC(testSecret)
+	return join
+}
+
+func TestVerifyJoin(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(join *JoinMessage)
+		now    time.Time
+		want   error
+	}{
+		{"valid", func(*JoinMessage) {}, testSignedAt, nil},
+		{"unsigned", func(join *JoinMessage) { join.MAC = nil }, testSignedAt, ErrJoinUnsigned},
+		{"other peer ID", func(join *JoinMessage) { join.PeerID = "n6" }, testSignedAt, ErrJoinBadSignature},
+		{"other address", func(join *JoinMessage) { join.Address = "127.0.0.1:9999" }, testSignedAt, ErrJoinBadSignature},
+		{"other nonce", func(join *JoinMessage) { join.Nonce = newNonce() }, testSignedAt, ErrJoinBadSignature},
+		{"other secret", func(join *JoinMessage) { join.MAC = join.computeMAC([]byte("guess")) }, testSignedAt, ErrJoinBadSignature},
+		{"too old", func(*JoinMessage) {}, testSignedAt.Add(testSkew + time.Second), ErrJoinExpired},
+		{"from the future", func(*JoinMessage) {}, testSignedAt.Add(-testSkew - time.Second), ErrJoinExpired},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			join := signedJoin()
+			test.tamper(join)
+			err := VerifyJoin(testSecret, join, test.now, testSkew, NewReplayCache())
+			if !errors.Is(err, test.want) {
+				t.Errorf("err = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyJoinRefusesReplays(t *testing.T) {
+	seen := NewReplayCache()
+	join := signedJoin()
+	if err := VerifyJoin(testSecret, join, testSignedAt, testSkew, seen); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyJoin(testSecret, join, testSignedAt.Add(time.Second), testSkew, seen); !errors.Is(err, ErrReplayed) {
+		t.Errorf("replayed JOIN: err = %v, want %v", err, ErrReplayed)
+	}
+	if err := VerifyJoin(testSecret, signedJoin(), testSignedAt, testSkew, seen); err != nil {
+		t.Errorf("fresh JOIN: %v", err)
+	}
+}
+
+func TestValidateJoin(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  []byte
+		join    *JoinMessage
+		invalid bool
+	}{
+		{"signed", testSecret, signedJoin(), false},
+		{"unsigned without a secret", nil, &JoinMessage{PeerID: "n5", Address: "127.0.0.1:8888"}, false},
+		{"unsigned with a secret", testSecret, &JoinMessage{PeerID: "n5", Address: "127.0.0.1:8888", Timestamp: testSignedAt.Unix()}, true},
+		{"peer ID off the ring", nil, &JoinMessage{PeerID: "bootstrap", Address: "127.0.0.1:8888"}, true},
+		{"leading zero", nil, &JoinMessage{PeerID: "n05", Address: "127.0.0.1:8888"}, true},
+		{"address without a port", nil, &JoinMessage{PeerID: "n5", Address: "127.0.0.1"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateJoin(test.secret, test.join, testSignedAt, testSkew, NewReplayCache())
+			if invalid := err != nil; invalid != test.invalid {
+				t.Errorf("err = %v, want invalid %v", err, test.invalid)
+			}
+		})
+	}
+}
+
+func TestReplayCacheForgetsExpiredNonces(t *testing.T) {
+	seen := NewReplayCache()
+	nonce := newNonce()
+	expires := testSignedAt.Add(testSkew)
+	if err := seen.check(nonce, expires, testSignedAt); err != nil {
+		t.Fatal(err)
+	}
+	later := expires.Add(replaySweepInterval + time.Second)
+	if err := seen.check(nonce, later.Add(testSkew), later); err != nil {
+		t.Errorf("nonce past its expiry: %v", err)
+	}
+	if len(seen.seen) != 1 {
+		t.Errorf("cache holds %d nonces, want 1", len(seen.seen))
+	}
+	if err := seen.check([]byte("short"), expires, testSignedAt); err == nil {
+		t.Error("accepted a nonce of the wrong length")
+	}
+}
+
+// signedRequest returns a STORE of object 65 for client 1 signed with testSecret at testSignedAt
+func signedRequest() *RequestMessage {
+	request := &RequestMessage{ReqID: 1, OperationType: STORE, ObjectID: 65, ClientID: 1, ReplyTo: "127.0.0.1:9100", KeyID: "lab", Timestamp: testSignedAt.Unix(), Nonce: newNonce()}
+	request.Signature = request.computeSignature(testSecret)
+	return request
+}
+
+func TestVerifyRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(request *RequestMessage)
+		now    time.Time
+		want   error
+	}{
+		{"valid", func(*RequestMessage) {}, testSignedAt, nil},
+		{"routing fields changed", func(request *RequestMessage) {
+			request.Flags = FLAG_TRACE
+			request.AddHop("n5")
+		}, testSignedAt, nil},
+		{"unsigned", func(request *RequestMessage) { request.Signature = nil }, testSignedAt, ErrRequestUnsigned},
+		{"no key", func(request *RequestMessage) { request.KeyID = "" }, testSignedAt, ErrRequestUnsigned},
+		{"other object", func(request *RequestMessage) { request.ObjectID = 66 }, testSignedAt, ErrRequestBadSignature},
+		{"other client", func(request *RequestMessage) { request.ClientID = 2 }, testSignedAt, ErrRequestBadSignature},
+		{"other operation", func(request *RequestMessage) { request.OperationType = RETRIEVE }, testSignedAt, ErrRequestBadSignature},
+		{"other reply address", func(request *RequestMessage) { request.ReplyTo = "127.0.0.1:6666" }, testSignedAt, ErrRequestBadSignature},
+		{"other nonce", func(request *RequestMessage) { request.Nonce = newNonce() }, testSignedAt, ErrRequestBadSignature},
+		{"too old", func(*RequestMessage) {}, testSignedAt.Add(testSkew + time.Second), ErrRequestExpired},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := signedRequest()
+			test.tamper(request)
+			err := VerifyRequest(testSecret, request, test.now, testSkew, NewReplayCache())
+			if !errors.Is(err, test.want) {
+				t.Errorf("err = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyRequestRefusesReplays(t *testing.T) {
+	seen := NewReplayCache()
+	request := signedRequest()
+	if err := VerifyRequest(testSecret, request, testSignedAt, testSkew, seen); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyRequest(testSecret, request, testSignedAt, testSkew, seen); !errors.Is(err, ErrReplayed) {
+		t.Errorf("replayed REQUEST: err = %v, want %v", err, ErrReplayed)
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	request := &RequestMessage{ReqID: 1, OperationType: RETRIEVE, ObjectID: 66, ClientID: 1, ReplyTo: "127.0.0.1:9100"}
+	SignRequest(request, "lab", testSecret)
+	if request.KeyID != "lab" || len(request.Nonce) != nonceSize {
+		t.Fatalf("signed request %+v", request)
+	}
+	if err := VerifyRequest(testSecret, request, time.Now(), testSkew, NewReplayCache()); err != nil {
+		t.Error(err)
+	}
+}
+
+// signedLeave returns a LEAVE from n5 signed with testSecret at testSignedAt
+func signedLeave() *LeaveMessage {
+	leave := &LeaveMessage{
+		Node:        NodeInfo{ID: "n5", Address: "127.0.0.1:8888"},
+		Predecessor: NodeInfo{ID: "n1", Address: "127.0.0.1:8881"},
+		Successor:   NodeInfo{ID: "n66", Address: "127.0.0.1:8866"},
+		Timestamp:   testSignedAt.Unix(),
+		Nonce:       newNonce(),
+	}
+	leave.MAC = leave.computeMAC(testSecret)
+	return leave
+}
+
+func TestValidateLeave(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret []byte
+		tamper func(leave *LeaveMessage)
+		now    time.Time
+		want   error
+	}{
+		{"valid", testSecret, func(*LeaveMessage) {}, testSignedAt, nil},
+		{"no secret configured", nil, func(leave *LeaveMessage) { leave.MAC = nil }, testSignedAt, nil},
+		{"unsigned", testSecret, func(leave *LeaveMessage) { leave.MAC = nil }, testSignedAt, ErrLeaveUnsigned},
+		{"other node", testSecret, func(leave *LeaveMessage) { leave.Node.ID = "n6" }, testSignedAt, ErrLeaveBadSignature},
+		{"other successor", testSecret, func(leave *LeaveMessage) { leave.Successor.Address = "127.0.0.1:6666" }, testSignedAt, ErrLeaveBadSignature},
+		{"too old", testSecret, func(*LeaveMessage) {}, testSignedAt.Add(testSkew + time.Second), ErrLeaveExpired},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			leave := signedLeave()
+			test.tamper(leave)
+			err := ValidateLeave(test.secret, leave, test.now, testSkew, NewReplayCache())
+			if !errors.Is(err, test.want) {
+				t.Errorf("err = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateLeaveRefusesReplays(t *testing.T) {
+	seen := NewReplayCache()
+	leave := signedLeave()
+	if err := ValidateLeave(testSecret, leave, testSignedAt, testSkew, seen); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateLeave(testSecret, leave, testSignedAt, testSkew, seen); !errors.Is(err, ErrReplayed) {
+		t.Errorf("replayed LEAVE: err = %v, want %v", err, ErrReplayed)
+	}
+}
+
+func TestVerifyGossip(t *testing.T) {
+	n5 := NodeInfo{ID: "n5", Address: "n5:8888"}
+	dead := []MemberUpdate{{Node: NodeInfo{ID: "n30", Address: "n30:8888"}, State: MemberDead, Incarnation: 2}}
+	tests := []struct {
+		name   string
+		frame  func() ([]byte, error)
+		secret []byte
+		want   error
+	}{
+		{"valid", func() ([]byte, error) { return GetPingMessage(7, n5, dead, testSecret) }, testSecret, nil},
+		{"valid sync", func() ([]byte, error) { return GetSyncMessage(n5, true, dead, testSecret) }, testSecret, nil},
+		{"unsigned", func() ([]byte, error) { return GetPingMessage(7, n5, dead, nil) }, testSecret, ErrGossipUnsigned},
+		{"other secret", func() ([]byte, error) { return GetAckMessage(7, n5, dead, []byte("guess")) }, testSecret, ErrGossipBadSignature},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame, err := test.frame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			message, err := readFrom(t, frame, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyGossip(test.secret, message.Payload); !errors.Is(err, test.want) {
+				t.Errorf("err = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyGossipRefusesTamperedUpdates(t *testing.T) {
+	ping := &PingMessage{Seq: 7, From: NodeInfo{ID: "n5", Address: "n5:8888"}}
+	ping.MAC = messageMAC(ping, testSecret)
+	ping.Updates = []MemberUpdate{{Node: NodeInfo{ID: "n30", Address: "n30:8888"}, State: MemberDead}}
+	if err := VerifyGossip(testSecret, ping); !errors.Is(err, ErrGossipBadSignature) {
+		t.Errorf("err = %v, want %v", err, ErrGossipBadSignature)
+	}
+	if err := VerifyGossip(testSecret, &VoteRequestMessage{}); err == nil {
+		t.Error("verified a replica message as gossip")
+	}
+}
@@ -0,0 +1,104 @@
+package communication
+
+// General ring queries. Each carries a request ID chosen by the asker, which
+// the answer echoes so it can be matched to the question.
+
+// FindSuccessorMessage asks which peer is the successor of a ring position,
+// that is the peer owning it. A peer answers with itself when it owns the
+// position and otherwise with the next peer to ask.
+type FindSuccessorMessage struct {
+	RequestID uint64
+	Position  int
+	ReplyTo   string
+}
+
+// SuccessorMessage answers a FindSuccessorMessage.
+type SuccessorMessage struct {
+	RequestID uint64
+	Position  int
+	Successor NodeInfo
+}
+
+// PredecessorRequestMessage asks a peer for its predecessor.
+type PredecessorRequestMessage struct {
+	RequestID uint64
+	ReplyTo   string
+}
+
+// PredecessorMessage answers a PredecessorRequestMessage. Predecessor has an
+// empty ID when the peer does not know its predecessor.
+type PredecessorMessage struct {
+	RequestID   uint64
+	From        NodeInfo
+	Predecessor NodeInfo
+}
+
+func (m *FindSuccessorMessage) messageType() MessageType { return FIND_SUCCESSOR }
+
+func (m *FindSuccessorMessage) encode(w *wireWriter) {
+	w.uint64(m.RequestID)
+	w.int(m.Position)
+	w.string(m.ReplyTo)
+}
+
+func (m *FindSuccessorMessage) decode(r *wireReader) {
+	m.RequestID = r.uint64()
+	m.Position = r.int()
+	m.ReplyTo = r.string()
+}
+
+func (m *SuccessorMessage) messageType() MessageType { return SUCCESSOR }
+
+func (m *SuccessorMessage) encode(w *wireWriter) {
+	w.uint64(m.RequestID)
+	w.int(m.Position)
+	w.nodeInfo(m.Successor)
+}
+
+func (m *SuccessorMessage) decode(r *wireReader) {
+	m.RequestID = r.uint64()
+	m.Position = r.int()
+	m.Successor = r.nodeInfo()
+}
+
+func (m *PredecessorRequestMessage) messageType() MessageType { return GET_PREDECESSOR }
+
+func (m *PredecessorRequestMessage) encode(w *wireWriter) {
+	w.uint64(m.RequestID)
+	w.string(m.ReplyTo)
+}
+
+func (m *PredecessorRequestMessage) decode(r *wireReader) {
+	m.RequestID = r.uint64()
+	m.ReplyTo = r.string()
+}
+
+func (m *PredecessorMessage) messageType() MessageType { return PREDECESSOR }
+
+func (m *PredecessorMessage) encode(w *wireWriter) {
+	w.uint64(m.RequestID)
+	w.nodeInfo(m.From)
+	w.nodeInfo(m.Predecessor)
+}
+
+func (m *PredecessorMessage) decode(r *wireReader) {
+	m.RequestID = r.uint64()
+	m.From = r.nodeInfo()
+	m.Predecessor = r.nodeInfo()
+}
+
+func GetFindSuccessorMessage(requestID uint64, position int, replyTo string) ([]byte, error) {
+	return encodeMessage(&FindSuccessorMessage{RequestID: requestID, Position: position, ReplyTo: replyTo})
+}
+
+func GetSuccessorMessage(requestID uint64, position int, successor NodeInfo) ([]byte, error) {
+	return encodeMessage(&SuccessorMessage{RequestID: requestID, Position: position, Successor: successor})
+}
+
+func GetPredecessorRequestMessage(requestID uint64, replyTo string) ([]byte, error) {
+	return encodeMessage(&PredecessorRequestMessage{RequestID: requestID, ReplyTo: replyTo})
+}
+
+func GetPredecessorMessage(requestID uint64, from, predecessor NodeInfo) ([]byte, error) {
+	return encodeMessage(&PredecessorMessage{RequestID: requestID, From: from, Predecessor: predecessor})
+}
@@ -0,0 +1,214 @@
+package communication
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrConnectionClosed is returned for frames that could not be written because the connection went away.
+var ErrConnectionClosed = errors.New("connection closed")
+
+// ConnectionOptions controls how established connections are used and kept alive.
+type ConnectionOptions struct {
+	QueueSize        int           // Frames that can wait for the writer before senders block
+	WriteTimeout     time.Duration // Deadline for writing a single frame
+	KeepAlive        time.Duration // TCP keepalive period, 0 uses the OS default
+	IdleTimeout      time.Duration // Outgoing connections unused for this long are closed, 0 disables reaping
+	HandshakeTimeout time.Duration // Time allowed for the HELLO exchange on a new connection
+	CallTimeout      time.Duration // Time a Call waits for its reply when the caller sets no deadline
+
+	MaxFrameSize      uint32        // Largest payload accepted from a sender, 0 disables the limit
+	MaxProtocolErrors int           // Recoverable protocol errors tolerated before a sender is disconnected
+	Quarantine        time.Duration // How long a disconnected misbehaving sender is refused
+}
+
+// DefaultConnectionOptions returns the connection settings used when nothing else is configured.
+func DefaultConnectionOptions() ConnectionOptions {
+	return ConnectionOptions{
+		QueueSize:        64,
+		WriteTimeout:     5 * time.Second,
+		KeepAlive:        15 * time.Second,
+		IdleTimeout:      2 * time.Minute,
+		HandshakeTimeout: 5 * time.Second,
+		CallTimeout:      5 * time.Second,
+
+		MaxFrameSize:      1 << 20,
+		MaxProtocolErrors: 3,
+		Quarantine:        time.Minute,
+	}
+}
+
+// outboundFrame is a fully encoded message waiting to be written.
+type outboundFrame struct {
+	data   []byte
+	result chan error // Buffered, receives the outcome of the write
+}
+
+// connection owns an outgoing net.Conn. A single writer goroutine drains the
+// queue so frames from concurrent senders are never interleaved on the wire.
+type connection struct {
+	address      string
+	conn         net.Conn
+	session      session // Negotiated during the handshake
+	queue        chan outboundFrame
+	writeTimeout time.Duration
+	maxFrameSize uint32
+	logger       *slog.Logger  // Carries the remote peer and address
+	calls        *pendingCalls // Calls made on an outgoing connection, nil on accepted ones
+	lastUsed     atomic.Int64  // Unix nanoseconds of the last queued frame
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+// newConnection starts writing to an outgoing connection and reading the
+// replies to the calls made on it.
+func newConnection(address string, conn net.Conn, session session, options ConnectionOptions, logger *slog.Logger) *connection {
+	c := newWriter(address, conn, session, options, logger)
+	c.calls = newPendingCalls()
+	connectionsOpen.Add(1, directionOutgoing)
+	connectionsTotal.Inc(directionOutgoing)
+	go func() {
+		c.readReplies()
+		connectionsOpen.Add(-1, directionOutgoing)
+	}()
+	return c
+}
+
+// newWriter starts writing to a connection whose reads are handled elsewhere,
+// such as an accepted connection that calls are answered on.
+func newWriter(address string, conn net.Conn, session session, options ConnectionOptions, logger *slog.Logger) *connection {
+	c := &connection{
+		address:      address,
+		conn:         conn,
+		session:      session,
+		queue:        make(chan outboundFrame, max(options.QueueSize, 1)),
+		writeTimeout: options.WriteTimeout,
+		maxFrameSize: options.MaxFrameSize,
+		logger:       logger,
+		closed:       make(chan struct{}),
+	}
+	c.touch()
+	go c.writeLoop()
+	return c
+}
+
+// send queues a frame and waits until it has been written or ctx is done.
+// Frames are rewritten in the layout of the negotiated protocol version.
+func (c *connection) send(ctx context.Context, data []byte) error {
+	data, err := convertFrame(data, c.session.version)
+	if err != nil {
+		return err
+	}
+	frame := outboundFrame{data: data, result: make(chan error, 1)}
+	c.touch()
+
+	select {
+	case c.queue <- frame:
+	case <-c.closed:
+		return ErrConnectionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-frame.result:
+		return err
+	case <-c.closed:
+		// The frame may have made it out just before the connection closed
+		select {
+		case err := <-frame.result:
+			return err
+		default:
+			return ErrConnectionClosed
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeLoop is the only goroutine that writes to the underlying connection.
+func (c *connection) writeLoop() {
+	for {
+		select {
+		case frame := <-c.queue:
+			if c.writeTimeout > 0 {
+				c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+			}
+			_, err := c.conn.Write(frame.data)
+			frame.result <- err
+			if err != nil {
+				c.close()
+				return
+			}
+			messagesSent.Inc(frameType(frame.data).String())
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// readReplies passes on the replies to calls made on an outgoing connection
+// and notices when the remote side closes it. Nothing else is expected to
+// arrive, so any other frame or read error ends the connection, failing the
+// calls still waiting on it.
+func (c *connection) readReplies() {
+	defer c.calls.fail(ErrConnectionClosed)
+	defer c.close()
+	for {
+		message, err := ReadMessage(c.conn, c.maxFrameSize)
+		if err != nil {
+			if err != io.EOF && !c.isClosed() {
+				c.logger.Warn("Closing connection", "err", err)
+			}
+			return
+		}
+		messagesReceived.Inc(message.Header.Type.String())
+		reply, ok := message.Payload.(*ReplyMessage)
+		if !ok {
+			c.logger.Warn("Closing connection, expected only replies", "msg_type", message.Header.Type)
+			return
+		}
+		c.calls.deliver(reply)
+	}
+}
+
+func (c *connection) touch() {
+	c.lastUsed.Store(time.Now().UnixNano())
+}
+
+// idleFor reports how long ago the connection was last used.
+func (c *connection) idleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, c.lastUsed.Load()))
+}
+
+func (c *connection) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *connection) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// setKeepAlive enables TCP keepalive on connections that support it.
+func setKeepAlive(conn net.Conn, period time.Duration) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(true)
+		if period > 0 {
+			tcpConn.SetKeepAlivePeriod(period)
+		}
+	}
+}
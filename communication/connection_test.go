@@ -0,0 +1,76 @@
+package communication
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// stalledWriter returns a writer on a connection nobody reads from
+func stalledWriter(t *testing.T, options ConnectionOptions) *connection {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	c := newWriter("n66:8888", client, session{remoteID: "n66", version: ProtocolVersion}, options, discardLogger)
+	t.Cleanup(c.close)
+	return c
+}
+
+func testFrame(t *testing.T) []byte {
+	t.Helper()
+	frame, err := GetRequestMessage(7, STORE, 66, 2, "client:8888")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestConnectionClosesAtWriteDeadline(t *testing.T) {
+	options := DefaultConnectionOptions()
+	options.WriteTimeout = 50 * time.Millisecond
+	c := stalledWriter(t, options)
+
+	if err := c.send(context.Background(), testFrame(t)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if !c.isClosed() {
+		t.Error("connection still open after a write timed out")
+	}
+	if err := c.send(context.Background(), testFrame(t)); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("send after closing: err = %v, want %v", err, ErrConnectionClosed)
+	}
+}
+
+func TestConnectionSendWaitsForRoomInQueue(t *testing.T) {
+	options := DefaultConnectionOptions()
+	options.QueueSize = 1
+	options.WriteTimeout = 0
+	c := stalledWriter(t, options)
+
+	// One frame stuck in the writer, one filling the queue
+	for i := 0; i < 2; i++ {
+		go c.send(context.Background(), testFrame(t))
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(c.queue) < cap(c.queue) {
+		if time.Now().After(deadline) {
+			t.Fatal("queue never filled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.send(ctx, testFrame(t)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Closing wakes the senders still waiting
+	c.close()
+	if err := c.send(context.Background(), testFrame(t)); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("send after closing: err = %v, want %v", err, ErrConnectionClosed)
+	}
+}
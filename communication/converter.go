@@ -1,12 +1,14 @@
 package communication
 
 import (
-	"bytes"
 	"encoding/binary"
-	"encoding/gob"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
 	"net"
+	"regexp"
+	"time"
 )
 
 type MessageType uint8
@@ -18,6 +20,33 @@ const (
 	REQUEST
 	OBJ_STORED
 	OBJ_RETRIEVED
+	HELLO
+	HELLO_ACK
+	HELLO_REJECT
+	JOIN_REJECTED
+	VOTE_REQUEST
+	VOTE_RESPONSE
+	APPEND_ENTRIES
+	APPEND_RESPONSE
+	STABILIZE
+	STABILIZE_REPLY
+	NOTIFY
+	PING
+	PING_REQ
+	ACK
+	SYNC
+	LAYOUT_REQUEST
+	LAYOUT
+	WRONG_OWNER
+	NEXT_HOP_REQUEST
+	NEXT_HOP
+	FIND_SUCCESSOR
+	SUCCESSOR
+	GET_PREDECESSOR
+	PREDECESSOR
+	CALL
+	REPLY
+	LEAVE
 )
 
 const (
@@ -25,23 +54,163 @@ const (
 	RETRIEVE
 )
 
+func (o OperationType) String() string {
+	switch o {
+	case STORE:
+		return "store"
+	case RETRIEVE:
+		return "retrieve"
+	default:
+		return fmt.Sprintf("OperationType(%d)", uint8(o))
+	}
+}
+
+// Status values carried in OBJ_STORED and OBJ_RETRIEVED
+const (
+	STATUS_OK                = 1
+	STATUS_NOT_FOUND         = -1
+	STATUS_PERMISSION_DENIED = -2
+	STATUS_BUSY              = -3
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case JOIN:
+		return "JOIN"
+	case RING:
+		return "RING"
+	case REQUEST:
+		return "REQUEST"
+	case OBJ_STORED:
+		return "OBJ_STORED"
+	case OBJ_RETRIEVED:
+		return "OBJ_RETRIEVED"
+	case HELLO:
+		return "HELLO"
+	case HELLO_ACK:
+		return "HELLO_ACK"
+	case HELLO_REJECT:
+		return "HELLO_REJECT"
+	case JOIN_REJECTED:
+		return "JOIN_REJECTED"
+	case VOTE_REQUEST:
+		return "VOTE_REQUEST"
+	case VOTE_RESPONSE:
+		return "VOTE_RESPONSE"
+	case APPEND_ENTRIES:
+		return "APPEND_ENTRIES"
+	case APPEND_RESPONSE:
+		return "APPEND_RESPONSE"
+	case STABILIZE:
+		return "STABILIZE"
+	case STABILIZE_REPLY:
+		return "STABILIZE_REPLY"
+	case NOTIFY:
+		return "NOTIFY"
+	case PING:
+		return "PING"
+	case PING_REQ:
+		return "PING_REQ"
+	case ACK:
+		return "ACK"
+	case SYNC:
+		return "SYNC"
+	case LAYOUT_REQUEST:
+		return "LAYOUT_REQUEST"
+	case LAYOUT:
+		return "LAYOUT"
+	case WRONG_OWNER:
+		return "WRONG_OWNER"
+	case NEXT_HOP_REQUEST:
+		return "NEXT_HOP_REQUEST"
+	case NEXT_HOP:
+		return "NEXT_HOP"
+	case FIND_SUCCESSOR:
+		return "FIND_SUCCESSOR"
+	case SUCCESSOR:
+		return "SUCCESSOR"
+	case GET_PREDECESSOR:
+		return "GET_PREDECESSOR"
+	case PREDECESSOR:
+		return "PREDECESSOR"
+	case CALL:
+		return "CALL"
+	case REPLY:
+		return "REPLY"
+	case LEAVE:
+		return "LEAVE"
+	default:
+		return fmt.Sprintf("MessageType(%d)", uint8(t))
+	}
+}
+
+// LogValue logs a message type by name, in JSON as well as text
+func (t MessageType) LogValue() slog.Value {
+	return slog.StringValue(t.String())
+}
+
+// ProtocolVersion is the wire format version written into every header.
+// MinProtocolVersion is the oldest version this build can still decode and
+// encode, for peers that don't speak the current one yet.
+const (
+	ProtocolVersion    uint8 = 9
+	MinProtocolVersion uint8 = 7
+)
+
+// Versions that changed a payload layout this build still speaks. Older
+// layouts are written and read by checking the version of the frame.
+const (
+	versionHopCount  uint8 = 8 // Added hop_count to REQUEST
+	versionGossipMAC uint8 = 9 // Added mac to PING, PING_REQ, ACK and SYNC
+)
+
+// headerSize is the encoded size of a MessageHeader: version, type and payload length.
+const headerSize = 6
+
 type MessageHeader struct {
-	Type   MessageType
-	Length uint32
+	Version uint8
+	Type    MessageType
+	Length  uint32
 }
 
 type Message struct {
 	Header  MessageHeader
 	Payload interface{}
+	Sender  string    // Node ID the sending connection proved with its TLS certificate, empty on plain TCP
+	respond Responder // Answers on the incoming connection when the message came through Call, nil otherwise
+}
+
+// NodeInfo pairs a node's identity with the address it can be reached on.
+type NodeInfo struct {
+	ID      string
+	Address string
+}
+
+// peerIDPattern is the only node ID format the ring can order: "n" and a number without leading zeros
+var peerIDPattern = regexp.MustCompile(`^n(0|[1-9][0-9]*)$`)
+
+// ValidPeerID reports whether id is a peer ID with a position on the ring
+func ValidPeerID(id string) bool {
+	return peerIDPattern.MatchString(id)
 }
 
 type JoinMessage struct {
+	PeerID    string
+	Address   string
+	Timestamp int64  // Unix seconds when the JOIN was signed
+	Nonce     []byte // Random, so each signed JOIN is only acted on once
+	MAC       []byte // HMAC-SHA256 over the fields above, empty when no secret is configured
+}
+
+// JoinRejectedMessage tells a peer the bootstrap refused to add it to the ring.
+type JoinRejectedMessage struct {
 	PeerID string
+	Reason string
 }
 
 type RingInformation struct {
-	Predecessor string
-	Successor   string
+	Predecessor NodeInfo
+	Successor   NodeInfo
 }
 
 type RequestMessage struct {
@@ -49,103 +218,343 @@ type RequestMessage struct {
 	OperationType OperationType
 	ObjectID      int
 	ClientID      int
+	ReplyTo       string       // Address of the client waiting for the result
+	KeyID         string       // API key the request is signed with, empty if unsigned
+	Timestamp     int64        // Unix seconds when the request was signed
+	Nonce         []byte       // Random, so each signed request is only served once
+	Signature     []byte       // HMAC-SHA256 over the fields above with the key's secret
+	Flags         RequestFlags // Routing hints, not covered by the signature
+	HopCount      uint8        // Nodes that took the request so far, traced or not
+	Trace         []Hop        // Nodes passed through so far when FLAG_TRACE is set
 }
 
 type ObjectStoredMessage struct {
+	Status   int
 	PeerId   string
 	ObjectID int
 	ClientID int
+	ReplyTo  string
+	Trace    []Hop // Path of a traced request, empty otherwise
 }
 
 type ObjectRetrievedMessage struct {
 	Status   int
-	ObjectId interface{}
+	ObjectId int
+	ReplyTo  string
+	Trace    []Hop // Path of a traced request, empty otherwise
 }
 
-// Register types before decoding
-func init() {
-	gob.Register(JoinMessage{})
-	gob.Register(RingInformation{})
-	gob.Register(RequestMessage{})
-	gob.Register(ObjectStoredMessage{})
-	gob.Register(ObjectRetrievedMessage{})
+// payload is implemented by every message type that can travel on the wire.
+type payload interface {
+	messageType() MessageType
+	encode(w *wireWriter)
+	decode(r *wireReader)
 }
 
-func encodeMessage(msg Message) ([]byte, error) {
-	// Encode payload to binary
-	payloadBytes, err := EncodeToBinary(msg.Payload)
-	if err != nil {
-		return nil, err
+func (m *JoinMessage) messageType() MessageType { return JOIN }
+
+func (m *JoinMessage) encode(w *wireWriter) {
+	w.string(m.PeerID)
+	w.string(m.Address)
+	w.int64(m.Timestamp)
+	w.bytes(m.Nonce)
+	w.bytes(m.MAC)
+}
+
+func (m *JoinMessage) decode(r *wireReader) {
+	m.PeerID = r.string()
+	m.Address = r.string()
+	m.Timestamp = r.int64()
+	m.Nonce = r.bytes()
+	m.MAC = r.bytes()
+}
+
+func (m *JoinRejectedMessage) messageType() MessageType { return JOIN_REJECTED }
+
+func (m *JoinRejectedMessage) encode(w *wireWriter) {
+	w.string(m.PeerID)
+	w.string(m.Reason)
+}
+
+func (m *JoinRejectedMessage) decode(r *wireReader) {
+	m.PeerID = r.string()
+	m.Reason = r.string()
+}
+
+func (m *RingInformation) messageType() MessageType { return RING }
+
+func (m *RingInformation) encode(w *wireWriter) {
+	w.nodeInfo(m.Predecessor)
+	w.nodeInfo(m.Successor)
+}
+
+func (m *RingInformation) decode(r *wireReader) {
+	m.Predecessor = r.nodeInfo()
+	m.Successor = r.nodeInfo()
+}
+
+func (m *RequestMessage) messageType() MessageType { return REQUEST }
+
+func (m *RequestMessage) encode(w *wireWriter) {
+	w.int(m.ReqID)
+	w.uint8(uint8(m.OperationType))
+	w.int(m.ObjectID)
+	w.int(m.ClientID)
+	w.string(m.ReplyTo)
+	w.string(m.KeyID)
+	w.int64(m.Timestamp)
+	w.bytes(m.Nonce)
+	w.bytes(m.Signature)
+	w.uint8(uint8(m.Flags))
+	if w.version >= versionHopCount {
+		w.uint8(m.HopCount)
 	}
+	w.hops(m.Trace)
+}
 
-	// Prepare buffer
-	buf := new(bytes.Buffer)
+func (m *RequestMessage) decode(r *wireReader) {
+	m.ReqID = r.int()
+	m.OperationType = OperationType(r.uint8())
+	m.ObjectID = r.int()
+	m.ClientID = r.int()
+	m.ReplyTo = r.string()
+	m.KeyID = r.string()
+	m.Timestamp = r.int64()
+	m.Nonce = r.bytes()
+	m.Signature = r.bytes()
+	m.Flags = RequestFlags(r.uint8())
+	if r.version >= versionHopCount {
+		m.HopCount = r.uint8()
+	}
+	m.Trace = r.hops()
+}
 
-	// Write header
-	if err := binary.Write(buf, binary.LittleEndian, msg.Header.Type); err != nil {
-		return nil, err
+func (m *ObjectStoredMessage) messageType() MessageType { return OBJ_STORED }
+
+func (m *ObjectStoredMessage) encode(w *wireWriter) {
+	w.int(m.Status)
+	w.string(m.PeerId)
+	w.int(m.ObjectID)
+	w.int(m.ClientID)
+	w.string(m.ReplyTo)
+	w.hops(m.Trace)
+}
+
+func (m *ObjectStoredMessage) decode(r *wireReader) {
+	m.Status = r.int()
+	m.PeerId = r.string()
+	m.ObjectID = r.int()
+	m.ClientID = r.int()
+	m.ReplyTo = r.string()
+	m.Trace = r.hops()
+}
+
+func (m *ObjectRetrievedMessage) messageType() MessageType { return OBJ_RETRIEVED }
+
+func (m *ObjectRetrievedMessage) encode(w *wireWriter) {
+	w.int(m.Status)
+	w.int(m.ObjectId)
+	w.string(m.ReplyTo)
+	w.hops(m.Trace)
+}
+
+func (m *ObjectRetrievedMessage) decode(r *wireReader) {
+	m.Status = r.int()
+	m.ObjectId = r.int()
+	m.ReplyTo = r.string()
+	m.Trace = r.hops()
+}
+
+// newPayload returns an empty payload for the given message type
+func newPayload(messageType MessageType) (payload, error) {
+	switch messageType {
+	case JOIN:
+		return &JoinMessage{}, nil
+	case RING:
+		return &RingInformation{}, nil
+	case REQUEST:
+		return &RequestMessage{}, nil
+	case OBJ_STORED:
+		return &ObjectStoredMessage{}, nil
+	case OBJ_RETRIEVED:
+		return &ObjectRetrievedMessage{}, nil
+	case HELLO:
+		return &HelloMessage{}, nil
+	case HELLO_ACK:
+		return &HelloAckMessage{}, nil
+	case HELLO_REJECT:
+		return &HelloRejectMessage{}, nil
+	case JOIN_REJECTED:
+		return &JoinRejectedMessage{}, nil
+	case VOTE_REQUEST:
+		return &VoteRequestMessage{}, nil
+	case VOTE_RESPONSE:
+		return &VoteResponseMessage{}, nil
+	case APPEND_ENTRIES:
+		return &AppendEntriesMessage{}, nil
+	case APPEND_RESPONSE:
+		return &AppendResponseMessage{}, nil
+	case STABILIZE:
+		return &StabilizeMessage{}, nil
+	case STABILIZE_REPLY:
+		return &StabilizeReplyMessage{}, nil
+	case NOTIFY:
+		return &NotifyMessage{}, nil
+	case PING:
+		return &PingMessage{}, nil
+	case PING_REQ:
+		return &PingReqMessage{}, nil
+	case ACK:
+		return &AckMessage{}, nil
+	case SYNC:
+		return &SyncMessage{}, nil
+	case LAYOUT_REQUEST:
+		return &LayoutRequestMessage{}, nil
+	case LAYOUT:
+		return &LayoutMessage{}, nil
+	case WRONG_OWNER:
+		return &WrongOwnerMessage{}, nil
+	case NEXT_HOP_REQUEST:
+		return &NextHopRequestMessage{}, nil
+	case NEXT_HOP:
+		return &NextHopMessage{}, nil
+	case FIND_SUCCESSOR:
+		return &FindSuccessorMessage{}, nil
+	case SUCCESSOR:
+		return &SuccessorMessage{}, nil
+	case GET_PREDECESSOR:
+		return &PredecessorRequestMessage{}, nil
+	case PREDECESSOR:
+		return &PredecessorMessage{}, nil
+	case CALL:
+		return &CallMessage{}, nil
+	case REPLY:
+		return &ReplyMessage{}, nil
+	case LEAVE:
+		return &LeaveMessage{}, nil
+	default:
+		return nil, ErrUnknownMessageType
 	}
-	if err := binary.Write(buf, binary.LittleEndian, uint32(len(payloadBytes))); err != nil {
+}
+
+// encodeMessage frames a payload behind a header carrying the protocol version, type and length
+func encodeMessage(p payload) ([]byte, error) {
+	return encodeVersion(p, ProtocolVersion)
+}
+
+// encodeVersion frames a payload in the layout of an older protocol version
+func encodeVersion(p payload, version uint8) ([]byte, error) {
+	// Leave room for the header and fill it in once the payload length is known
+	w := &wireWriter{buf: make([]byte, headerSize, 64), version: version}
+	p.encode(w)
+	if w.err != nil {
+		return nil, w.err
+	}
+
+	length := len(w.buf) - headerSize
+	if length > math.MaxUint32 {
+		return nil, fmt.Errorf("payload of %d bytes is too large", length)
+	}
+	w.buf[0] = version
+	w.buf[1] = byte(p.messageType())
+	binary.BigEndian.PutUint32(w.buf[2:headerSize], uint32(length))
+
+	return w.buf, nil
+}
+
+// convertFrame re-encodes a frame in the layout of the protocol version a
+// connection negotiated, along with the frame a CALL or REPLY carries.
+func convertFrame(frame []byte, version uint8) ([]byte, error) {
+	if len(frame) < headerSize || frame[0] == version {
+		return frame, nil
+	}
+	message, err := decodeFrame(MessageHeader{Version: frame[0], Type: MessageType(frame[1]), Length: uint32(len(frame) - headerSize)}, frame[headerSize:])
+	if err != nil {
 		return nil, err
 	}
+	var embedded *[]byte
+	switch payload := message.Payload.(type) {
+	case *CallMessage:
+		embedded = &payload.Frame
+	case *ReplyMessage:
+		embedded = &payload.Frame
+	}
+	if embedded != nil {
+		if *embedded, err = convertFrame(*embedded, version); err != nil {
+			return nil, err
+		}
+	}
+	return encodeVersion(message.Payload.(payload), version)
+}
+
+// frameType reads the message type from the header of an encoded message
+func frameType(frame []byte) MessageType {
+	if len(frame) < headerSize {
+		return MessageType(0xff)
+	}
+	return MessageType(frame[1])
+}
 
-	// Write payload
-	if _, err := buf.Write(payloadBytes); err != nil {
+// ReadMessage reads a complete message from the connection. Frames whose
+// payload is larger than maxFrameSize are refused before anything is allocated
+// for them; 0 disables the limit. Protocol violations are returned as *ProtocolError.
+func ReadMessage(conn net.Conn, maxFrameSize uint32) (*Message, error) {
+	header, payloadBytes, err := readFrame(conn, maxFrameSize)
+	if err != nil {
 		return nil, err
 	}
 
-	return buf.Bytes(), nil
+	if header.Version < MinProtocolVersion || header.Version > ProtocolVersion {
+		return nil, &ProtocolError{Kind: ErrUnsupportedVersion, Header: header}
+	}
+
+	return decodeFrame(header, payloadBytes)
 }
 
-// ReadMessage reads a complete message from the connection
-func ReadMessage(conn net.Conn) (*Message, error) {
+// readFrame reads one header and the payload bytes it announces
+func readFrame(conn net.Conn, maxFrameSize uint32) (MessageHeader, []byte, error) {
 	// Read header first
 	header := MessageHeader{}
-	headerBytes := make([]byte, 5) // 1 byte type + 4 bytes length
+	headerBytes := make([]byte, headerSize)
 
 	// Ensure we read the entire header
 	_, err := io.ReadFull(conn, headerBytes)
 	if err != nil {
-		fmt.Println("Error reading header:", err)
-		return nil, err
+		return header, nil, err
 	}
 
 	// Parse header
-	header.Type = MessageType(headerBytes[0])
-	header.Length = binary.LittleEndian.Uint32(headerBytes[1:5])
+	header.Version = headerBytes[0]
+	header.Type = MessageType(headerBytes[1])
+	header.Length = binary.BigEndian.Uint32(headerBytes[2:headerSize])
+
+	// Never trust the announced length with an allocation
+	if maxFrameSize > 0 && header.Length > maxFrameSize {
+		return header, nil, &ProtocolError{Kind: ErrFrameTooLarge, Header: header, Err: fmt.Errorf("limit is %d bytes", maxFrameSize)}
+	}
 
 	// Read payload
 	payloadBytes := make([]byte, header.Length)
 	_, err = io.ReadFull(conn, payloadBytes)
 	if err != nil {
-		fmt.Println("Error reading payload:", err)
-		return nil, err
+		return header, nil, err
 	}
 
+	return header, payloadBytes, nil
+}
+
+// decodeFrame decodes the payload of a frame according to its header
+func decodeFrame(header MessageHeader, payloadBytes []byte) (*Message, error) {
 	// Decode payload (use appropriate type based on header)
-	var payload interface{}
-	switch header.Type {
-	case JOIN:
-		payload = &JoinMessage{}
-	case RING:
-		payload = &RingInformation{}
-	case REQUEST:
-		payload = &RequestMessage{}
-	case OBJ_STORED:
-		payload = &ObjectStoredMessage{}
-	case OBJ_RETRIEVED:
-		payload = &ObjectRetrievedMessage{}
-	default:
-		err := fmt.Errorf("unknown message type")
-		fmt.Println(err)
-		return nil, err
+	payload, err := newPayload(header.Type)
+	if err != nil {
+		return nil, &ProtocolError{Kind: ErrUnknownMessageType, Header: header}
 	}
 
-	// Decode payload
-	err = DecodeFromBinary(payloadBytes, payload)
-	if err != nil {
-		fmt.Println("Error decoding payload:", err)
-		return nil, err
+	r := &wireReader{buf: payloadBytes, version: header.Version}
+	payload.decode(r)
+	if err := r.finish(); err != nil {
+		return nil, &ProtocolError{Kind: ErrMalformedPayload, Header: header, Err: err}
 	}
 
 	return &Message{
@@ -154,119 +563,70 @@ func ReadMessage(conn net.Conn) (*Message, error) {
 	}, nil
 }
 
-// EncodeToBinary converts a struct to binary bytes using Gob
-func EncodeToBinary(data interface{}) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	encoder := gob.NewEncoder(buf)
-	err := encoder.Encode(data)
-	return buf.Bytes(), err
+// GetJoinMessage builds a JOIN, signing it when a secret is given
+func GetJoinMessage(peerID string, address string, secret []byte) ([]byte, error) {
+	joinMsg := &JoinMessage{
+		PeerID:    peerID,
+		Address:   address,
+		Timestamp: time.Now().Unix(),
+	}
+	if len(secret) > 0 {
+		joinMsg.Nonce = newNonce()
+		joinMsg.MAC = joinMsg.computeMAC(secret)
+	}
+	return encodeMessage(joinMsg)
 }
 
-// DecodeFromBinary converts binary bytes to a struct using Gob
-func DecodeFromBinary(b []byte, data interface{}) error {
-	buf := bytes.NewReader(b)
-	decoder := gob.NewDecoder(buf)
-	return decoder.Decode(data)
+// EncodeJoinMessage encodes a JOIN as is, so it can be passed on with its MAC intact
+func EncodeJoinMessage(join *JoinMessage) ([]byte, error) {
+	return encodeMessage(join)
 }
 
-func GetJoinMessage(peerID string) ([]byte, error) {
-	joinMsg := JoinMessage{
+func GetJoinRejectedMessage(peerID string, reason string) ([]byte, error) {
+	return encodeMessage(&JoinRejectedMessage{
 		PeerID: peerID,
-	}
-	msg := Message{
-		Header: MessageHeader{
-			Type:   JOIN,
-			Length: uint32(binary.Size(joinMsg)),
-		},
-		Payload: joinMsg,
-	}
-	byteMessage, err := encodeMessage(msg)
-	if err != nil {
-		return nil, err
-	}
-
-	return byteMessage, nil
+		Reason: reason,
+	})
 }
 
-func GetRingMessage(predecessor, successor string) ([]byte, error) {
-	ringInfo := RingInformation{
+func GetRingMessage(predecessor, successor NodeInfo) ([]byte, error) {
+	return encodeMessage(&RingInformation{
 		Predecessor: predecessor,
 		Successor:   successor,
-	}
-	msg := Message{
-		Header: MessageHeader{
-			Type:   RING,
-			Length: uint32(binary.Size(ringInfo)),
-		},
-		Payload: ringInfo,
-	}
-	byteMessage, err := encodeMessage(msg)
-	if err != nil {
-		return nil, err
-	}
-
-	return byteMessage, nil
+	})
 }
 
-func GetRequestMessage(reqID int, operationType OperationType, objectID int, clientID int) ([]byte, error) {
-	reqMsg := RequestMessage{
+func GetRequestMessage(reqID int, operationType OperationType, objectID int, clientID int, replyTo string) ([]byte, error) {
+	return encodeMessage(&RequestMessage{
 		ReqID:         reqID,
 		OperationType: operationType,
 		ObjectID:      objectID,
 		ClientID:      clientID,
-	}
-	msg := Message{
-		Header: MessageHeader{
-			Type:   REQUEST,
-			Length: uint32(binary.Size(reqMsg)),
-		},
-		Payload: reqMsg,
-	}
-	byteMessage, err := encodeMessage(msg)
-	if err != nil {
-		return nil, err
-	}
+		ReplyTo:       replyTo,
+	})
+}
 
-	return byteMessage, nil
+// EncodeRequestMessage encodes a request as is, keeping any signature it carries
+func EncodeRequestMessage(request *RequestMessage) ([]byte, error) {
+	return encodeMessage(request)
 }
 
-func GetObjectStoredMessage(peerID string, objectID int, clientID int) ([]byte, error) {
-	objStoredMsg := ObjectStoredMessage{
+func GetObjectStoredMessage(status int, peerID string, objectID int, clientID int, replyTo string, trace []Hop) ([]byte, error) {
+	return encodeMessage(&ObjectStoredMessage{
+		Status:   status,
 		PeerId:   peerID,
 		ObjectID: objectID,
 		ClientID: clientID,
-	}
-	msg := Message{
-		Header: MessageHeader{
-			Type:   OBJ_STORED,
-			Length: uint32(binary.Size(objStoredMsg)),
-		},
-		Payload: objStoredMsg,
-	}
-	byteMessage, err := encodeMessage(msg)
-	if err != nil {
-		return nil, err
-	}
-
-	return byteMessage, nil
+		ReplyTo:  replyTo,
+		Trace:    trace,
+	})
 }
 
-func GetObjectRetrievedMessage(status int, objectID interface{}) ([]byte, error) {
-	objRetrievedMsg := ObjectRetrievedMessage{
+func GetObjectRetrievedMessage(status int, objectID int, replyTo string, trace []Hop) ([]byte, error) {
+	return encodeMessage(&ObjectRetrievedMessage{
 		Status:   status,
 		ObjectId: objectID,
-	}
-	msg := Message{
-		Header: MessageHeader{
-			Type:   OBJ_RETRIEVED,
-			Length: uint32(binary.Size(objRetrievedMsg)),
-		},
-		Payload: objRetrievedMsg,
-	}
-	byteMessage, err := encodeMessage(msg)
-	if err != nil {
-		return nil, err
-	}
-
-	return byteMessage, nil
+		ReplyTo:  replyTo,
+		Trace:    trace,
+	})
 }
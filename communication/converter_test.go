@@ -0,0 +1,207 @@
+package communication
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readFrom feeds frame to ReadMessage over an in-memory connection
+func readFrom(t *testing.T, frame []byte, maxFrameSize uint32) (*Message, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write(frame)
+		client.Close()
+	}()
+	return ReadMessage(server, maxFrameSize)
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	hopTime := time.Unix(0, 1728715564123456789)
+	payloads := []payload{
+		&JoinMessage{PeerID: "n5", Address: "n5:8888", Timestamp: 1728715564, Nonce: make([]byte, nonceSize), MAC: []byte{1, 2, 3}},
+		&JoinRejectedMessage{PeerID: "n5", Reason: "duplicate peer ID"},
+		&RingInformation{Predecessor: NodeInfo{ID: "n1", Address: "n1:8888"}, Successor: NodeInfo{ID: "n66", Address: "n66:8888"}},
+		&RequestMessage{
+			ReqID:         7,
+			OperationType: RETRIEVE,
+			ObjectID:      66,
+			ClientID:      2,
+			ReplyTo:       "client:8888",
+			KeyID:         "lab",
+			Timestamp:     1728715564,
+			Nonce:         []byte{9, 9},
+			Signature:     []byte{4, 5},
+			Flags:         FLAG_DIRECT | FLAG_TRACE,
+			HopCount:      3,
+			Trace:         []Hop{{Node: "client", Time: hopTime}, {Node: "n5", Time: hopTime}},
+		},
+		&ObjectStoredMessage{Status: STATUS_OK, PeerId: "n66", ObjectID: 65, ClientID: 1, ReplyTo: "client:8888"},
+		&ObjectRetrievedMessage{Status: STATUS_NOT_FOUND, ObjectId: 110, ReplyTo: "client:8888", Trace: []Hop{{Node: "n5", Time: hopTime}}},
+		&LeaveMessage{Node: NodeInfo{ID: "n5", Address: "n5:8888"}, Predecessor: NodeInfo{ID: "n1", Address: "n1:8888"}, Timestamp: 1, Nonce: []byte{1}, MAC: []byte{2}},
+		&AppendEntriesMessage{Term: 3, LeaderID: "bootstrap", PrevLogIndex: 4, PrevLogTerm: 2, Entries: []LogEntry{{Term: 3, Command: []byte("join n5")}, {Term: 3}}, LeaderCommit: 4, MAC: []byte{7}},
+		&VoteResponseMessage{Term: 3, VoterID: "b2", Granted: true},
+	}
+	for _, p := range payloads {
+		t.Run(p.messageType().String(), func(t *testing.T) {
+			frame, err := encodeMessage(p)
+			if err != nil {
+				t.Fatalf("encodeMessage: %v", err)
+			}
+			message, err := readFrom(t, frame, 0)
+			if err != nil {
+				t.Fatalf("ReadMessage: %v", err)
+			}
+			if message.Header.Version != ProtocolVersion || message.Header.Type != p.messageType() || int(message.Header.Length) != len(frame)-headerSize {
+				t.Errorf("header = %+v, frame of %d bytes", message.Header, len(frame))
+			}
+			if !reflect.DeepEqual(message.Payload, p) {
+				t.Errorf("decoded %+v, want %+v", message.Payload, p)
+			}
+		})
+	}
+}
+
+func TestOlderVersionLayouts(t *testing.T) {
+	request := &RequestMessage{ReqID: 7, OperationType: STORE, ObjectID: 66, ClientID: 2, ReplyTo: "client:8888", HopCount: 3}
+	ping := &PingMessage{Seq: 7, From: NodeInfo{ID: "n5", Address: "n5:8888"}, MAC: []byte{1, 2}}
+	tests := []struct {
+		name    string
+		payload payload
+		version uint8
+		want    payload
+	}{
+		{"REQUEST without hop_count", request, versionHopCount - 1, &RequestMessage{ReqID: 7, OperationType: STORE, ObjectID: 66, ClientID: 2, ReplyTo: "client:8888"}},
+		{"REQUEST with hop_count", request, versionHopCount, request},
+		{"PING without mac", ping, versionGossipMAC - 1, &PingMessage{Seq: 7, From: ping.From}},
+		{"PING with mac", ping, versionGossipMAC, ping},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame, err := encodeVersion(test.payload, test.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			message, err := readFrom(t, frame, 0)
+			if err != nil {
+				t.Fatalf("ReadMessage: %v", err)
+			}
+			if message.Header.Version != test.version {
+				t.Errorf("version = %d, want %d", message.Header.Version, test.version)
+			}
+			if !reflect.DeepEqual(message.Payload, test.want) {
+				t.Errorf("decoded %+v, want %+v", message.Payload, test.want)
+			}
+		})
+	}
+}
+
+func TestConvertFrame(t *testing.T) {
+	request, err := GetRequestMessage(7, RETRIEVE, 66, 2, "client:8888")
+	if err != nil {
+		t.Fatal(err)
+	}
+	call, err := encodeMessage(&CallMessage{CallID: 3, Frame: request})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same, _ := convertFrame(call, ProtocolVersion); &same[0] != &call[0] {
+		t.Error("re-encoded a frame already in the negotiated version")
+	}
+
+	converted, err := convertFrame(call, MinProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := readFrom(t, converted, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := message.Payload.(*CallMessage)
+	if message.Header.Version != MinProtocolVersion || inner.CallID != 3 || inner.Frame[0] != MinProtocolVersion {
+		t.Errorf("converted to %+v carrying a version %d frame", message.Header, inner.Frame[0])
+	}
+	embedded, err := decodeEmbedded(inner.Frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if embedded.Payload.(*RequestMessage).ObjectID != 66 {
+		t.Errorf("embedded %+v", embedded.Payload)
+	}
+}
+
+func TestReadMessageRejectsTruncatedFrames(t *testing.T) {
+	frame, err := GetJoinMessage("n5", "n5:8888", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cut := range []int{1, headerSize - 1, headerSize, len(frame) - 1} {
+		_, err := readFrom(t, frame[:cut], 0)
+		if !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			t.Errorf("cut at %d: err = %v, want an EOF", cut, err)
+		}
+	}
+}
+
+func TestReadMessageRejectsMalformedFrames(t *testing.T) {
+	join, err := GetJoinMessage("n5", "n5:8888", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reframe copies a frame with its header length adjusted to the payload
+	reframe := func(frame []byte, payloadBytes []byte) []byte {
+		out := append([]byte(nil), frame[:headerSize]...)
+		binary.BigEndian.PutUint32(out[2:headerSize], uint32(len(payloadBytes)))
+		return append(out, payloadBytes...)
+	}
+	withHeader := func(version uint8, messageType MessageType) []byte {
+		out := append([]byte(nil), join...)
+		out[0], out[1] = version, byte(messageType)
+		return out
+	}
+
+	tests := []struct {
+		name  string
+		frame []byte
+		max   uint32
+		kind  error
+	}{
+		{"old version", withHeader(MinProtocolVersion-1, JOIN), 0, ErrUnsupportedVersion},
+		{"newer version", withHeader(ProtocolVersion+1, JOIN), 0, ErrUnsupportedVersion},
+		{"unknown type", withHeader(ProtocolVersion, MessageType(0xee)), 0, ErrUnknownMessageType},
+		{"short payload", reframe(join, join[headerSize:len(join)-1]), 0, ErrMalformedPayload},
+		{"trailing bytes", reframe(join, append(append([]byte(nil), join[headerSize:]...), 0)), 0, ErrMalformedPayload},
+		{"string past the end", reframe(join, []byte{0xff, 0xff, 'n'}), 0, ErrMalformedPayload},
+		{"oversized frame", join, uint32(len(join) - headerSize - 1), ErrFrameTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := readFrom(t, test.frame, test.max)
+			var protocolErr *ProtocolError
+			if !errors.As(err, &protocolErr) || !errors.Is(err, test.kind) {
+				t.Fatalf("err = %v, want a protocol error of kind %v", err, test.kind)
+			}
+			if recoverable := test.kind != ErrFrameTooLarge; protocolErr.Recoverable() != recoverable {
+				t.Errorf("Recoverable() = %v, want %v", protocolErr.Recoverable(), recoverable)
+			}
+		})
+	}
+}
+
+func TestReadMessageRejectsInvalidBoolean(t *testing.T) {
+	frame, err := encodeMessage(&VoteResponseMessage{Term: 1, VoterID: "b1", Granted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Term, then the voter ID, then the granted flag
+	frame[headerSize+8+2+2] = 2
+	if _, err := readFrom(t, frame, 0); !errors.Is(err, ErrMalformedPayload) {
+		t.Errorf("err = %v, want %v", err, ErrMalformedPayload)
+	}
+}
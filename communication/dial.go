@@ -0,0 +1,81 @@
+package communication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// ErrDialAttemptsExhausted is returned once every allowed dial attempt has failed.
+var ErrDialAttemptsExhausted = errors.New("dial attempts exhausted")
+
+// DialOptions controls how outgoing connections are established.
+type DialOptions struct {
+	Timeout     time.Duration // Timeout for a single dial attempt
+	MaxAttempts int           // Attempts before giving up, 0 or less means a single attempt
+	BaseDelay   time.Duration // Backoff before the second attempt
+	MaxDelay    time.Duration // Upper bound for the backoff between attempts
+}
+
+// DefaultDialOptions returns the dial policy used when nothing else is configured.
+func DefaultDialOptions() DialOptions {
+	return DialOptions{
+		Timeout:     2 * time.Second,
+		MaxAttempts: 8,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    5 * time.Second,
+	}
+}
+
+// backoff returns the delay before the given retry using exponential backoff with full jitter.
+func (o DialOptions) backoff(retry int) time.Duration {
+	if o.BaseDelay <= 0 {
+		return 0
+	}
+	ceiling := o.BaseDelay << uint(retry)
+	if ceiling <= 0 || (o.MaxDelay > 0 && ceiling > o.MaxDelay) {
+		// Shifting overflowed or went past the cap
+		ceiling = o.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// establishConnection establishes a TCP connection to a specific address,
+// retrying with backoff until it succeeds, the attempts run out or ctx is done.
+func (c *TcpCommunicator) establishConnection(ctx context.Context, address string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: c.dialOptions.Timeout, KeepAlive: c.connectionOptions.KeepAlive}
+	attempts := max(c.dialOptions.MaxAttempts, 1)
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			// Wait before retrying, unless the caller gives up first
+			timer := time.NewTimer(c.dialOptions.backoff(attempt - 1))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, fmt.Errorf("dialing %s: %w (last error: %v)", address, ctx.Err(), lastErr)
+			case <-timer.C:
+			}
+		}
+
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		dialFailures.Inc()
+
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("dialing %s: %w (last error: %v)", address, ctx.Err(), lastErr)
+		}
+	}
+
+	return nil, fmt.Errorf("dialing %s after %d attempts: %w: %v", address, attempts, ErrDialAttemptsExhausted, lastErr)
+}
@@ -0,0 +1,103 @@
+package communication
+
+import (
+	"context"
+	"dht/metrics"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoffStaysWithinFullJitterBounds(t *testing.T) {
+	options := DialOptions{BaseDelay: 10 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+	tests := []struct {
+		retry   int
+		ceiling time.Duration
+	}{
+		{0, 10 * time.Millisecond},
+		{1, 20 * time.Millisecond},
+		{4, 160 * time.Millisecond},
+		{5, 300 * time.Millisecond},  // 320ms capped
+		{70, 300 * time.Millisecond}, // The shift overflows
+	}
+	for _, test := range tests {
+		var low, high bool
+		for i := 0; i < 1000; i++ {
+			delay := options.backoff(test.retry)
+			if delay < 0 || delay > test.ceiling {
+				t.Fatalf("backoff(%d) = %v, want within [0, %v]", test.retry, delay, test.ceiling)
+			}
+			low = low || delay < test.ceiling/4
+			high = high || delay > test.ceiling*3/4
+		}
+		if !low || !high {
+			t.Errorf("backoff(%d) does not spread over [0, %v]", test.retry, test.ceiling)
+		}
+	}
+	if delay := (DialOptions{MaxDelay: time.Second}).backoff(3); delay != 0 {
+		t.Errorf("backoff without a base delay = %v, want 0", delay)
+	}
+}
+
+// dialFailureCount reads the dial failures counter from the default registry
+func dialFailureCount(t *testing.T) int {
+	t.Helper()
+	for _, line := range strings.Split(metrics.Default.Text(), "\n") {
+		if value, ok := strings.CutPrefix(line, "dht_dial_failures_total "); ok {
+			count, err := strconv.Atoi(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return count
+		}
+	}
+	t.Fatal("no dht_dial_failures_total sample")
+	return 0
+}
+
+// closedAddress returns a loopback address nothing listens on
+func closedAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestEstablishConnectionStopsAfterMaxAttempts(t *testing.T) {
+	for _, attempts := range []int{0, 1, 3} {
+		options := DefaultOptions()
+		options.Logger = discardLogger
+		options.Dial = DialOptions{Timeout: time.Second, MaxAttempts: attempts, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+		c := NewTcpCommunicator("n5", "127.0.0.1:0", "127.0.0.1:0", options)
+		defer c.Close()
+
+		before := dialFailureCount(t)
+		_, err := c.establishConnection(context.Background(), closedAddress(t))
+		if !errors.Is(err, ErrDialAttemptsExhausted) {
+			t.Errorf("%d attempts: err = %v, want %v", attempts, err, ErrDialAttemptsExhausted)
+		}
+		if dialed, want := dialFailureCount(t)-before, max(attempts, 1); dialed != want {
+			t.Errorf("%d attempts: dialed %d times, want %d", attempts, dialed, want)
+		}
+	}
+}
+
+func TestEstablishConnectionGivesUpWhenCancelled(t *testing.T) {
+	options := DefaultOptions()
+	options.Logger = discardLogger
+	options.Dial = DialOptions{Timeout: time.Second, MaxAttempts: 100, BaseDelay: time.Second, MaxDelay: time.Second}
+	c := NewTcpCommunicator("n5", "127.0.0.1:0", "127.0.0.1:0", options)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.establishConnection(ctx, closedAddress(t)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
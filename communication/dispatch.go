@@ -0,0 +1,260 @@
+package communication
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// OverloadPolicy says what a Dispatcher does with a message whose queue is full.
+type OverloadPolicy int
+
+const (
+	// OVERLOAD_BLOCK stops reading the connection a message arrived on until
+	// its queue has room, which slows down that sender alone.
+	OVERLOAD_BLOCK OverloadPolicy = iota
+	// OVERLOAD_REJECT hands the message to the reject handler instead.
+	OVERLOAD_REJECT
+)
+
+func (p OverloadPolicy) String() string {
+	switch p {
+	case OVERLOAD_BLOCK:
+		return "block"
+	case OVERLOAD_REJECT:
+		return "reject"
+	default:
+		return fmt.Sprintf("OverloadPolicy(%d)", int(p))
+	}
+}
+
+// ParseOverloadPolicy reads an overload policy by name, "block" or "reject".
+func ParseOverloadPolicy(name string) (OverloadPolicy, error) {
+	for _, policy := range []OverloadPolicy{OVERLOAD_BLOCK, OVERLOAD_REJECT} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown overload policy %q, expected block or reject", name)
+}
+
+// DispatchOptions sizes the queue and worker pool of each message type.
+type DispatchOptions struct {
+	QueueSize int            // Messages waiting per type before the overload policy applies
+	Workers   int            // Messages of one type handled at the same time
+	Overload  OverloadPolicy // What to do with a message whose queue is full
+	Timeout   time.Duration  // Time a handler has for one message, including what it sends, 0 for no limit
+}
+
+// DefaultDispatchOptions returns the dispatch settings used when nothing else is configured.
+func DefaultDispatchOptions() DispatchOptions {
+	return DispatchOptions{
+		QueueSize: 256,
+		Workers:   8,
+		Overload:  OVERLOAD_BLOCK,
+	}
+}
+
+// Handler processes one incoming message. It sends whatever the message
+// calls for itself, under ctx, rather than in goroutines of its own, so the
+// workers of a message type bound the work that type can start.
+type Handler func(ctx context.Context, message Message)
+
+// workQueue holds the messages of one type until a worker takes them
+type workQueue struct {
+	messages chan Message
+	overload OverloadPolicy
+	timeout  time.Duration
+}
+
+// Dispatcher hands incoming messages to handlers registered per message type.
+// Each type has its own bounded queue and pool of workers, so a flood of one
+// kind of message neither starves the others nor starts unbounded goroutines.
+// Dispatch is called by every connection on its own, so a connection waiting
+// for room holds up neither the other connections nor the other types.
+type Dispatcher struct {
+	options  DispatchOptions
+	queues   map[MessageType]*workQueue
+	rejects  chan Message   // Messages turned away, waiting for the reject handler
+	workers  sync.WaitGroup // Running workers, including the reject handler's
+	started  chan struct{}  // Closed by Start, once every handler is registered
+	stopping chan struct{}  // Closed by Stop, wakes dispatches waiting for room
+	stopOnce sync.Once
+	stopped  bool               // Set by Stop, later messages are dropped
+	mu       sync.RWMutex       // Held for reading while a message is queued, for writing by Stop
+	ctx      context.Context    // Handlers work under it
+	cancel   context.CancelFunc // Called when Stop gives up, so handlers abandon their sends
+	logger   *slog.Logger
+}
+
+func NewDispatcher(options DispatchOptions, logger *slog.Logger) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Dispatcher{
+		options:  options,
+		queues:   make(map[MessageType]*workQueue),
+		started:  make(chan struct{}),
+		stopping: make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+		logger:   logger,
+	}
+}
+
+// Handle registers the handler for a message type and starts its workers.
+// Handlers are registered before Start.
+func (d *Dispatcher) Handle(messageType MessageType, handler Handler) {
+	d.HandleWith(messageType, d.options, handler)
+}
+
+// HandleInOrder registers a handler that sees messages of its type one at a
+// time, in the order they arrived.
+func (d *Dispatcher) HandleInOrder(messageType MessageType, handler Handler) {
+	options := d.options
+	options.Workers = 1
+	d.HandleWith(messageType, options, handler)
+}
+
+// HandleWith registers a handler whose queue and workers are sized by options
+// instead of the dispatcher's defaults.
+func (d *Dispatcher) HandleWith(messageType MessageType, options DispatchOptions, handler Handler) {
+	queue := &workQueue{
+		messages: make(chan Message, max(options.QueueSize, 0)),
+		overload: options.Overload,
+		timeout:  options.Timeout,
+	}
+	d.queues[messageType] = queue
+	for i := 0; i < max(options.Workers, 1); i++ {
+		d.workers.Add(1)
+		go func() {
+			defer d.workers.Done()
+			for message := range queue.messages {
+				d.handle(handler, message, queue.timeout)
+			}
+		}()
+	}
+}
+
+// handle runs a handler on one message, giving up on what it sends after timeout
+func (d *Dispatcher) handle(handler Handler, message Message, timeout time.Duration) {
+	ctx := d.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	handler(ctx, message)
+}
+
+// OnReject sets the handler for messages turned away by OVERLOAD_REJECT,
+// which can tell the sender the node is busy. It runs on a single worker
+// behind a queue of its own; without one, or when that queue is full too,
+// rejected messages are dropped.
+func (d *Dispatcher) OnReject(handler Handler) {
+	d.rejects = make(chan Message, max(d.options.QueueSize, 1))
+	d.workers.Add(1)
+	go func() {
+		defer d.workers.Done()
+		for message := range d.rejects {
+			d.handle(handler, message, d.options.Timeout)
+		}
+	}()
+}
+
+// Stop drops any message dispatched from now on and waits until the workers
+// have handled the ones already queued, sends included. If ctx is done first,
+// the handlers still running have their contexts cancelled, so nothing is
+// left sending once the node closes its connections.
+func (d *Dispatcher) Stop(ctx context.Context) error {
+	drained := make(chan struct{})
+	go func() {
+		// Dispatches waiting for room give up and let go of the lock
+		d.stopOnce.Do(func() { close(d.stopping) })
+		d.mu.Lock()
+		if !d.stopped {
+			d.stopped = true
+			for _, queue := range d.queues {
+				close(queue.messages)
+			}
+			if d.rejects != nil {
+				close(d.rejects)
+			}
+		}
+		d.mu.Unlock()
+		d.workers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		d.cancel()
+		return ctx.Err()
+	}
+}
+
+// Start lets dispatched messages through to their handlers. Messages
+// dispatched before then wait, so nothing arriving during startup is lost.
+func (d *Dispatcher) Start() {
+	close(d.started)
+}
+
+// Dispatch queues a message for the handler of its type. Under OVERLOAD_BLOCK
+// it waits for room, holding up only the caller.
+func (d *Dispatcher) Dispatch(message Message) {
+	messageType := message.Header.Type
+	select {
+	case <-d.started:
+	case <-d.stopping:
+		d.drop(message, dropStopping)
+		return
+	}
+	queue, ok := d.queues[messageType]
+	if !ok {
+		d.drop(message, dropNoHandler)
+		return
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.stopped {
+		d.drop(message, dropStopping)
+		return
+	}
+	d.logger.Debug("Dispatching message", "msg_type", messageType)
+	if queue.overload == OVERLOAD_BLOCK {
+		select {
+		case queue.messages <- message:
+		case <-d.stopping:
+			d.drop(message, dropStopping)
+		}
+		return
+	}
+	select {
+	case queue.messages <- message:
+		return
+	default:
+	}
+	select {
+	case d.rejects <- message:
+	default:
+		d.drop(message, dropQueueFull)
+	}
+}
+
+// Reasons a message is dropped, as counted by dht_messages_dropped_total
+const (
+	dropNoHandler = "no_handler"
+	dropQueueFull = "queue_full"
+	dropStopping  = "stopping"
+)
+
+// drop logs and counts a message no handler will see
+func (d *Dispatcher) drop(message Message, reason string) {
+	messagesDropped.Inc(message.Header.Type.String(), reason)
+	if reason == dropQueueFull {
+		d.logger.Warn("Dropping message, its queue is full", "msg_type", message.Header.Type)
+	} else {
+		d.logger.Debug("Dropping message", "msg_type", message.Header.Type, "reason", reason)
+	}
+}
@@ -0,0 +1,290 @@
+package communication
+
+import (
+	"context"
+	"dht/metrics"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// droppedCount reads dht_messages_dropped_total for a type and reason off the metrics page
+func droppedCount(t *testing.T, messageType MessageType, reason string) float64 {
+	t.Helper()
+	series := fmt.Sprintf(`dht_messages_dropped_total{type="%s",reason="%s"} `, messageType, reason)
+	for _, line := range strings.Split(metrics.Default.Text(), "\n") {
+		if value, ok := strings.CutPrefix(line, series); ok {
+			count, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return count
+		}
+	}
+	return 0
+}
+
+func message(messageType MessageType) Message {
+	return Message{Header: MessageHeader{Version: ProtocolVersion, Type: messageType}}
+}
+
+// dispatchReturns reports whether Dispatch returns within a short while
+func dispatchReturns(d *Dispatcher, m Message) bool {
+	done := make(chan struct{})
+	go func() {
+		d.Dispatch(m)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(100 * time.Millisecond):
+		return false
+	}
+}
+
+// blockedHandler returns a handler that holds every message until release is closed
+func blockedHandler(handled chan<- Message, release <-chan struct{}) Handler {
+	return func(_ context.Context, m Message) {
+		<-release
+		handled <- m
+	}
+}
+
+func TestDispatcherBlocksOnlyTheFullQueue(t *testing.T) {
+	d := NewDispatcher(DispatchOptions{QueueSize: 1, Workers: 1, Overload: OVERLOAD_BLOCK}, discardLogger)
+	release := make(chan struct{})
+	handled := make(chan Message, 8)
+	d.Handle(REQUEST, blockedHandler(handled, release))
+	d.Handle(PING, func(_ context.Context, m Message) { handled <- m })
+	d.Start()
+
+	// One message with the worker, one in the queue
+	for i := 0; i < 2; i++ {
+		if !dispatchReturns(d, message(REQUEST)) {
+			t.Fatalf("request %d blocked before the queue was full", i)
+		}
+	}
+	blocked := make(chan struct{})
+	go func() {
+		d.Dispatch(message(REQUEST))
+		close(blocked)
+	}()
+	select {
+	case <-blocked:
+		t.Fatal("dispatch into a full queue returned")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Other types, dispatched by other connections, carry on
+	if !dispatchReturns(d, message(PING)) {
+		t.Fatal("a full REQUEST queue held up a PING")
+	}
+	if m := <-handled; m.Header.Type != PING {
+		t.Fatalf("handled %s first, want PING", m.Header.Type)
+	}
+
+	close(release)
+	<-blocked
+	for i := 0; i < 3; i++ {
+		<-handled
+	}
+}
+
+func TestDispatcherRejectsWhenFull(t *testing.T) {
+	d := NewDispatcher(DispatchOptions{QueueSize: 1, Workers: 1, Overload: OVERLOAD_REJECT}, discardLogger)
+	release := make(chan struct{})
+	handled := make(chan Message, 8)
+	rejected := make(chan Message, 8)
+	d.Handle(REQUEST, blockedHandler(handled, release))
+	d.OnReject(func(_ context.Context, m Message) { rejected <- m })
+	d.Start()
+
+	d.Dispatch(message(REQUEST))
+	// Wait for the worker to take it, so the queue is empty again
+	for deadline := time.Now().Add(time.Second); len(d.queues[REQUEST].messages) > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i < 4; i++ {
+		if !dispatchReturns(d, message(REQUEST)) {
+			t.Fatalf("request %d blocked under OVERLOAD_REJECT", i)
+		}
+	}
+	// The worker and the queue take two, the rest are turned away
+	for i := 0; i < 2; i++ {
+		select {
+		case <-rejected:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d requests rejected, want 2", i)
+		}
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		<-handled
+	}
+}
+
+func TestDispatcherDropsWhenRejectQueueIsMissing(t *testing.T) {
+	d := NewDispatcher(DispatchOptions{QueueSize: 0, Workers: 1, Overload: OVERLOAD_REJECT}, discardLogger)
+	release := make(chan struct{})
+	defer close(release)
+	d.Handle(REQUEST, blockedHandler(make(chan Message, 8), release))
+	d.Start()
+
+	before := droppedCount(t, REQUEST, dropQueueFull)
+	for i := 0; i < 3; i++ {
+		if !dispatchReturns(d, message(REQUEST)) {
+			t.Fatalf("request %d blocked under OVERLOAD_REJECT", i)
+		}
+	}
+	if dropped := droppedCount(t, REQUEST, dropQueueFull) - before; dropped < 2 {
+		t.Errorf("counted %v dropped requests, want at least 2", dropped)
+	}
+}
+
+func TestDispatcherHandlesInOrder(t *testing.T) {
+	d := NewDispatcher(DispatchOptions{QueueSize: 16, Workers: 8, Overload: OVERLOAD_BLOCK}, discardLogger)
+	var mu sync.Mutex
+	var order []int
+	done := make(chan struct{})
+	d.HandleInOrder(RING, func(_ context.Context, m Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, m.Payload.(int))
+		if len(order) == 10 {
+			close(done)
+		}
+	})
+	d.Start()
+	for i := 0; i < 10; i++ {
+		m := message(RING)
+		m.Payload = i
+		d.Dispatch(m)
+	}
+	<-done
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("handled in order %v", order)
+		}
+	}
+}
+
+func TestDispatcherWaitsForStart(t *testing.T) {
+	d := NewDispatcher(DefaultDispatchOptions(), discardLogger)
+	handled := make(chan Message, 1)
+	d.Handle(JOIN, func(_ context.Context, m Message) { handled <- m })
+	if dispatchReturns(d, message(JOIN)) {
+		t.Fatal("dispatched before Start")
+	}
+	d.Start()
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("message dispatched before Start was never handled")
+	}
+}
+
+func TestDispatcherCountsMessagesWithoutHandler(t *testing.T) {
+	d := NewDispatcher(DefaultDispatchOptions(), discardLogger)
+	d.Start()
+	before := droppedCount(t, LEAVE, dropNoHandler)
+	d.Dispatch(message(LEAVE))
+	if dropped := droppedCount(t, LEAVE, dropNoHandler) - before; dropped != 1 {
+		t.Errorf("counted %v dropped messages, want 1", dropped)
+	}
+}
+
+func TestDispatcherStopUnblocksWaitingDispatches(t *testing.T) {
+	d := NewDispatcher(DispatchOptions{QueueSize: 0, Workers: 1, Overload: OVERLOAD_BLOCK}, discardLogger)
+	release := make(chan struct{})
+	handled := make(chan Message, 8)
+	d.Handle(REQUEST, blockedHandler(handled, release))
+	d.Start()
+	d.Dispatch(message(REQUEST)) // Taken by the worker
+	blocked := make(chan struct{})
+	go func() {
+		d.Dispatch(message(REQUEST))
+		close(blocked)
+	}()
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- d.Stop(context.Background()) }()
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("Stop left a dispatch waiting for room")
+	}
+	close(release)
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 1 {
+		t.Errorf("handled %d messages, want the 1 taken before Stop", len(handled))
+	}
+	if dispatchReturns(d, message(REQUEST)); len(handled) != 1 {
+		t.Error("handled a message dispatched after Stop")
+	}
+}
+
+func TestDispatcherStopGivesUpAtDeadline(t *testing.T) {
+	d := NewDispatcher(DefaultDispatchOptions(), discardLogger)
+	cancelled := make(chan struct{})
+	d.Handle(REQUEST, func(ctx context.Context, _ Message) {
+		// A send that would outlive the shutdown
+		<-ctx.Done()
+		close(cancelled)
+	})
+	d.Start()
+	d.Dispatch(message(REQUEST))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := d.Stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Stop() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("the handler still running was not cancelled")
+	}
+}
+
+func TestParseOverloadPolicy(t *testing.T) {
+	for _, policy := range []OverloadPolicy{OVERLOAD_BLOCK, OVERLOAD_REJECT} {
+		if parsed, err := ParseOverloadPolicy(policy.String()); err != nil || parsed != policy {
+			t.Errorf("ParseOverloadPolicy(%q) = %v, %v", policy, parsed, err)
+		}
+	}
+	if _, err := ParseOverloadPolicy("drop"); err == nil {
+		t.Error("accepted an unknown policy")
+	}
+}
+
+func TestDispatcherBoundsHandlersByTimeout(t *testing.T) {
+	options := DefaultDispatchOptions()
+	options.Timeout = 50 * time.Millisecond
+	d := NewDispatcher(options, discardLogger)
+	done := make(chan error, 1)
+	d.Handle(REQUEST, func(ctx context.Context, _ Message) {
+		// A send to a node that never answers
+		<-ctx.Done()
+		done <- ctx.Err()
+	})
+	d.Start()
+	d.Dispatch(message(REQUEST))
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("handler context ended with %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler context has no deadline")
+	}
+}
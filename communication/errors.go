@@ -0,0 +1,85 @@
+package communication
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Kinds of protocol violation. Use errors.Is on a *ProtocolError to tell them apart.
+var (
+	ErrFrameTooLarge      = errors.New("frame exceeds maximum size")
+	ErrUnknownMessageType = errors.New("unknown message type")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrMalformedPayload   = errors.New("malformed payload")
+	ErrUnexpectedMessage  = errors.New("unexpected message")
+)
+
+// ProtocolError describes a frame that broke the wire protocol.
+type ProtocolError struct {
+	Kind   error         // One of the Err* protocol violation kinds
+	Header MessageHeader // Header of the offending frame
+	Err    error         // Underlying cause, may be nil
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%v (type %s, version %d, length %d): %v", e.Kind, e.Header.Type, e.Header.Version, e.Header.Length, e.Err)
+	}
+	return fmt.Sprintf("%v (type %s, version %d, length %d)", e.Kind, e.Header.Type, e.Header.Version, e.Header.Length)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Kind
+}
+
+// Recoverable reports whether the stream is still positioned on a frame
+// boundary after the error, so reading can carry on with the next frame.
+func (e *ProtocolError) Recoverable() bool {
+	return !errors.Is(e.Kind, ErrFrameTooLarge)
+}
+
+// quarantine remembers misbehaving senders and refuses them for a while.
+type quarantine struct {
+	mu    sync.Mutex
+	until map[string]time.Time // Keyed by remote host or verified node ID, see quarantineKey
+}
+
+func newQuarantine() *quarantine {
+	return &quarantine{until: make(map[string]time.Time)}
+}
+
+// quarantineKey names the sender of a connection from host that claimed
+// nodeID. Only a certificate makes the claim trustworthy; without TLS the ID
+// is whatever the sender chose, so the host is what gets quarantined.
+func (c *TcpCommunicator) quarantineKey(host, nodeID string) string {
+	if c.tlsConfig != nil {
+		return nodeID
+	}
+	return host
+}
+
+func (q *quarantine) add(key string, duration time.Duration) {
+	if key == "" || duration <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.until[key] = time.Now().Add(duration)
+}
+
+// contains reports whether key is still quarantined, forgetting it once the time is up.
+func (q *quarantine) contains(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	until, ok := q.until[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(q.until, key)
+		return false
+	}
+	return true
+}
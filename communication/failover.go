@@ -0,0 +1,60 @@
+package communication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// failoverAttemptTimeout bounds how long one address may take before the next one is tried
+const failoverAttemptTimeout = 3 * time.Second
+
+// Failover sends messages to one of several equivalent addresses, such as the
+// bootstrap replicas. It sticks with the address that worked last and moves
+// on to the next one when a send fails.
+type Failover struct {
+	addresses []string
+	current   int
+	mu        sync.Mutex
+}
+
+// NewFailover returns a Failover over addresses, trying them in order.
+func NewFailover(addresses []string) *Failover {
+	return &Failover{addresses: addresses}
+}
+
+// Addresses returns the addresses in the order they are tried.
+func (f *Failover) Addresses() []string {
+	return f.addresses
+}
+
+// Send delivers message to the first address that accepts it.
+func (f *Failover) Send(ctx context.Context, communicator *TcpCommunicator, message []byte) error {
+	if len(f.addresses) == 0 {
+		return fmt.Errorf("no addresses to send to")
+	}
+	f.mu.Lock()
+	start := f.current
+	f.mu.Unlock()
+
+	var errs []error
+	for i := range f.addresses {
+		index := (start + i) % len(f.addresses)
+		attemptCtx, cancel := context.WithTimeout(ctx, failoverAttemptTimeout)
+		err := communicator.SendMessage(attemptCtx, f.addresses[index], message)
+		cancel()
+		if err == nil {
+			f.mu.Lock()
+			f.current = index
+			f.mu.Unlock()
+			return nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,230 @@
+package communication
+
+import "log/slog"
+
+// Messages of the SWIM gossip protocol peers use to keep a membership list;
+// see the membership package.
+
+// MemberState is what a node believes about a member.
+type MemberState uint8
+
+const (
+	MemberAlive MemberState = iota
+	MemberSuspect
+	MemberDead
+	MemberLeft
+)
+
+func (s MemberState) String() string {
+	switch s {
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	case MemberDead:
+		return "dead"
+	case MemberLeft:
+		return "left"
+	default:
+		return "unknown"
+	}
+}
+
+// LogValue logs a member state by name, in JSON as well as text
+func (s MemberState) LogValue() slog.Value {
+	return slog.StringValue(s.String())
+}
+
+// MemberUpdate is one piece of membership news. A higher incarnation,
+// which only the member itself can raise, overrides older news about it.
+type MemberUpdate struct {
+	Node        NodeInfo
+	State       MemberState
+	Incarnation uint64
+}
+
+// PingMessage checks that a member is alive. Updates are piggybacked gossip.
+type PingMessage struct {
+	Seq     uint64
+	From    NodeInfo
+	Updates []MemberUpdate
+	MAC     []byte // HMAC-SHA256 with the join secret, empty when none is configured
+}
+
+// PingReqMessage asks a member to ping Target on the sender's behalf.
+type PingReqMessage struct {
+	Seq     uint64
+	From    NodeInfo
+	Target  NodeInfo
+	Updates []MemberUpdate
+	MAC     []byte
+}
+
+// AckMessage answers a PING, directly or relayed for a PING_REQ. Seq is the
+// sequence number of the ping being answered, From the member that is alive.
+type AckMessage struct {
+	Seq     uint64
+	From    NodeInfo
+	Updates []MemberUpdate
+	MAC     []byte
+}
+
+// SyncMessage carries a node's whole membership list. It is sent when
+// joining, and answered with the receiver's list when Reply is false.
+type SyncMessage struct {
+	From    NodeInfo
+	Reply   bool
+	Members []MemberUpdate
+	MAC     []byte
+}
+
+func (w *wireWriter) memberUpdates(updates []MemberUpdate) {
+	w.uint32(uint32(len(updates)))
+	for _, update := range updates {
+		w.nodeInfo(update.Node)
+		w.uint8(uint8(update.State))
+		w.uint64(update.Incarnation)
+	}
+}
+
+func (r *wireReader) memberUpdates() []MemberUpdate {
+	// The count is not trusted for an allocation, a short payload fails on the reads
+	count := r.uint32()
+	var updates []MemberUpdate
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		update := MemberUpdate{Node: r.nodeInfo()}
+		update.State = MemberState(r.uint8())
+		update.Incarnation = r.uint64()
+		if update.State > MemberLeft && r.err == nil {
+			r.err = errInvalidMemberState
+		}
+		updates = append(updates, update)
+	}
+	return updates
+}
+
+func (m *PingMessage) messageType() MessageType { return PING }
+
+func (m *PingMessage) encode(w *wireWriter) {
+	m.signedFields(w)
+	if w.version >= versionGossipMAC {
+		w.bytes(m.MAC)
+	}
+}
+
+func (m *PingMessage) mac() []byte       { return m.MAC }
+func (m *PingMessage) setMAC(mac []byte) { m.MAC = mac }
+
+func (m *PingMessage) signedFields(w *wireWriter) {
+	w.uint64(m.Seq)
+	w.nodeInfo(m.From)
+	w.memberUpdates(m.Updates)
+}
+
+func (m *PingMessage) decode(r *wireReader) {
+	m.Seq = r.uint64()
+	m.From = r.nodeInfo()
+	m.Updates = r.memberUpdates()
+	if r.version >= versionGossipMAC {
+		m.MAC = r.bytes()
+	}
+}
+
+func (m *PingReqMessage) messageType() MessageType { return PING_REQ }
+
+func (m *PingReqMessage) encode(w *wireWriter) {
+	m.signedFields(w)
+	if w.version >= versionGossipMAC {
+		w.bytes(m.MAC)
+	}
+}
+
+func (m *PingReqMessage) mac() []byte       { return m.MAC }
+func (m *PingReqMessage) setMAC(mac []byte) { m.MAC = mac }
+
+func (m *PingReqMessage) signedFields(w *wireWriter) {
+	w.uint64(m.Seq)
+	w.nodeInfo(m.From)
+	w.nodeInfo(m.Target)
+	w.memberUpdates(m.Updates)
+}
+
+func (m *PingReqMessage) decode(r *wireReader) {
+	m.Seq = r.uint64()
+	m.From = r.nodeInfo()
+	m.Target = r.nodeInfo()
+	m.Updates = r.memberUpdates()
+	if r.version >= versionGossipMAC {
+		m.MAC = r.bytes()
+	}
+}
+
+func (m *AckMessage) messageType() MessageType { return ACK }
+
+func (m *AckMessage) encode(w *wireWriter) {
+	m.signedFields(w)
+	if w.version >= versionGossipMAC {
+		w.bytes(m.MAC)
+	}
+}
+
+func (m *AckMessage) mac() []byte       { return m.MAC }
+func (m *AckMessage) setMAC(mac []byte) { m.MAC = mac }
+
+func (m *AckMessage) signedFields(w *wireWriter) {
+	w.uint64(m.Seq)
+	w.nodeInfo(m.From)
+	w.memberUpdates(m.Updates)
+}
+
+func (m *AckMessage) decode(r *wireReader) {
+	m.Seq = r.uint64()
+	m.From = r.nodeInfo()
+	m.Updates = r.memberUpdates()
+	if r.version >= versionGossipMAC {
+		m.MAC = r.bytes()
+	}
+}
+
+func (m *SyncMessage) messageType() MessageType { return SYNC }
+
+func (m *SyncMessage) encode(w *wireWriter) {
+	m.signedFields(w)
+	if w.version >= versionGossipMAC {
+		w.bytes(m.MAC)
+	}
+}
+
+func (m *SyncMessage) mac() []byte       { return m.MAC }
+func (m *SyncMessage) setMAC(mac []byte) { m.MAC = mac }
+
+func (m *SyncMessage) signedFields(w *wireWriter) {
+	w.nodeInfo(m.From)
+	w.bool(m.Reply)
+	w.memberUpdates(m.Members)
+}
+
+func (m *SyncMessage) decode(r *wireReader) {
+	m.From = r.nodeInfo()
+	m.Reply = r.bool()
+	m.Members = r.memberUpdates()
+	if r.version >= versionGossipMAC {
+		m.MAC = r.bytes()
+	}
+}
+
+func GetPingMessage(seq uint64, from NodeInfo, updates []MemberUpdate, secret []byte) ([]byte, error) {
+	return encodeSigned(&PingMessage{Seq: seq, From: from, Updates: updates}, secret)
+}
+
+func GetPingReqMessage(seq uint64, from, target NodeInfo, updates []MemberUpdate, secret []byte) ([]byte, error) {
+	return encodeSigned(&PingReqMessage{Seq: seq, From: from, Target: target, Updates: updates}, secret)
+}
+
+func GetAckMessage(seq uint64, from NodeInfo, updates []MemberUpdate, secret []byte) ([]byte, error) {
+	return encodeSigned(&AckMessage{Seq: seq, From: from, Updates: updates}, secret)
+}
+
+func GetSyncMessage(from NodeInfo, reply bool, members []MemberUpdate, secret []byte) ([]byte, error) {
+	return encodeSigned(&SyncMessage{From: from, Reply: reply, Members: members}, secret)
+}
@@ -0,0 +1,230 @@
+package communication
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Features is a bit set of optional protocol capabilities advertised in HELLO.
+// A feature is only used on a connection when both ends advertise it.
+type Features uint32
+
+const (
+	// FEATURE_RPC lets a node wrap a message in CALL and get the answer back
+	// in a REPLY on the same connection.
+	FEATURE_RPC Features = 1 << iota
+)
+
+// SupportedFeatures lists the optional features implemented by this build.
+const SupportedFeatures = FEATURE_RPC
+
+// Has reports whether every bit of flag is set.
+func (f Features) Has(flag Features) bool {
+	return f&flag == flag
+}
+
+// HelloMessage is the first frame on every connection. Its layout is frozen
+// across protocol versions so that any two builds can negotiate.
+type HelloMessage struct {
+	NodeID     string
+	MinVersion uint8
+	MaxVersion uint8
+	Features   Features
+}
+
+// HelloAckMessage accepts a HELLO and carries the negotiated parameters.
+type HelloAckMessage struct {
+	NodeID   string
+	Version  uint8
+	Features Features
+}
+
+// HelloRejectMessage refuses a HELLO. The connection is closed after it is sent.
+type HelloRejectMessage struct {
+	NodeID string
+	Reason string
+}
+
+func (m *HelloMessage) messageType() MessageType { return HELLO }
+
+func (m *HelloMessage) encode(w *wireWriter) {
+	w.string(m.NodeID)
+	w.uint8(m.MinVersion)
+	w.uint8(m.MaxVersion)
+	w.uint32(uint32(m.Features))
+}
+
+func (m *HelloMessage) decode(r *wireReader) {
+	m.NodeID = r.string()
+	m.MinVersion = r.uint8()
+	m.MaxVersion = r.uint8()
+	m.Features = Features(r.uint32())
+}
+
+func (m *HelloAckMessage) messageType() MessageType { return HELLO_ACK }
+
+func (m *HelloAckMessage) encode(w *wireWriter) {
+	w.string(m.NodeID)
+	w.uint8(m.Version)
+	w.uint32(uint32(m.Features))
+}
+
+func (m *HelloAckMessage) decode(r *wireReader) {
+	m.NodeID = r.string()
+	m.Version = r.uint8()
+	m.Features = Features(r.uint32())
+}
+
+func (m *HelloRejectMessage) messageType() MessageType { return HELLO_REJECT }
+
+func (m *HelloRejectMessage) encode(w *wireWriter) {
+	w.string(m.NodeID)
+	w.string(m.Reason)
+}
+
+func (m *HelloRejectMessage) decode(r *wireReader) {
+	m.NodeID = r.string()
+	m.Reason = r.string()
+}
+
+// HandshakeError is returned when the remote side refuses the connection.
+type HandshakeError struct {
+	Address string
+	NodeID  string
+	Reason  string
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("handshake with %s (%s) rejected: %s", e.Address, e.NodeID, e.Reason)
+}
+
+// session holds what two nodes agreed on during the handshake.
+type session struct {
+	remoteID string
+	version  uint8
+	features Features
+}
+
+// negotiate picks the highest protocol version both sides support and the
+// features both advertise. It fails if the version ranges do not overlap.
+func negotiate(hello *HelloMessage) (session, error) {
+	version := min(ProtocolVersion, hello.MaxVersion)
+	if version < max(MinProtocolVersion, hello.MinVersion) {
+		return session{}, fmt.Errorf("no common protocol version: local %d-%d, remote %d-%d",
+			MinProtocolVersion, ProtocolVersion, hello.MinVersion, hello.MaxVersion)
+	}
+	return session{
+		remoteID: hello.NodeID,
+		version:  version,
+		features: SupportedFeatures & hello.Features,
+	}, nil
+}
+
+// handshakeDeadline bounds a handshake by the configured timeout and ctx, whichever is sooner.
+func (c *TcpCommunicator) handshakeDeadline(ctx context.Context) time.Time {
+	var deadline time.Time
+	if c.connectionOptions.HandshakeTimeout > 0 {
+		deadline = time.Now().Add(c.connectionOptions.HandshakeTimeout)
+	}
+	if ctxDeadline, ok := ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		deadline = ctxDeadline
+	}
+	return deadline
+}
+
+// clientHandshake introduces this node on a freshly dialed connection and waits for the answer.
+func (c *TcpCommunicator) clientHandshake(ctx context.Context, address string, conn net.Conn) (session, error) {
+	conn.SetDeadline(c.handshakeDeadline(ctx))
+	defer conn.SetDeadline(time.Time{})
+
+	hello, err := encodeMessage(&HelloMessage{
+		NodeID:     c.selfId,
+		MinVersion: MinProtocolVersion,
+		MaxVersion: ProtocolVersion,
+		Features:   SupportedFeatures,
+	})
+	if err != nil {
+		return session{}, err
+	}
+	if _, err := conn.Write(hello); err != nil {
+		return session{}, fmt.Errorf("sending hello to %s: %w", address, err)
+	}
+
+	header, payloadBytes, err := readFrame(conn, c.connectionOptions.MaxFrameSize)
+	if err != nil {
+		return session{}, fmt.Errorf("reading hello reply from %s: %w", address, err)
+	}
+	reply, err := decodeFrame(header, payloadBytes)
+	if err != nil {
+		return session{}, fmt.Errorf("decoding hello reply from %s: %w", address, err)
+	}
+
+	switch payload := reply.Payload.(type) {
+	case *HelloAckMessage:
+		if payload.Version < MinProtocolVersion || payload.Version > ProtocolVersion {
+			return session{}, fmt.Errorf("%s chose unsupported protocol version %d", address, payload.Version)
+		}
+		if err := verifyPeerIdentity(conn, payload.NodeID); err != nil {
+			return session{}, fmt.Errorf("%s: %w", address, err)
+		}
+		return session{
+			remoteID: payload.NodeID,
+			version:  payload.Version,
+			features: SupportedFeatures & payload.Features,
+		}, nil
+	case *HelloRejectMessage:
+		return session{}, &HandshakeError{Address: address, NodeID: payload.NodeID, Reason: payload.Reason}
+	default:
+		return session{}, fmt.Errorf("hello reply from %s: %w", address, &ProtocolError{Kind: ErrUnexpectedMessage, Header: header})
+	}
+}
+
+// serverHandshake waits for the HELLO on an accepted connection from host and answers it.
+func (c *TcpCommunicator) serverHandshake(conn net.Conn, host string) (session, error) {
+	conn.SetDeadline(c.handshakeDeadline(context.Background()))
+	defer conn.SetDeadline(time.Time{})
+
+	header, payloadBytes, err := readFrame(conn, c.connectionOptions.MaxFrameSize)
+	if err != nil {
+		return session{}, fmt.Errorf("reading hello: %w", err)
+	}
+	if header.Type != HELLO {
+		return session{}, &ProtocolError{Kind: ErrUnexpectedMessage, Header: header, Err: fmt.Errorf("first frame must be HELLO")}
+	}
+	message, err := decodeFrame(header, payloadBytes)
+	if err != nil {
+		return session{}, fmt.Errorf("decoding hello: %w", err)
+	}
+	hello := message.Payload.(*HelloMessage)
+
+	negotiated, err := negotiate(hello)
+	if err == nil {
+		err = verifyPeerIdentity(conn, hello.NodeID)
+	}
+	if err == nil && c.quarantined.contains(c.quarantineKey(host, hello.NodeID)) {
+		err = fmt.Errorf("node %s is quarantined", hello.NodeID)
+	}
+	if err != nil {
+		// Tell the other side why before hanging up
+		if reject, encodeErr := encodeMessage(&HelloRejectMessage{NodeID: c.selfId, Reason: err.Error()}); encodeErr == nil {
+			conn.Write(reject)
+		}
+		return session{}, fmt.Errorf("rejecting %s: %w", hello.NodeID, err)
+	}
+
+	ack, err := encodeMessage(&HelloAckMessage{
+		NodeID:   c.selfId,
+		Version:  negotiated.version,
+		Features: negotiated.features,
+	})
+	if err != nil {
+		return session{}, err
+	}
+	if _, err := conn.Write(ack); err != nil {
+		return session{}, fmt.Errorf("acknowledging hello from %s: %w", hello.NodeID, err)
+	}
+
+	return negotiated, nil
+}
@@ -0,0 +1,232 @@
+package communication
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCommunicator returns a communicator that is never started, for
+// exercising its handshake directly on in-memory connections
+func testCommunicator(id string) *TcpCommunicator {
+	options := DefaultOptions()
+	options.Connection.IdleTimeout = 0
+	return NewTcpCommunicator(id, "127.0.0.1:0", "127.0.0.1:0", options)
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name     string
+		hello    HelloMessage
+		version  uint8
+		features Features
+		fails    bool
+	}{
+		{"same range", HelloMessage{MinVersion: MinProtocolVersion, MaxVersion: ProtocolVersion, Features: SupportedFeatures}, ProtocolVersion, SupportedFeatures, false},
+		{"newer remote", HelloMessage{MinVersion: MinProtocolVersion, MaxVersion: ProtocolVersion + 3, Features: SupportedFeatures}, ProtocolVersion, SupportedFeatures, false},
+		{"no common features", HelloMessage{MinVersion: 1, MaxVersion: ProtocolVersion, Features: 0}, ProtocolVersion, 0, false},
+		{"unknown features", HelloMessage{MinVersion: 1, MaxVersion: ProtocolVersion, Features: SupportedFeatures | 1<<31}, ProtocolVersion, SupportedFeatures, false},
+		{"older remote", HelloMessage{MinVersion: 1, MaxVersion: MinProtocolVersion - 1}, 0, 0, true},
+		{"remote only speaks newer versions", HelloMessage{MinVersion: ProtocolVersion + 1, MaxVersion: ProtocolVersion + 2}, 0, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.hello.NodeID = "n5"
+			negotiated, err := negotiate(&test.hello)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("negotiated %+v, want an error", negotiated)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if negotiated.remoteID != "n5" || negotiated.version != test.version || negotiated.features != test.features {
+				t.Errorf("negotiated %+v, want version %d and features %b", negotiated, test.version, test.features)
+			}
+		})
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	dialer, accepter := testCommunicator("n5"), testCommunicator("n66")
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	accepted := make(chan session, 1)
+	go func() {
+		negotiated, err := accepter.serverHandshake(server, "127.0.0.1")
+		if err != nil {
+			t.Errorf("serverHandshake: %v", err)
+		}
+		accepted <- negotiated
+	}()
+
+	dialed, err := dialer.clientHandshake(context.Background(), "n66:8888", client)
+	if err != nil {
+		t.Fatalf("clientHandshake: %v", err)
+	}
+	if dialed.remoteID != "n66" || dialed.version != ProtocolVersion || dialed.features != SupportedFeatures {
+		t.Errorf("dialing side agreed on %+v", dialed)
+	}
+	if negotiated := <-accepted; negotiated.remoteID != "n5" || negotiated.version != ProtocolVersion {
+		t.Errorf("accepting side agreed on %+v", negotiated)
+	}
+}
+
+// helloFrom sends hello on conn and returns the frame the accepting side answers with
+func helloFrom(t *testing.T, conn net.Conn, hello *HelloMessage) *Message {
+	t.Helper()
+	frame, err := encodeMessage(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	header, payloadBytes, err := readFrame(conn, 0)
+	if err != nil {
+		t.Fatalf("reading hello reply: %v", err)
+	}
+	reply, err := decodeFrame(header, payloadBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestServerHandshakeRejectsOldVersions(t *testing.T) {
+	accepter := testCommunicator("n66")
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := accepter.serverHandshake(server, "127.0.0.1")
+		result <- err
+	}()
+
+	reply := helloFrom(t, client, &HelloMessage{NodeID: "n5", MinVersion: 1, MaxVersion: MinProtocolVersion - 1, Features: SupportedFeatures})
+	if _, ok := reply.Payload.(*HelloRejectMessage); !ok {
+		t.Errorf("answered %s, want HELLO_REJECT", reply.Header.Type)
+	}
+	if err := <-result; err == nil {
+		t.Error("serverHandshake accepted an old node")
+	}
+}
+
+func TestServerHandshakeRejectsQuarantinedNodes(t *testing.T) {
+	accepter := testCommunicator("n66")
+	accepter.quarantined.add("127.0.0.1", time.Minute)
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go accepter.serverHandshake(server, "127.0.0.1")
+	reply := helloFrom(t, client, &HelloMessage{NodeID: "n5", MinVersion: MinProtocolVersion, MaxVersion: ProtocolVersion})
+	if _, ok := reply.Payload.(*HelloRejectMessage); !ok {
+		t.Errorf("answered %s, want HELLO_REJECT", reply.Header.Type)
+	}
+}
+
+func TestServerHandshakeRequiresHelloFirst(t *testing.T) {
+	accepter := testCommunicator("n66")
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	join, err := GetJoinMessage("n5", "n5:8888", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Write(join)
+	_, err = accepter.serverHandshake(server, "127.0.0.1")
+	if !errors.Is(err, ErrUnexpectedMessage) {
+		t.Errorf("err = %v, want %v", err, ErrUnexpectedMessage)
+	}
+}
+
+func TestClientHandshakeReportsRejection(t *testing.T) {
+	dialer := testCommunicator("n5")
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		if _, _, err := readFrame(server, 0); err != nil {
+			return
+		}
+		reject, _ := encodeMessage(&HelloRejectMessage{NodeID: "n66", Reason: "no common protocol version"})
+		server.Write(reject)
+	}()
+	_, err := dialer.clientHandshake(context.Background(), "n66:8888", client)
+	var handshakeErr *HandshakeError
+	if !errors.As(err, &handshakeErr) || handshakeErr.NodeID != "n66" || handshakeErr.Reason != "no common protocol version" {
+		t.Errorf("err = %v, want the rejection from n66", err)
+	}
+}
+
+func TestServerHandshakeSettlesOnOlderVersion(t *testing.T) {
+	accepter := testCommunicator("n66")
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	accepted := make(chan session, 1)
+	go func() {
+		negotiated, _ := accepter.serverHandshake(server, "127.0.0.1")
+		accepted <- negotiated
+	}()
+	reply := helloFrom(t, client, &HelloMessage{NodeID: "n5", MinVersion: 1, MaxVersion: MinProtocolVersion, Features: SupportedFeatures})
+	if ack, ok := reply.Payload.(*HelloAckMessage); !ok || ack.Version != MinProtocolVersion {
+		t.Errorf("answered %+v, want HELLO_ACK for version %d", reply.Payload, MinProtocolVersion)
+	}
+	if negotiated := <-accepted; negotiated.version != MinProtocolVersion {
+		t.Errorf("accepting side agreed on version %d, want %d", negotiated.version, MinProtocolVersion)
+	}
+}
+
+func TestClientHandshakeSpeaksOlderVersion(t *testing.T) {
+	dialer := testCommunicator("n5")
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// An older node that only speaks MinProtocolVersion
+	go func() {
+		if _, _, err := readFrame(server, 0); err != nil {
+			return
+		}
+		ack, _ := encodeMessage(&HelloAckMessage{NodeID: "n66", Version: MinProtocolVersion, Features: SupportedFeatures})
+		server.Write(ack)
+	}()
+	dialed, err := dialer.clientHandshake(context.Background(), "n66:8888", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialed.version != MinProtocolVersion {
+		t.Fatalf("dialing side agreed on version %d, want %d", dialed.version, MinProtocolVersion)
+	}
+
+	// Frames sent afterwards are written in the older layout
+	writer := newWriter("n66:8888", client, dialed, DefaultConnectionOptions(), discardLogger)
+	defer writer.close()
+	request, err := encodeMessage(&RequestMessage{ReqID: 7, OperationType: RETRIEVE, ObjectID: 66, ClientID: 2, ReplyTo: "client:8888", HopCount: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go writer.send(context.Background(), request)
+	message, err := ReadMessage(server, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Header.Version != MinProtocolVersion || message.Payload.(*RequestMessage).ObjectID != 66 {
+		t.Errorf("received %+v, %+v", message.Header, message.Payload)
+	}
+}
@@ -0,0 +1,55 @@
+package communication
+
+import "time"
+
+// LeaveMessage announces that a peer is leaving the ring on purpose. It names
+// the peer's neighbors so they can link to each other straight away instead
+// of waiting for stabilization to notice the gap.
+type LeaveMessage struct {
+	Node        NodeInfo
+	Predecessor NodeInfo
+	Successor   NodeInfo
+	Timestamp   int64  // Unix seconds when the LEAVE was signed
+	Nonce       []byte // Random, so each signed LEAVE is only acted on once
+	MAC         []byte // HMAC-SHA256 with the join secret, empty when no secret is configured
+}
+
+func (m *LeaveMessage) messageType() MessageType { return LEAVE }
+
+func (m *LeaveMessage) encode(w *wireWriter) {
+	w.nodeInfo(m.Node)
+	w.nodeInfo(m.Predecessor)
+	w.nodeInfo(m.Successor)
+	w.int64(m.Timestamp)
+	w.bytes(m.Nonce)
+	w.bytes(m.MAC)
+}
+
+func (m *LeaveMessage) decode(r *wireReader) {
+	m.Node = r.nodeInfo()
+	m.Predecessor = r.nodeInfo()
+	m.Successor = r.nodeInfo()
+	m.Timestamp = r.int64()
+	m.Nonce = r.bytes()
+	m.MAC = r.bytes()
+}
+
+// GetLeaveMessage builds a LEAVE for node, signed with the join secret when one is given.
+func GetLeaveMessage(node, predecessor, successor NodeInfo, secret []byte) ([]byte, error) {
+	leave := &LeaveMessage{
+		Node:        node,
+		Predecessor: predecessor,
+		Successor:   successor,
+		Timestamp:   time.Now().Unix(),
+	}
+	if len(secret) > 0 {
+		leave.Nonce = newNonce()
+		leave.MAC = leave.computeMAC(secret)
+	}
+	return encodeMessage(leave)
+}
+
+// EncodeLeaveMessage encodes a LEAVE as is, so it can be passed on with its MAC intact
+func EncodeLeaveMessage(leave *LeaveMessage) ([]byte, error) {
+	return encodeMessage(leave)
+}
@@ -0,0 +1,67 @@
+package communication
+
+// Messages for iterative lookups, where the querying node walks the ring
+// itself by asking each hop for the next one.
+
+// NextHopRequestMessage asks a peer whether it owns an object and, if not,
+// which peers to ask next.
+type NextHopRequestMessage struct {
+	LookupID uint64 // Chosen by the querier to match the answer
+	ObjectID int
+	ReplyTo  string // Address the NEXT_HOP should be sent to
+}
+
+// NextHopMessage answers a NextHopRequestMessage. When Owner is false, Next
+// lists the peers to ask next in order of preference, so the querier can skip
+// one that does not answer.
+type NextHopMessage struct {
+	LookupID uint64
+	From     NodeInfo
+	Owner    bool // Whether From owns the object
+	Next     []NodeInfo
+}
+
+func (m *NextHopRequestMessage) messageType() MessageType { return NEXT_HOP_REQUEST }
+
+func (m *NextHopRequestMessage) encode(w *wireWriter) {
+	w.uint64(m.LookupID)
+	w.int(m.ObjectID)
+	w.string(m.ReplyTo)
+}
+
+func (m *NextHopRequestMessage) decode(r *wireReader) {
+	m.LookupID = r.uint64()
+	m.ObjectID = r.int()
+	m.ReplyTo = r.string()
+}
+
+func (m *NextHopMessage) messageType() MessageType { return NEXT_HOP }
+
+func (m *NextHopMessage) encode(w *wireWriter) {
+	w.uint64(m.LookupID)
+	w.nodeInfo(m.From)
+	w.bool(m.Owner)
+	w.uint32(uint32(len(m.Next)))
+	for _, next := range m.Next {
+		w.nodeInfo(next)
+	}
+}
+
+func (m *NextHopMessage) decode(r *wireReader) {
+	m.LookupID = r.uint64()
+	m.From = r.nodeInfo()
+	m.Owner = r.bool()
+	// The count is not trusted for an allocation, a short payload fails on the reads
+	count := r.uint32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		m.Next = append(m.Next, r.nodeInfo())
+	}
+}
+
+func GetNextHopRequestMessage(lookupID uint64, objectID int, replyTo string) ([]byte, error) {
+	return encodeMessage(&NextHopRequestMessage{LookupID: lookupID, ObjectID: objectID, ReplyTo: replyTo})
+}
+
+func GetNextHopMessage(lookupID uint64, from NodeInfo, owner bool, next []NodeInfo) ([]byte, error) {
+	return encodeMessage(&NextHopMessage{LookupID: lookupID, From: from, Owner: owner, Next: next})
+}
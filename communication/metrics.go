@@ -0,0 +1,18 @@
+package communication
+
+import "dht/metrics"
+
+var (
+	messagesSent     = metrics.Default.Counter("dht_messages_sent_total", "Messages written to other nodes, by type.", "type")
+	messagesReceived = metrics.Default.Counter("dht_messages_received_total", "Messages read from other nodes, by type.", "type")
+	messagesDropped  = metrics.Default.Counter("dht_messages_dropped_total", "Messages read but never handled, by type and reason.", "type", "reason")
+	connectionsOpen  = metrics.Default.Gauge("dht_connections_open", "Connections currently open, by direction.", "direction")
+	connectionsTotal = metrics.Default.Counter("dht_connections_total", "Connections established since the node started, by direction.", "direction")
+	dialFailures     = metrics.Default.Counter("dht_dial_failures_total", "Attempts to dial another node that failed.")
+)
+
+// Connection directions, as seen from this node
+const (
+	directionIncoming = "incoming"
+	directionOutgoing = "outgoing"
+)
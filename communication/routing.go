@@ -0,0 +1,94 @@
+package communication
+
+// Messages clients use to learn the ring layout and send requests straight
+// to the peer that owns an object.
+
+// RequestFlags modify how peers handle a REQUEST.
+type RequestFlags uint8
+
+const (
+	// FLAG_DIRECT marks a request the client sent to the peer it believes
+	// owns the object. A peer that does not own it answers WRONG_OWNER
+	// instead of forwarding it around the ring.
+	FLAG_DIRECT RequestFlags = 1 << iota
+	// FLAG_TRACE asks every node the request passes through to add itself to
+	// its trace, which the owner returns with the result.
+	FLAG_TRACE
+)
+
+// Has reports whether every bit of flag is set.
+func (f RequestFlags) Has(flag RequestFlags) bool {
+	return f&flag == flag
+}
+
+// LayoutRequestMessage asks a bootstrap or peer for the peers it knows in the ring.
+type LayoutRequestMessage struct {
+	ReplyTo string // Address the LAYOUT should be sent to
+}
+
+// LayoutMessage lists the peers in the ring as known to the sender.
+type LayoutMessage struct {
+	Peers []NodeInfo
+}
+
+// WrongOwnerMessage tells a client that a direct request reached a peer that
+// does not own the object. Owner is the peer's best guess at the owner, with
+// an empty ID when it has none.
+type WrongOwnerMessage struct {
+	ReqID    int
+	ObjectID int
+	Owner    NodeInfo
+}
+
+func (m *LayoutRequestMessage) messageType() MessageType { return LAYOUT_REQUEST }
+
+func (m *LayoutRequestMessage) encode(w *wireWriter) {
+	w.string(m.ReplyTo)
+}
+
+func (m *LayoutRequestMessage) decode(r *wireReader) {
+	m.ReplyTo = r.string()
+}
+
+func (m *LayoutMessage) messageType() MessageType { return LAYOUT }
+
+func (m *LayoutMessage) encode(w *wireWriter) {
+	w.uint32(uint32(len(m.Peers)))
+	for _, peer := range m.Peers {
+		w.nodeInfo(peer)
+	}
+}
+
+func (m *LayoutMessage) decode(r *wireReader) {
+	// The count is not trusted for an allocation, a short payload fails on the reads
+	count := r.uint32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		m.Peers = append(m.Peers, r.nodeInfo())
+	}
+}
+
+func (m *WrongOwnerMessage) messageType() MessageType { return WRONG_OWNER }
+
+func (m *WrongOwnerMessage) encode(w *wireWriter) {
+	w.int(m.ReqID)
+	w.int(m.ObjectID)
+	w.nodeInfo(m.Owner)
+}
+
+func (m *WrongOwnerMessage) decode(r *wireReader) {
+	m.ReqID = r.int()
+	m.ObjectID = r.int()
+	m.Owner = r.nodeInfo()
+}
+
+func GetLayoutRequestMessage(replyTo string) ([]byte, error) {
+	return encodeMessage(&LayoutRequestMessage{ReplyTo: replyTo})
+}
+
+func GetLayoutMessage(peers []NodeInfo) ([]byte, error) {
+	return encodeMessage(&LayoutMessage{Peers: peers})
+}
+
+func GetWrongOwnerMessage(reqID, objectID int, owner NodeInfo) ([]byte, error) {
+	return encodeMessage(&WrongOwnerMessage{ReqID: reqID, ObjectID: objectID, Owner: owner})
+}
@@ -0,0 +1,212 @@
+package communication
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrCallsNotSupported is returned by Call when the remote node did not advertise FEATURE_RPC.
+var ErrCallsNotSupported = errors.New("remote node does not accept calls")
+
+// CallMessage wraps a request sent with Call. Frame is a complete message,
+// header included, and the answer comes back in a ReplyMessage with the same
+// CallID on the same connection.
+type CallMessage struct {
+	CallID uint64
+	Frame  []byte
+}
+
+// ReplyMessage carries the answer to a CallMessage.
+type ReplyMessage struct {
+	CallID uint64
+	Frame  []byte
+}
+
+func (m *CallMessage) messageType() MessageType { return CALL }
+
+func (m *CallMessage) encode(w *wireWriter) {
+	w.uint64(m.CallID)
+	w.raw(m.Frame)
+}
+
+func (m *CallMessage) decode(r *wireReader) {
+	m.CallID = r.uint64()
+	m.Frame = r.rest()
+}
+
+func (m *ReplyMessage) messageType() MessageType { return REPLY }
+
+func (m *ReplyMessage) encode(w *wireWriter) {
+	w.uint64(m.CallID)
+	w.raw(m.Frame)
+}
+
+func (m *ReplyMessage) decode(r *wireReader) {
+	m.CallID = r.uint64()
+	m.Frame = r.rest()
+}
+
+// decodeEmbedded decodes the frame carried by a CALL or REPLY. It may not be
+// a handshake message or another CALL or REPLY.
+func decodeEmbedded(frame []byte) (*Message, error) {
+	if len(frame) < headerSize {
+		return nil, errTruncated
+	}
+	header := MessageHeader{
+		Version: frame[0],
+		Type:    MessageType(frame[1]),
+		Length:  binary.BigEndian.Uint32(frame[2:headerSize]),
+	}
+	if int64(header.Length) != int64(len(frame)-headerSize) {
+		return nil, &ProtocolError{Kind: ErrMalformedPayload, Header: header, Err: fmt.Errorf("embedded frame announces %d bytes, carries %d", header.Length, len(frame)-headerSize)}
+	}
+	if header.Version < MinProtocolVersion || header.Version > ProtocolVersion {
+		return nil, &ProtocolError{Kind: ErrUnsupportedVersion, Header: header}
+	}
+	switch header.Type {
+	case HELLO, HELLO_ACK, HELLO_REJECT, CALL, REPLY:
+		return nil, &ProtocolError{Kind: ErrUnexpectedMessage, Header: header, Err: fmt.Errorf("%s cannot be embedded", header.Type)}
+	}
+	return decodeFrame(header, frame[headerSize:])
+}
+
+// callResult is what a pending call is woken up with
+type callResult struct {
+	message *Message
+	err     error
+}
+
+// pendingCalls matches the replies arriving on one outgoing connection to
+// the calls made on it, so no other connection can answer them.
+type pendingCalls struct {
+	mu      sync.Mutex
+	next    uint64
+	waiting map[uint64]chan callResult
+	err     error // Set once the connection is gone, failing every call after it
+}
+
+func newPendingCalls() *pendingCalls {
+	return &pendingCalls{waiting: make(map[uint64]chan callResult)}
+}
+
+func (p *pendingCalls) start() (uint64, chan callResult, error) {
+	result := make(chan callResult, 1)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return 0, nil, p.err
+	}
+	p.next++
+	p.waiting[p.next] = result
+	return p.next, result, nil
+}
+
+func (p *pendingCalls) end(callID uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.waiting, callID)
+}
+
+// deliver wakes the call a reply belongs to. Replies to calls that gave up are dropped.
+func (p *pendingCalls) deliver(reply *ReplyMessage) {
+	p.mu.Lock()
+	result, ok := p.waiting[reply.CallID]
+	delete(p.waiting, reply.CallID)
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	message, err := decodeEmbedded(reply.Frame)
+	result <- callResult{message: message, err: err}
+}
+
+// fail wakes every waiting call with err, and fails the calls started after it.
+func (p *pendingCalls) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+	for callID, result := range p.waiting {
+		result <- callResult{err: err}
+		delete(p.waiting, callID)
+	}
+}
+
+// Call sends message, a complete frame such as one built by a Get*Message
+// function, and waits for the answer, which the remote node sends back on the
+// same connection. Without a deadline on ctx the call gives up after the
+// configured call timeout.
+func (c *TcpCommunicator) Call(ctx context.Context, to string, message []byte) (*Message, error) {
+	if _, ok := ctx.Deadline(); !ok && c.connectionOptions.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.connectionOptions.CallTimeout)
+		defer cancel()
+	}
+
+	conn, err := c.getConnection(ctx, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to establish connection to %s: %w", to, err)
+	}
+	if !conn.session.features.Has(FEATURE_RPC) {
+		return nil, fmt.Errorf("calling %s: %w", to, ErrCallsNotSupported)
+	}
+
+	callID, result, err := conn.calls.start()
+	if err != nil {
+		return nil, fmt.Errorf("call to %s: %w", to, err)
+	}
+	defer conn.calls.end(callID)
+	frame, err := encodeMessage(&CallMessage{CallID: callID, Frame: message})
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.send(ctx, frame); err != nil {
+		if ctx.Err() == nil {
+			c.removeConnection(conn)
+		}
+		return nil, fmt.Errorf("failed to send call to %s: %w", to, err)
+	}
+
+	select {
+	case r := <-result:
+		if r.err != nil {
+			return nil, fmt.Errorf("reply from %s: %w", to, r.err)
+		}
+		return r.message, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("call to %s: %w", to, ctx.Err())
+	}
+}
+
+// Responder sends the answer to a request.
+type Responder func(ctx context.Context, reply []byte) error
+
+// Responder returns how to answer message: on the connection it came in on
+// when it was sent with Call, and otherwise by sending to replyTo.
+func (c *TcpCommunicator) Responder(message Message, replyTo string) Responder {
+	if message.respond != nil {
+		return message.respond
+	}
+	return func(ctx context.Context, reply []byte) error {
+		return c.SendMessage(ctx, replyTo, reply)
+	}
+}
+
+// answerCalls returns the function replying to calls on an accepted connection
+func answerCalls(writer *connection, callID uint64) Responder {
+	return func(ctx context.Context, reply []byte) error {
+		frame, err := encodeMessage(&ReplyMessage{CallID: callID, Frame: reply})
+		if err != nil {
+			return err
+		}
+		if err := writer.send(ctx, frame); err != nil {
+			writer.logger.Warn("Failed to reply to call", "call_id", callID, "err", err)
+			return err
+		}
+		return nil
+	}
+}
@@ -0,0 +1,153 @@
+package communication
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listening starts a communicator on a free loopback port that hands every
+// message to deliver, and returns its address
+func listening(t *testing.T, id string, deliver func(c *TcpCommunicator, message Message)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	options := DefaultOptions()
+	options.Logger = discardLogger
+	c := NewTcpCommunicator(id, address, address, options)
+	t.Cleanup(c.Close)
+	go c.Listen(func(message Message) { go deliver(c, message) })
+	return address
+}
+
+// caller returns a communicator that only dials out, giving up on calls after callTimeout
+func caller(t *testing.T, callTimeout time.Duration) *TcpCommunicator {
+	t.Helper()
+	options := DefaultOptions()
+	options.Logger = discardLogger
+	options.Connection.CallTimeout = callTimeout
+	c := NewTcpCommunicator("client", "127.0.0.1:0", "127.0.0.1:0", options)
+	t.Cleanup(c.Close)
+	return c
+}
+
+// nextHopQuestion asks about objectID under lookup ID id
+func nextHopQuestion(t *testing.T, id uint64, objectID int) []byte {
+	t.Helper()
+	question, err := GetNextHopRequestMessage(id, objectID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return question
+}
+
+// answerAfter answers a NEXT_HOP_REQUEST after as many milliseconds as its object ID
+func answerAfter(c *TcpCommunicator, message Message) {
+	question, ok := message.Payload.(*NextHopRequestMessage)
+	if !ok {
+		return
+	}
+	time.Sleep(time.Duration(question.ObjectID) * time.Millisecond)
+	if answer, err := GetNextHopMessage(question.LookupID, NodeInfo{ID: c.ID()}, true, nil); err == nil {
+		c.Responder(message, question.ReplyTo)(context.Background(), answer)
+	}
+}
+
+func TestCallMatchesRepliesToCalls(t *testing.T) {
+	address := listening(t, "n66", answerAfter)
+	c := caller(t, 5*time.Second)
+
+	// The first call is answered last
+	var wg sync.WaitGroup
+	for id, delay := range map[uint64]int{1: 60, 2: 30, 3: 0} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply, err := c.Call(context.Background(), address, nextHopQuestion(t, id, delay))
+			if err != nil {
+				t.Errorf("call %d: %v", id, err)
+				return
+			}
+			if answer := reply.Payload.(*NextHopMessage); answer.LookupID != id || answer.From.ID != "n66" {
+				t.Errorf("call %d answered with %+v", id, answer)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCallTimesOut(t *testing.T) {
+	address := listening(t, "n66", func(*TcpCommunicator, Message) {})
+	c := caller(t, 50*time.Millisecond)
+
+	start := time.Now()
+	if _, err := c.Call(context.Background(), address, nextHopQuestion(t, 1, 0)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("gave up after %v, want about the call timeout", waited)
+	}
+}
+
+func TestCallGivesUpWhenCancelled(t *testing.T) {
+	address := listening(t, "n66", func(*TcpCommunicator, Message) {})
+	c := caller(t, 5*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := c.Call(ctx, address, nextHopQuestion(t, 1, 0)); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestCallDropsLateReplies(t *testing.T) {
+	address := listening(t, "n66", answerAfter)
+	c := caller(t, 5*time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.Call(ctx, address, nextHopQuestion(t, 1, 100)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The late answer to the first call arrives while the second one waits
+	reply, err := c.Call(context.Background(), address, nextHopQuestion(t, 2, 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer := reply.Payload.(*NextHopMessage); answer.LookupID != 2 {
+		t.Errorf("second call answered with lookup %d", answer.LookupID)
+	}
+}
+
+func TestPendingCallsDropRepliesToEndedCalls(t *testing.T) {
+	calls := newPendingCalls()
+	callID, result, err := calls.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls.end(callID)
+	answer, err := GetNextHopMessage(1, NodeInfo{ID: "n66"}, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls.deliver(&ReplyMessage{CallID: callID, Frame: answer})
+	select {
+	case r := <-result:
+		t.Errorf("ended call woken with %+v", r)
+	default:
+	}
+
+	calls.fail(ErrConnectionClosed)
+	if _, _, err := calls.start(); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("call started on a failed connection: err = %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package communication
+
+// Messages peers exchange to keep their ring links correct as nodes join
+// without going through the bootstrap.
+
+// StabilizeMessage asks a peer's successor for its current predecessor.
+type StabilizeMessage struct {
+	From NodeInfo
+}
+
+// StabilizeReplyMessage answers a StabilizeMessage. Predecessor has an empty
+// ID when the sender does not know its predecessor.
+type StabilizeReplyMessage struct {
+	From        NodeInfo
+	Predecessor NodeInfo
+}
+
+// NotifyMessage tells a peer that the sender believes it is its predecessor.
+type NotifyMessage struct {
+	From NodeInfo
+}
+
+func (m *StabilizeMessage) messageType() MessageType { return STABILIZE }
+
+func (m *StabilizeMessage) encode(w *wireWriter) {
+	w.nodeInfo(m.From)
+}
+
+func (m *StabilizeMessage) decode(r *wireReader) {
+	m.From = r.nodeInfo()
+}
+
+func (m *StabilizeReplyMessage) messageType() MessageType { return STABILIZE_REPLY }
+
+func (m *StabilizeReplyMessage) encode(w *wireWriter) {
+	w.nodeInfo(m.From)
+	w.nodeInfo(m.Predecessor)
+}
+
+func (m *StabilizeReplyMessage) decode(r *wireReader) {
+	m.From = r.nodeInfo()
+	m.Predecessor = r.nodeInfo()
+}
+
+func (m *NotifyMessage) messageType() MessageType { return NOTIFY }
+
+func (m *NotifyMessage) encode(w *wireWriter) {
+	w.nodeInfo(m.From)
+}
+
+func (m *NotifyMessage) decode(r *wireReader) {
+	m.From = r.nodeInfo()
+}
+
+func GetStabilizeMessage(from NodeInfo) ([]byte, error) {
+	return encodeMessage(&StabilizeMessage{From: from})
+}
+
+func GetStabilizeReplyMessage(from, predecessor NodeInfo) ([]byte, error) {
+	return encodeMessage(&StabilizeReplyMessage{From: from, Predecessor: predecessor})
+}
+
+func GetNotifyMessage(from NodeInfo) ([]byte, error) {
+	return encodeMessage(&NotifyMessage{From: from})
+}
@@ -1,102 +1,406 @@
 package communication
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
 
-const TCPPort = "8888"
+// DefaultPort is used for any address that does not carry an explicit port.
+const DefaultPort = "8888"
+
+// Options groups the tunables of a TcpCommunicator.
+type Options struct {
+	Dial       DialOptions
+	Connection ConnectionOptions
+	TLS        *tls.Config  // Mutual TLS for every connection, nil for plain TCP
+	Logger     *slog.Logger // Where connection problems are logged, nil for slog.Default
+}
+
+// DefaultOptions returns the communicator settings used when nothing else is configured.
+func DefaultOptions() Options {
+	return Options{
+		Dial:       DefaultDialOptions(),
+		Connection: DefaultConnectionOptions(),
+	}
+}
 
 type TcpCommunicator struct {
-	selfId      string              // The ID of the current peer.
-	connections map[string]net.Conn // Maps peer IDs to their active TCP connections.
-	mu          sync.Mutex          // Mutex for thread-safe access to connections.
+	selfId            string                 // The ID of the current node.
+	listenAddress     string                 // The host:port this node accepts connections on.
+	advertiseAddress  string                 // The host:port other nodes use to reach this node.
+	dialOptions       DialOptions            // Timeouts and retry policy for outgoing connections.
+	connectionOptions ConnectionOptions      // Queueing, deadlines and keepalive for established connections.
+	tlsConfig         *tls.Config            // Mutual TLS configuration, nil when running plain TCP.
+	connections       map[string]*connection // Maps remote addresses to their active outgoing connections.
+	quarantined       *quarantine            // Senders refused after breaking the protocol.
+	listener          net.Listener           // Accepts incoming connections, nil before Listen.
+	accepted          map[net.Conn]struct{}  // Incoming connections being served.
+	stopping          bool                   // Set once the node stops accepting connections.
+	closed            chan struct{}          // Closed by Close, stops the idle connection reaper.
+	closeOnce         sync.Once              // Close may be called more than once.
+	logger            *slog.Logger           // Structured logger for connection problems.
+	mu                sync.Mutex             // Mutex for thread-safe access to connections.
+}
+
+func NewTcpCommunicator(id, listenAddress, advertiseAddress string, options Options) *TcpCommunicator {
+	c := &TcpCommunicator{
+		selfId:            id,
+		listenAddress:     NormalizeAddress(listenAddress),
+		advertiseAddress:  NormalizeAddress(advertiseAddress),
+		dialOptions:       options.Dial,
+		connectionOptions: options.Connection,
+		tlsConfig:         options.TLS,
+		connections:       make(map[string]*connection),
+		quarantined:       newQuarantine(),
+		accepted:          make(map[net.Conn]struct{}),
+		closed:            make(chan struct{}),
+		logger:            options.Logger,
+	}
+	if c.logger == nil {
+		c.logger = slog.Default()
+	}
+	if options.Connection.IdleTimeout > 0 {
+		go c.reapIdleConnections()
+	}
+	return c
+}
+
+// NormalizeAddress appends DefaultPort to an address that has no port.
+func NormalizeAddress(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(address, DefaultPort)
+}
+
+// ID returns the node ID this communicator belongs to.
+func (c *TcpCommunicator) ID() string {
+	return c.selfId
+}
+
+// Logger returns the logger the communicator was created with.
+func (c *TcpCommunicator) Logger() *slog.Logger {
+	return c.logger
+}
+
+// AdvertiseAddress returns the address other nodes should use to reach this node.
+func (c *TcpCommunicator) AdvertiseAddress() string {
+	return c.advertiseAddress
+}
+
+// SendMessage dynamically establishes a connection to the given address if one does not exist and then sends the message.
+// Dialing gives up once ctx is done or the configured number of attempts has been used.
+func (c *TcpCommunicator) SendMessage(ctx context.Context, to string, message []byte) error {
+	conn, err := c.getConnection(ctx, to)
+	if err != nil {
+		return fmt.Errorf("failed to establish connection to %s: %w", to, err)
+	}
+
+	// Hand the message to the connection's writer
+	if err := conn.send(ctx, message); err != nil {
+		c.logger.Warn("Failed to send message", "address", to, "msg_type", frameType(message), "err", err)
+		if ctx.Err() == nil {
+			// The connection itself failed, force re-establishment on the next send
+			c.removeConnection(conn)
+		}
+		return fmt.Errorf("failed to send message to %s: %w", to, err)
+	}
+
+	return nil
 }
 
-func NewTcpCommunicator(id string) *TcpCommunicator {
-	return &TcpCommunicator{
-		selfId:      id,
-		connections: make(map[string]net.Conn),
+// Probe makes sure a connection to address can be established and returns
+// the node ID that answered the handshake.
+func (c *TcpCommunicator) Probe(ctx context.Context, address string) (string, error) {
+	conn, err := c.getConnection(ctx, address)
+	if err != nil {
+		return "", err
 	}
+	return conn.session.remoteID, nil
 }
 
-// SendMessage dynamically establishes a connection if one does not exist and then sends the message.
-func (c *TcpCommunicator) SendMessage(to string, message []byte) error {
+// getConnection returns the live connection for an address, dialing a new one if needed.
+func (c *TcpCommunicator) getConnection(ctx context.Context, address string) (*connection, error) {
 	c.mu.Lock()
-	conn, exists := c.connections[to]
+	conn, exists := c.connections[address]
 	c.mu.Unlock()
+	if exists && !conn.isClosed() {
+		return conn, nil
+	}
 
-	if !exists {
-		// Establish the connection if it does not exist
-		var err error
-		conn, err = c.establishConnection(to)
+	// Dial without holding the lock so sends to other addresses are not held up
+	netConn, err := c.establishConnection(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if c.tlsConfig != nil {
+		netConn, err = c.secureClient(ctx, address, netConn)
 		if err != nil {
-			return fmt.Errorf("failed to establish connection to peer %s: %w", to, err)
-		} else {
-			// Store the connection for future use
-			c.mu.Lock()
-			c.connections[to] = conn
-			c.mu.Unlock()
+			return nil, err
 		}
 	}
-
-	// Send the message
-	_, err := conn.Write(message)
+	session, err := c.clientHandshake(ctx, address, netConn)
 	if err != nil {
-		log.Printf("Failed to send message to peer %s: %v", to, err)
-		// If sending fails, remove the connection to force re-establishment later
-		c.mu.Lock()
-		delete(c.connections, to)
-		c.mu.Unlock()
-		return fmt.Errorf("failed to send message to peer %s: %w", to, err)
+		netConn.Close()
+		return nil, err
 	}
 
-	return nil
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, ok := c.connections[address]; ok && !existing.isClosed() {
+		// Another sender won the race, keep a single connection per address
+		netConn.Close()
+		return existing, nil
+	}
+	logger := c.logger.With("peer", session.remoteID, "address", address)
+	conn = newConnection(address, netConn, session, c.connectionOptions, logger)
+	c.connections[address] = conn
+	return conn, nil
+}
+
+// removeConnection closes a connection and forgets it if it is still the current one for its address.
+func (c *TcpCommunicator) removeConnection(conn *connection) {
+	conn.close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connections[conn.address] == conn {
+		delete(c.connections, conn.address)
+	}
 }
 
-// establishConnection establishes a TCP connection to a specific peer and stores it in the connections map.
-func (c *TcpCommunicator) establishConnection(address string) (net.Conn, error) {
+// reapIdleConnections periodically closes outgoing connections that have not
+// been used recently, until the communicator is closed.
+func (c *TcpCommunicator) reapIdleConnections() {
+	ticker := time.NewTicker(max(c.connectionOptions.IdleTimeout/2, time.Millisecond))
+	defer ticker.Stop()
+
 	for {
-		conn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", address, TCPPort))
-		if err == nil {
-			return conn, nil
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-c.closed:
+			return
 		}
-
-		// Retry after a short delay if the connection fails
-		time.Sleep(500 * time.Millisecond)
+		c.mu.Lock()
+		for address, conn := range c.connections {
+			if conn.isClosed() || (conn.idleFor(now) > c.connectionOptions.IdleTimeout && len(conn.queue) == 0) {
+				conn.close()
+				delete(c.connections, address)
+			}
+		}
+		c.mu.Unlock()
 	}
 }
 
-func (c *TcpCommunicator) Listen(messageCh chan Message) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", TCPPort))
+// Listen accepts connections and passes every message read to deliver, which
+// runs on the goroutine serving that connection: until it returns, nothing
+// more is read from that connection.
+func (c *TcpCommunicator) Listen(deliver func(Message)) {
+	listener, err := net.Listen("tcp", c.listenAddress)
 	if err != nil {
-		log.Fatalf("Failed to start listener on port %s: %v", TCPPort, err)
+		c.logger.Error("Failed to start listener", "address", c.listenAddress, "err", err)
+		os.Exit(1)
 	}
 	defer listener.Close()
+	c.mu.Lock()
+	if c.stopping {
+		c.mu.Unlock()
+		return
+	}
+	c.listener = listener
+	c.mu.Unlock()
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Failed to accept connection: %v", err)
+			if c.isStopping() {
+				return
+			}
+			c.logger.Warn("Failed to accept connection", "err", err)
+			continue
+		}
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if c.quarantined.contains(host) {
+			conn.Close()
 			continue
 		}
-		go func(conn net.Conn) {
-			defer func() {
-				conn.Close()
-			}()
-			for {
-				// Read and parse the message
-				fullMessage, err := ReadMessage(conn)
-				if err != nil {
-					log.Printf("Failed to read and parse message from %s: %v", conn.RemoteAddr().String(), err)
-					break
-				}
-				// Handle the message
-				messageCh <- *fullMessage
+		setKeepAlive(conn, c.connectionOptions.KeepAlive)
+		c.mu.Lock()
+		c.accepted[conn] = struct{}{}
+		c.mu.Unlock()
+		go c.serveConnection(conn, deliver)
+	}
+}
+
+// StopListening stops accepting connections. Connections already accepted
+// are still served, so requests in flight can be answered.
+func (c *TcpCommunicator) StopListening() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopping = true
+	if c.listener != nil {
+		c.listener.Close()
+	}
+}
+
+func (c *TcpCommunicator) isStopping() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stopping
+}
+
+// Close stops accepting connections and closes every connection, incoming
+// and outgoing, and stops the idle connection reaper. Frames still queued on
+// them are dropped.
+func (c *TcpCommunicator) Close() {
+	c.StopListening()
+	c.closeOnce.Do(func() { close(c.closed) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for address, conn := range c.connections {
+		conn.close()
+		delete(c.connections, address)
+	}
+	for conn := range c.accepted {
+		conn.Close()
+	}
+}
+
+// serveConnection reads frames from an accepted connection until it closes.
+// Senders that keep breaking the protocol are disconnected and quarantined,
+// without affecting any other connection.
+func (c *TcpCommunicator) serveConnection(conn net.Conn, deliver func(Message)) {
+	accepted := conn // conn is replaced by its TLS wrapper below
+	connectionsOpen.Add(1, directionIncoming)
+	connectionsTotal.Inc(directionIncoming)
+	defer func() {
+		connectionsOpen.Add(-1, directionIncoming)
+		conn.Close()
+		c.mu.Lock()
+		delete(c.accepted, accepted)
+		c.mu.Unlock()
+	}()
+	remote := conn.RemoteAddr().String()
+	host, _, _ := net.SplitHostPort(remote)
+
+	if c.tlsConfig != nil {
+		secured, err := c.secureServer(conn)
+		if err != nil {
+			c.logger.Warn("TLS handshake failed", "address", remote, "err", err)
+			return
+		}
+		conn = secured
+	}
+
+	session, err := c.serverHandshake(conn, host)
+	if err != nil {
+		c.logger.Warn("Handshake failed", "address", remote, "err", err)
+		var protocolErr *ProtocolError
+		if errors.As(err, &protocolErr) {
+			// Nothing identifies the sender yet but its host
+			c.quarantined.add(host, c.connectionOptions.Quarantine)
+		}
+		return
+	}
+
+	logger := c.logger.With("peer", session.remoteID, "address", remote)
+
+	// Calls are answered on this connection, through a writer of its own
+	writer := newWriter(remote, conn, session, c.connectionOptions, logger)
+	defer writer.close()
+
+	protocolErrors := 0 // Recoverable protocol errors seen on this connection
+	for {
+		// Read and parse the message
+		fullMessage, err := ReadMessage(conn, c.connectionOptions.MaxFrameSize)
+		if err == nil && fullMessage.Header.Version != session.version {
+			err = &ProtocolError{Kind: ErrUnsupportedVersion, Header: fullMessage.Header, Err: fmt.Errorf("negotiated version %d", session.version)}
+		}
+		if err == nil {
+			messagesReceived.Inc(fullMessage.Header.Type.String())
+			fullMessage, err = unwrapCall(fullMessage, session, writer)
+		}
+
+		var protocolErr *ProtocolError
+		if errors.As(err, &protocolErr) {
+			protocolErrors++
+			logger.Warn("Protocol error", "msg_type", protocolErr.Header.Type, "count", protocolErrors, "max", c.connectionOptions.MaxProtocolErrors, "err", err)
+			if protocolErr.Recoverable() && protocolErrors < c.connectionOptions.MaxProtocolErrors {
+				continue
 			}
-		}(conn)
+			logger.Warn("Disconnecting and quarantining sender", "quarantine", c.connectionOptions.Quarantine)
+			c.quarantined.add(c.quarantineKey(host, session.remoteID), c.connectionOptions.Quarantine)
+			return
+		}
+		if err != nil {
+			if err != io.EOF && !c.isStopping() {
+				logger.Warn("Failed to read message", "err", err)
+			}
+			return
+		}
+
+		if c.tlsConfig != nil {
+			// The handshake checked the announced ID against the certificate
+			fullMessage.Sender = session.remoteID
+		}
+
+		// Handle the message
+		deliver(*fullMessage)
+	}
+}
+
+// unwrapCall returns the message inside a CALL, set up to be answered on the
+// connection it came in on. Other messages are returned as they are.
+func unwrapCall(message *Message, session session, writer *connection) (*Message, error) {
+	switch payload := message.Payload.(type) {
+	case *CallMessage:
+		if !session.features.Has(FEATURE_RPC) {
+			return nil, &ProtocolError{Kind: ErrUnexpectedMessage, Header: message.Header, Err: fmt.Errorf("calls were not negotiated")}
+		}
+		inner, err := decodeEmbedded(payload.Frame)
+		if err != nil {
+			var protocolErr *ProtocolError
+			if errors.As(err, &protocolErr) {
+				return nil, protocolErr
+			}
+			return nil, &ProtocolError{Kind: ErrMalformedPayload, Header: message.Header, Err: err}
+		}
+		inner.respond = answerCalls(writer, payload.CallID)
+		return inner, nil
+	case *ReplyMessage:
+		return nil, &ProtocolError{Kind: ErrUnexpectedMessage, Header: message.Header, Err: fmt.Errorf("reply on an incoming connection")}
+	default:
+		return message, nil
+	}
+}
+
+// secureClient runs the TLS handshake on a freshly dialed connection.
+func (c *TcpCommunicator) secureClient(ctx context.Context, address string, conn net.Conn) (net.Conn, error) {
+	tlsConn := tls.Client(conn, c.tlsConfig)
+	tlsConn.SetDeadline(c.handshakeDeadline(ctx))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s: %w", address, err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// secureServer runs the TLS handshake on an accepted connection.
+func (c *TcpCommunicator) secureServer(conn net.Conn) (net.Conn, error) {
+	tlsConn := tls.Server(conn, c.tlsConfig)
+	tlsConn.SetDeadline(c.handshakeDeadline(context.Background()))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
 	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
 }
@@ -0,0 +1,88 @@
+package communication
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+)
+
+// LoadTLSConfig builds a mutual TLS configuration for the node nodeID.
+// Every node presents the certificate in certFile both when dialing and when
+// accepting, and only trusts peers whose certificate chains to caFile. The
+// node ID must appear in the certificate as its common name or a DNS name,
+// since that is what other nodes check the HELLO against.
+func LoadTLSConfig(certFile, keyFile, caFile, nodeID string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate %s: %w", certFile, err)
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate %s: %w", certFile, err)
+	}
+	if !certificateMatches(leaf, nodeID) {
+		return nil, fmt.Errorf("certificate %s does not name node %q", certFile, nodeID)
+	}
+
+	caBytes, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA %s: %w", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("no certificates found in CA %s", caFile)
+	}
+
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{certificate},
+		// Accepting side: require a client certificate signed by our CA
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+		// Dialing side: nodes are dialed by address, not by name, so the
+		// default hostname check is replaced by a chain check here and a
+		// node ID check against the HELLO once it arrives.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("peer presented no certificate")
+			}
+			options := x509.VerifyOptions{
+				Roots:         pool,
+				Intermediates: x509.NewCertPool(),
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			}
+			for _, intermediate := range state.PeerCertificates[1:] {
+				options.Intermediates.AddCert(intermediate)
+			}
+			_, err := state.PeerCertificates[0].Verify(options)
+			return err
+		},
+	}, nil
+}
+
+// certificateMatches reports whether the certificate names the given node ID.
+func certificateMatches(certificate *x509.Certificate, nodeID string) bool {
+	return certificate.Subject.CommonName == nodeID || slices.Contains(certificate.DNSNames, nodeID)
+}
+
+// verifyPeerIdentity checks that a TLS peer's certificate belongs to the node
+// ID it announced during the handshake. Plain TCP connections are not checked.
+func verifyPeerIdentity(conn net.Conn, nodeID string) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certificates := tlsConn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return errors.New("peer presented no certificate")
+	}
+	if !certificateMatches(certificates[0], nodeID) {
+		return fmt.Errorf("certificate for %q does not match node ID %q", certificates[0].Subject.CommonName, nodeID)
+	}
+	return nil
+}
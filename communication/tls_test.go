@@ -0,0 +1,209 @@
+package communication
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a throwaway certificate authority
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	file        string // PEM bundle holding the CA certificate
+}
+
+// writePEM writes one PEM block to a new file in dir
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{certificate: certificate, key: key, file: writePEM(t, t.TempDir(), "ca.pem", "CERTIFICATE", der)}
+}
+
+// issue signs a certificate with the given common name and DNS names and
+// returns the paths of it and its key
+func (ca *testCA) issue(t *testing.T, commonName string, dnsNames ...string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	return writePEM(t, dir, "node.pem", "CERTIFICATE", der), writePEM(t, dir, "node.key", "EC PRIVATE KEY", keyDER)
+}
+
+// tlsConfig loads the configuration of a node holding a certificate ca issues to name
+func (ca *testCA) tlsConfig(t *testing.T, name string) *tls.Config {
+	t.Helper()
+	certFile, keyFile := ca.issue(t, name)
+	config, err := LoadTLSConfig(certFile, keyFile, ca.file, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// tlsCommunicator returns a communicator for id that is never started and uses config
+func tlsCommunicator(id string, config *tls.Config) *TcpCommunicator {
+	options := DefaultOptions()
+	options.Connection.IdleTimeout = 0
+	options.Logger = discardLogger
+	options.TLS = config
+	return NewTcpCommunicator(id, "127.0.0.1:0", "127.0.0.1:0", options)
+}
+
+// connectTLS runs the TLS handshake and then the HELLO exchange between
+// dialer and accepter, returning the errors of the dialing and accepting sides
+func connectTLS(dialer, accepter *TcpCommunicator) (error, error) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		secured, err := accepter.secureServer(server)
+		if err == nil {
+			_, err = accepter.serverHandshake(secured, "127.0.0.1")
+		}
+		server.Close()
+		accepted <- err
+	}()
+	secured, err := dialer.secureClient(context.Background(), "n66:8888", client)
+	if err == nil {
+		_, err = dialer.clientHandshake(context.Background(), "n66:8888", secured)
+	}
+	client.Close()
+	return err, <-accepted
+}
+
+func TestLoadTLSConfigRequiresCertificateNamingNode(t *testing.T) {
+	ca := newTestCA(t)
+	tests := []struct {
+		name       string
+		commonName string
+		dnsNames   []string
+		ok         bool
+	}{
+		{"common name", "n5", nil, true},
+		{"DNS name", "peer", []string{"n5"}, true},
+		{"other node", "n66", []string{"n30"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			certFile, keyFile := ca.issue(t, test.commonName, test.dnsNames...)
+			_, err := LoadTLSConfig(certFile, keyFile, ca.file, "n5")
+			if (err == nil) != test.ok {
+				t.Errorf("err = %v, want loaded %v", err, test.ok)
+			}
+		})
+	}
+}
+
+func TestTLSHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	dialer := tlsCommunicator("n5", ca.tlsConfig(t, "n5"))
+	accepter := tlsCommunicator("n66", ca.tlsConfig(t, "n66"))
+	if dialErr, acceptErr := connectTLS(dialer, accepter); dialErr != nil || acceptErr != nil {
+		t.Errorf("dialing: %v, accepting: %v", dialErr, acceptErr)
+	}
+}
+
+func TestTLSHandshakeRefusesHelloForAnotherNode(t *testing.T) {
+	ca := newTestCA(t)
+	// n30 holds a valid certificate, but announces itself as n5
+	dialer := tlsCommunicator("n5", ca.tlsConfig(t, "n30"))
+	accepter := tlsCommunicator("n66", ca.tlsConfig(t, "n66"))
+	dialErr, acceptErr := connectTLS(dialer, accepter)
+	if acceptErr == nil {
+		t.Error("accepted a HELLO from n5 over n30's certificate")
+	}
+	if _, rejected := dialErr.(*HandshakeError); !rejected {
+		t.Errorf("dialing side: err = %v, want a HELLO_REJECT", dialErr)
+	}
+}
+
+func TestTLSHandshakeRefusesAnswerFromAnotherNode(t *testing.T) {
+	ca := newTestCA(t)
+	dialer := tlsCommunicator("n5", ca.tlsConfig(t, "n5"))
+	// n30 answers the HELLO as n66
+	accepter := tlsCommunicator("n66", ca.tlsConfig(t, "n30"))
+	if dialErr, _ := connectTLS(dialer, accepter); dialErr == nil {
+		t.Error("accepted a HELLO_ACK from n66 over n30's certificate")
+	}
+}
+
+func TestTLSHandshakeRefusesOtherCA(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	tests := []struct {
+		name             string
+		dialer, accepter *tls.Config
+	}{
+		{"dialer from another CA", other.tlsConfig(t, "n5"), ca.tlsConfig(t, "n66")},
+		{"accepter from another CA", ca.tlsConfig(t, "n5"), other.tlsConfig(t, "n66")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dialErr, acceptErr := connectTLS(tlsCommunicator("n5", test.dialer), tlsCommunicator("n66", test.accepter))
+			if dialErr == nil || acceptErr == nil {
+				t.Errorf("dialing: %v, accepting: %v, want both to fail", dialErr, acceptErr)
+			}
+		})
+	}
+}
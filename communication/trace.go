@@ -0,0 +1,49 @@
+package communication
+
+import (
+	"math"
+	"time"
+)
+
+// Hop records a node a traced request passed through and when it got there.
+type Hop struct {
+	Node string
+	Time time.Time
+}
+
+// StartTrace asks for the request to be traced, starting from origin, which
+// sent it and so is not counted as a hop.
+func (m *RequestMessage) StartTrace(origin string) {
+	m.Flags |= FLAG_TRACE
+	m.Trace = append(m.Trace, Hop{Node: origin, Time: time.Now()})
+}
+
+// AddHop counts node as a hop and appends it to the request's trace if the
+// client asked for one.
+func (m *RequestMessage) AddHop(node string) {
+	if m.HopCount < math.MaxUint8 {
+		m.HopCount++
+	}
+	if m.Flags.Has(FLAG_TRACE) {
+		m.Trace = append(m.Trace, Hop{Node: node, Time: time.Now()})
+	}
+}
+
+// hops writes a u32 count followed by each hop's node ID and Unix time in nanoseconds.
+func (w *wireWriter) hops(hops []Hop) {
+	w.uint32(uint32(len(hops)))
+	for _, hop := range hops {
+		w.string(hop.Node)
+		w.int64(hop.Time.UnixNano())
+	}
+}
+
+func (r *wireReader) hops() []Hop {
+	// The count is not trusted for an allocation, a short payload fails on the reads
+	count := r.uint32()
+	var hops []Hop
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		hops = append(hops, Hop{Node: r.string(), Time: time.Unix(0, r.int64())})
+	}
+	return hops
+}
@@ -0,0 +1,202 @@
+package communication
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Primitive encodings of the wire format. All integers are big-endian, see
+// PROTOCOL.md at the repository root for the full specification.
+
+var errTruncated = errors.New("payload truncated")
+var errInvalidMemberState = errors.New("invalid member state")
+
+// wireWriter appends encoded fields to a byte slice.
+type wireWriter struct {
+	buf     []byte
+	err     error
+	version uint8 // Protocol version whose layout is written
+}
+
+func (w *wireWriter) uint8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *wireWriter) bool(v bool) {
+	if v {
+		w.uint8(1)
+	} else {
+		w.uint8(0)
+	}
+}
+
+func (w *wireWriter) uint32(v uint32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, v)
+}
+
+func (w *wireWriter) uint64(v uint64) {
+	w.buf = binary.BigEndian.AppendUint64(w.buf, v)
+}
+
+func (w *wireWriter) int64(v int64) {
+	w.uint64(uint64(v))
+}
+
+// int writes a Go int as a signed 64-bit integer.
+func (w *wireWriter) int(v int) {
+	w.int64(int64(v))
+}
+
+// string writes a uint16 byte length followed by the UTF-8 bytes.
+func (w *wireWriter) string(v string) {
+	if len(v) > math.MaxUint16 {
+		if w.err == nil {
+			w.err = fmt.Errorf("string of %d bytes exceeds the wire limit of %d", len(v), math.MaxUint16)
+		}
+		return
+	}
+	w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+// bytes writes a uint16 length followed by the raw bytes.
+func (w *wireWriter) bytes(v []byte) {
+	if len(v) > math.MaxUint16 {
+		if w.err == nil {
+			w.err = fmt.Errorf("byte string of %d bytes exceeds the wire limit of %d", len(v), math.MaxUint16)
+		}
+		return
+	}
+	w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+// raw appends bytes as they are, for a field that runs to the end of the payload.
+func (w *wireWriter) raw(v []byte) {
+	w.buf = append(w.buf, v...)
+}
+
+func (w *wireWriter) nodeInfo(v NodeInfo) {
+	w.string(v.ID)
+	w.string(v.Address)
+}
+
+// wireReader consumes encoded fields from a byte slice. The first failure is
+// kept in err and every later read returns a zero value.
+type wireReader struct {
+	buf     []byte
+	err     error
+	version uint8 // Protocol version whose layout is read
+}
+
+func (r *wireReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = errTruncated
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *wireReader) uint8() uint8 {
+	b := r.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *wireReader) bool() bool {
+	switch v := r.uint8(); v {
+	case 0:
+		return false
+	case 1:
+		return true
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("invalid boolean value %d", v)
+		}
+		return false
+	}
+}
+
+func (r *wireReader) uint32() uint32 {
+	b := r.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *wireReader) uint64() uint64 {
+	b := r.take(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *wireReader) int64() int64 {
+	return int64(r.uint64())
+}
+
+// int reads a signed 64-bit integer into a Go int.
+func (r *wireReader) int() int {
+	v := r.int64()
+	if int64(int(v)) != v && r.err == nil {
+		r.err = fmt.Errorf("integer %d overflows int", v)
+	}
+	return int(v)
+}
+
+func (r *wireReader) string() string {
+	b := r.take(2)
+	if b == nil {
+		return ""
+	}
+	s := r.take(int(binary.BigEndian.Uint16(b)))
+	return string(s)
+}
+
+func (r *wireReader) bytes() []byte {
+	b := r.take(2)
+	if b == nil {
+		return nil
+	}
+	v := r.take(int(binary.BigEndian.Uint16(b)))
+	if len(v) == 0 {
+		return nil
+	}
+	return append([]byte(nil), v...)
+}
+
+// rest consumes everything left in the payload.
+func (r *wireReader) rest() []byte {
+	if r.err != nil {
+		return nil
+	}
+	v := append([]byte(nil), r.buf...)
+	r.buf = nil
+	return v
+}
+
+func (r *wireReader) nodeInfo() NodeInfo {
+	return NodeInfo{ID: r.string(), Address: r.string()}
+}
+
+// finish reports the first decoding error, or an error if bytes were left over.
+func (r *wireReader) finish() error {
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.buf) != 0 {
+		return fmt.Errorf("%d trailing bytes after payload", len(r.buf))
+	}
+	return nil
+}
@@ -0,0 +1,629 @@
+// Package consensus replicates a log of commands across a fixed set of
+// bootstrap replicas with the Raft consensus algorithm, so that ring
+// membership survives the loss of a minority of them.
+package consensus
+
+import (
+	"context"
+	"dht/communication"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrNotLeader is returned by Propose on a replica that is not the leader.
+var ErrNotLeader = errors.New("not the leader")
+
+// ErrLostLeadership is returned when a proposed command was overwritten by a newer leader.
+var ErrLostLeadership = errors.New("leadership lost before the command was committed")
+
+// maxBatch is the most entries sent in one APPEND_ENTRIES
+const maxBatch = 64
+
+// Role is the part a replica currently plays in the protocol.
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	default:
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+}
+
+// Options configures a replica.
+type Options struct {
+	Replicas        []communication.NodeInfo // Every replica of the cluster, this one included
+	StateDir        string                   // Directory the term, vote and log are kept in, empty to keep them in memory
+	ElectionTimeout time.Duration            // Followers start an election after hearing nothing for this long, randomized up to twice as long
+	Secret          []byte                   // Shared by the replicas only to sign their messages, nil when TLS certificates authenticate them
+}
+
+// entry is one entry of the replicated log.
+type entry struct {
+	Term    uint64 `json:"term"`
+	Command []byte `json:"command,omitempty"`
+}
+
+// waiter is a Propose call waiting for its entry to be applied
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// Node is one replica of the replicated log. Committed commands are handed
+// to the apply function in log order, on every replica.
+type Node struct {
+	id           string
+	replicas     map[string]communication.NodeInfo
+	timeout      time.Duration
+	heartbeat    time.Duration
+	apply        func(command []byte)
+	secret       []byte
+	storage      *storage
+	communicator *communication.TcpCommunicator
+	logger       *slog.Logger
+
+	mu          sync.Mutex
+	role        Role
+	currentTerm uint64
+	votedFor    string
+	log         []entry // log[0] is a sentinel so that indexes start at 1
+	commitIndex uint64
+	lastApplied uint64
+	leaderID    string
+	votes       map[string]bool
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	deadline    time.Time // When a follower or candidate starts the next election
+	waiters     map[uint64]waiter
+	committed   chan struct{}   // Wakes the applier when commitIndex moves
+	unreachable map[string]bool // Replicas the last send to failed, so a down replica is reported once
+}
+
+// NewNode restores a replica from its state directory and starts it as a follower.
+func NewNode(id string, options Options, apply func(command []byte), communicator *communication.TcpCommunicator, logger *slog.Logger) (*Node, error) {
+	replicas := make(map[string]communication.NodeInfo, len(options.Replicas))
+	for _, replica := range options.Replicas {
+		replicas[replica.ID] = replica
+	}
+	if _, ok := replicas[id]; !ok {
+		return nil, fmt.Errorf("%s is not one of the replicas", id)
+	}
+	if options.ElectionTimeout <= 0 {
+		return nil, fmt.Errorf("election timeout must be positive")
+	}
+
+	storage, state, log, err := openStorage(options.StateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		id:           id,
+		replicas:     replicas,
+		timeout:      options.ElectionTimeout,
+		heartbeat:    options.ElectionTimeout / 10,
+		apply:        apply,
+		secret:       options.Secret,
+		storage:      storage,
+		communicator: communicator,
+		logger:       logger,
+		role:         Follower,
+		currentTerm:  state.Term,
+		votedFor:     state.VotedFor,
+		log:          append([]entry{{}}, log...),
+		waiters:      make(map[uint64]waiter),
+		unreachable:  make(map[string]bool),
+		committed:    make(chan struct{}, 1),
+	}
+	n.resetDeadline()
+	go n.run()
+	go n.applyCommitted()
+	return n, nil
+}
+
+// Leader returns the current leader, if this replica knows one.
+func (n *Node) Leader() (communication.NodeInfo, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	leader, ok := n.replicas[n.leaderID]
+	return leader, ok
+}
+
+// IsLeader reports whether this replica is the leader.
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == Leader
+}
+
+// Propose appends a command to the log and waits until it has been committed
+// and applied on this replica. Only the leader accepts proposals.
+func (n *Node) Propose(ctx context.Context, command []byte) error {
+	if len(command) == 0 {
+		return fmt.Errorf("empty command")
+	}
+
+	n.mu.Lock()
+	if n.role != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	proposed := entry{Term: n.currentTerm, Command: command}
+	if err := n.storage.append([]entry{proposed}); err != nil {
+		n.mu.Unlock()
+		return fmt.Errorf("persisting log entry: %w", err)
+	}
+	n.log = append(n.log, proposed)
+	index := n.lastIndex()
+	n.matchIndex[n.id] = index
+	done := make(chan error, 1)
+	n.waiters[index] = waiter{term: proposed.Term, done: done}
+	n.broadcastAppend()
+	n.advanceCommit()
+	n.mu.Unlock()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, index)
+		n.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Handle processes a consensus message from another replica, once it is
+// sure the replica the message claims to come from really sent it.
+func (n *Node) Handle(message communication.Message) {
+	var claimed string
+	switch m := message.Payload.(type) {
+	case *communication.VoteRequestMessage:
+		claimed = m.CandidateID
+	case *communication.VoteResponseMessage:
+		claimed = m.VoterID
+	case *communication.AppendEntriesMessage:
+		claimed = m.LeaderID
+	case *communication.AppendResponseMessage:
+		claimed = m.FollowerID
+	default:
+		return
+	}
+	if err := n.authenticate(message, claimed); err != nil {
+		n.logger.Warn("Ignoring replica message", "msg_type", message.Header.Type, "peer", claimed, "err", err)
+		return
+	}
+
+	switch m := message.Payload.(type) {
+	case *communication.VoteRequestMessage:
+		n.handleVoteRequest(m)
+	case *communication.VoteResponseMessage:
+		n.handleVoteResponse(m)
+	case *communication.AppendEntriesMessage:
+		n.handleAppendEntries(m)
+	case *communication.AppendResponseMessage:
+		n.handleAppendResponse(m)
+	}
+}
+
+// authenticate checks that a message claiming to come from the replica
+// claimed was sent by it: over a connection authenticated with that
+// replica's certificate, or signed with the secret only replicas hold.
+func (n *Node) authenticate(message communication.Message, claimed string) error {
+	if _, ok := n.replicas[claimed]; !ok {
+		return fmt.Errorf("%s is not one of the replicas", claimed)
+	}
+	if message.Sender != "" {
+		if message.Sender != claimed {
+			return fmt.Errorf("sent by %s", message.Sender)
+		}
+		return nil
+	}
+	if len(n.secret) == 0 {
+		return fmt.Errorf("sender is not authenticated")
+	}
+	return communication.VerifyConsensus(n.secret, message.Payload)
+}
+
+// run drives elections and heartbeats
+func (n *Node) run() {
+	ticker := time.NewTicker(n.heartbeat)
+	defer ticker.Stop()
+	for range ticker.C {
+		n.mu.Lock()
+		if n.role == Leader {
+			n.broadcastAppend()
+		} else if time.Now().After(n.deadline) {
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// resetDeadline picks a new random election deadline. Callers hold n.mu.
+func (n *Node) resetDeadline() {
+	n.deadline = time.Now().Add(n.timeout + time.Duration(rand.Int63n(int64(n.timeout))))
+}
+
+func (n *Node) lastIndex() uint64 {
+	return uint64(len(n.log) - 1)
+}
+
+func (n *Node) lastTerm() uint64 {
+	return n.log[len(n.log)-1].Term
+}
+
+// persistState saves the term and vote, which must survive a restart before
+// the replica acts on them. Callers hold n.mu.
+func (n *Node) persistState() error {
+	if err := n.storage.saveState(hardState{Term: n.currentTerm, VotedFor: n.votedFor}); err != nil {
+		return fmt.Errorf("persisting consensus state: %w", err)
+	}
+	return nil
+}
+
+// stepDown makes a replica that failed to persist its state a follower
+// without a leader, so it does not act on what it could not record, and
+// holds off its next election for a full timeout. Callers hold n.mu.
+func (n *Node) stepDown(err error) {
+	n.logger.Error("Stepping down", "term", n.currentTerm, "err", err)
+	n.role = Follower
+	n.leaderID = ""
+	n.resetDeadline()
+}
+
+// becomeFollower steps down into term. A follower's election deadline is
+// left alone so that stale candidates cannot keep postponing elections.
+// Callers hold n.mu.
+func (n *Node) becomeFollower(term uint64) error {
+	if n.role != Follower {
+		n.logger.Info("Became follower", "term", term)
+		n.role = Follower
+		n.resetDeadline()
+	}
+	if term > n.currentTerm {
+		n.currentTerm = term
+		n.votedFor = ""
+		n.leaderID = ""
+		if err := n.persistState(); err != nil {
+			n.stepDown(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// startElection votes for itself and asks every other replica for its vote. Callers hold n.mu.
+func (n *Node) startElection() {
+	n.role = Candidate
+	n.currentTerm++
+	n.votedFor = n.id
+	n.leaderID = ""
+	if err := n.persistState(); err != nil {
+		// Asking for votes could mean voting twice in this term after a restart
+		n.stepDown(err)
+		return
+	}
+	n.votes = map[string]bool{n.id: true}
+	n.resetDeadline()
+	n.logger.Info("Starting election", "term", n.currentTerm)
+
+	if n.hasMajority(len(n.votes)) {
+		n.becomeLeader()
+		return
+	}
+	message, err := communication.GetVoteRequestMessage(n.currentTerm, n.id, n.lastIndex(), n.lastTerm(), n.secret)
+	if err != nil {
+		n.logger.Error("Failed to encode message", "msg_type", communication.VOTE_REQUEST, "err", err)
+		return
+	}
+	for id := range n.replicas {
+		if id != n.id {
+			n.send(id, message)
+		}
+	}
+}
+
+func (n *Node) hasMajority(count int) bool {
+	return count > len(n.replicas)/2
+}
+
+// becomeLeader takes over the log. The no-op entry it appends lets entries
+// from earlier terms commit. Callers hold n.mu.
+func (n *Node) becomeLeader() {
+	n.role = Leader
+	n.leaderID = n.id
+	n.logger.Info("Became leader", "term", n.currentTerm)
+
+	noop := entry{Term: n.currentTerm}
+	if err := n.storage.append([]entry{noop}); err != nil {
+		n.stepDown(fmt.Errorf("persisting log entry: %w", err))
+		return
+	}
+	n.log = append(n.log, noop)
+
+	n.nextIndex = make(map[string]uint64, len(n.replicas))
+	n.matchIndex = make(map[string]uint64, len(n.replicas))
+	for id := range n.replicas {
+		n.nextIndex[id] = n.lastIndex()
+	}
+	n.matchIndex[n.id] = n.lastIndex()
+	n.broadcastAppend()
+	n.advanceCommit()
+}
+
+func (n *Node) handleVoteRequest(request *communication.VoteRequestMessage) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if request.Term > n.currentTerm {
+		if err := n.becomeFollower(request.Term); err != nil {
+			return
+		}
+	}
+	// Only vote for candidates whose log holds everything this replica may have acknowledged
+	upToDate := request.LastLogTerm > n.lastTerm() ||
+		(request.LastLogTerm == n.lastTerm() && request.LastLogIndex >= n.lastIndex())
+	granted := request.Term == n.currentTerm && upToDate &&
+		(n.votedFor == "" || n.votedFor == request.CandidateID)
+	if granted {
+		n.votedFor = request.CandidateID
+		if err := n.persistState(); err != nil {
+			// A vote that is not on disk could be given again after a restart
+			n.votedFor = ""
+			n.stepDown(err)
+			granted = false
+		} else {
+			n.resetDeadline()
+		}
+	}
+
+	message, err := communication.GetVoteResponseMessage(n.currentTerm, n.id, granted, n.secret)
+	if err != nil {
+		n.logger.Error("Failed to encode message", "msg_type", communication.VOTE_RESPONSE, "err", err)
+		return
+	}
+	n.send(request.CandidateID, message)
+}
+
+func (n *Node) handleVoteResponse(response *communication.VoteResponseMessage) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if response.Term > n.currentTerm {
+		n.becomeFollower(response.Term)
+		return
+	}
+	if n.role != Candidate || response.Term != n.currentTerm || !response.Granted {
+		return
+	}
+	n.votes[response.VoterID] = true
+	if n.hasMajority(len(n.votes)) {
+		n.becomeLeader()
+	}
+}
+
+// broadcastAppend sends every follower the entries it is missing, or a heartbeat. Callers hold n.mu.
+func (n *Node) broadcastAppend() {
+	for id := range n.replicas {
+		if id != n.id {
+			n.sendAppend(id)
+		}
+	}
+}
+
+// sendAppend sends one follower the entries from its next index on. Callers hold n.mu.
+func (n *Node) sendAppend(id string) {
+	prevIndex := n.nextIndex[id] - 1
+	end := min(uint64(len(n.log)), prevIndex+1+maxBatch)
+	entries := make([]communication.LogEntry, 0, end-prevIndex-1)
+	for _, e := range n.log[prevIndex+1 : end] {
+		entries = append(entries, communication.LogEntry{Term: e.Term, Command: e.Command})
+	}
+
+	message, err := communication.GetAppendEntriesMessage(n.currentTerm, n.id, prevIndex, n.log[prevIndex].Term, entries, n.commitIndex, n.secret)
+	if err != nil {
+		n.logger.Error("Failed to encode message", "msg_type", communication.APPEND_ENTRIES, "err", err)
+		return
+	}
+	n.send(id, message)
+}
+
+func (n *Node) handleAppendEntries(request *communication.AppendEntriesMessage) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	success, matchIndex, err := n.appendEntries(request)
+	if err != nil {
+		// Not answering makes the leader send the entries again
+		n.stepDown(err)
+		return
+	}
+	message, err := communication.GetAppendResponseMessage(n.currentTerm, n.id, success, matchIndex, n.secret)
+	if err != nil {
+		n.logger.Error("Failed to encode message", "msg_type", communication.APPEND_RESPONSE, "err", err)
+		return
+	}
+	n.send(request.LeaderID, message)
+}
+
+// appendEntries applies an APPEND_ENTRIES to the log and returns the answer,
+// or an error when the entries could not be persisted. Callers hold n.mu.
+func (n *Node) appendEntries(request *communication.AppendEntriesMessage) (bool, uint64, error) {
+	if request.Term < n.currentTerm {
+		return false, 0, nil
+	}
+	if err := n.becomeFollower(request.Term); err != nil {
+		return false, 0, err
+	}
+	n.resetDeadline()
+	if n.leaderID != request.LeaderID {
+		n.leaderID = request.LeaderID
+		n.logger.Info("Following leader", "leader", n.leaderID, "term", n.currentTerm)
+	}
+
+	// The log must hold the entry the new ones follow on from
+	if request.PrevLogIndex > n.lastIndex() {
+		return false, n.lastIndex(), nil
+	}
+	if n.log[request.PrevLogIndex].Term != request.PrevLogTerm {
+		return false, request.PrevLogIndex - 1, nil
+	}
+
+	// Skip what is already there and drop whatever conflicts with the leader
+	previous := slices.Clone(n.log[request.PrevLogIndex+1:])
+	var added []entry
+	truncated := false
+	for i, e := range request.Entries {
+		index := request.PrevLogIndex + 1 + uint64(i)
+		if index <= n.lastIndex() {
+			if n.log[index].Term == e.Term {
+				continue
+			}
+			n.log = n.log[:index]
+			truncated = true
+		}
+		added = append(added, entry{Term: e.Term, Command: e.Command})
+		n.log = append(n.log, added[len(added)-1])
+	}
+
+	var err error
+	if truncated {
+		err = n.storage.rewrite(n.log[1:])
+	} else if len(added) > 0 {
+		err = n.storage.append(added)
+	}
+	if err != nil {
+		// Acknowledging entries that are not on disk could lose committed
+		// changes, so forget them until the leader sends them again
+		n.log = append(n.log[:request.PrevLogIndex+1], previous...)
+		return false, 0, fmt.Errorf("persisting consensus log: %w", err)
+	}
+
+	matchIndex := request.PrevLogIndex + uint64(len(request.Entries))
+	// A delayed message may know less than the follower already does
+	if commitIndex := min(request.LeaderCommit, matchIndex); commitIndex > n.commitIndex {
+		n.commitIndex = commitIndex
+		n.signalCommit()
+	}
+	return true, matchIndex, nil
+}
+
+func (n *Node) handleAppendResponse(response *communication.AppendResponseMessage) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if response.Term > n.currentTerm {
+		n.becomeFollower(response.Term)
+		return
+	}
+	if n.role != Leader || response.Term != n.currentTerm {
+		return
+	}
+
+	if response.Success {
+		if response.MatchIndex > n.matchIndex[response.FollowerID] {
+			n.matchIndex[response.FollowerID] = response.MatchIndex
+		}
+		n.nextIndex[response.FollowerID] = n.matchIndex[response.FollowerID] + 1
+		n.advanceCommit()
+		return
+	}
+
+	// Back off towards the point where the logs agree and try again
+	next := min(n.nextIndex[response.FollowerID]-1, response.MatchIndex+1)
+	n.nextIndex[response.FollowerID] = max(next, 1)
+	n.sendAppend(response.FollowerID)
+}
+
+// advanceCommit commits the newest entry of the current term that a majority
+// has stored, and everything before it. Callers hold n.mu.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if n.log[index].Term != n.currentTerm {
+			// Entries from earlier terms only commit along with one from this term
+			return
+		}
+		count := 0
+		for _, match := range n.matchIndex {
+			if match >= index {
+				count++
+			}
+		}
+		if n.hasMajority(count) {
+			n.commitIndex = index
+			n.signalCommit()
+			return
+		}
+	}
+}
+
+func (n *Node) signalCommit() {
+	select {
+	case n.committed <- struct{}{}:
+	default:
+	}
+}
+
+// applyCommitted hands committed commands to the apply function in order and
+// releases the proposals waiting for them.
+func (n *Node) applyCommitted() {
+	for range n.committed {
+		for {
+			n.mu.Lock()
+			if n.lastApplied >= n.commitIndex {
+				n.mu.Unlock()
+				break
+			}
+			n.lastApplied++
+			index, applied := n.lastApplied, n.log[n.lastApplied]
+			w, waiting := n.waiters[index]
+			delete(n.waiters, index)
+			n.mu.Unlock()
+
+			if len(applied.Command) > 0 {
+				n.apply(applied.Command)
+			}
+			if waiting {
+				if w.term == applied.Term {
+					w.done <- nil
+				} else {
+					w.done <- ErrLostLeadership
+				}
+			}
+		}
+	}
+}
+
+// send delivers a message to a replica in the background. Raft tolerates lost
+// and reordered messages, so a failed send is only logged, once per outage.
+func (n *Node) send(id string, message []byte) {
+	address := n.replicas[id].Address
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+		defer cancel()
+		err := n.communicator.SendMessage(ctx, address, message)
+
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if err != nil && !n.unreachable[id] {
+			n.logger.Warn("Replica is unreachable", "peer", id, "err", err)
+		} else if err == nil && n.unreachable[id] {
+			n.logger.Info("Replica is reachable again", "peer", id)
+		}
+		n.unreachable[id] = err != nil
+	}()
+}
@@ -0,0 +1,385 @@
+package consensus
+
+import (
+	"context"
+	"dht/communication"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	testSecret = []byte("replica secret")
+	testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+)
+
+// freeAddress returns a loopback address nothing is listening on
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// replica is one member of a test cluster and the commands it applied
+type replica struct {
+	id           string
+	node         *Node
+	communicator *communication.TcpCommunicator
+	down         atomic.Bool // Set to cut the replica off from the others, as if it crashed
+	mu           sync.Mutex
+	applied      []string
+}
+
+// senderOf returns the replica a consensus message claims to come from
+func senderOf(message communication.Message) string {
+	switch m := message.Payload.(type) {
+	case *communication.VoteRequestMessage:
+		return m.CandidateID
+	case *communication.VoteResponseMessage:
+		return m.VoterID
+	case *communication.AppendEntriesMessage:
+		return m.LeaderID
+	case *communication.AppendResponseMessage:
+		return m.FollowerID
+	}
+	return ""
+}
+
+func (r *replica) appliedCommands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.applied)
+}
+
+// startCluster starts size replicas talking over loopback TCP and signing
+// their messages with testSecret
+func startCluster(t *testing.T, size int) []*replica {
+	t.Helper()
+	var members []communication.NodeInfo
+	for i := 1; i <= size; i++ {
+		members = append(members, communication.NodeInfo{ID: fmt.Sprintf("b%d", i), Address: freeAddress(t)})
+	}
+
+	replicas := make([]*replica, 0, size)
+	byID := make(map[string]*replica, size)
+	for _, member := range members {
+		r := &replica{id: member.ID}
+		options := communication.DefaultOptions()
+		options.Connection.IdleTimeout = 0
+		options.Dial.MaxAttempts = 1
+		options.Logger = testLogger
+		r.communicator = communication.NewTcpCommunicator(member.ID, member.Address, member.Address, options)
+		node, err := NewNode(member.ID, Options{Replicas: members, ElectionTimeout: 150 * time.Millisecond, Secret: testSecret}, func(command []byte) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.applied = append(r.applied, string(command))
+		}, r.communicator, testLogger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.node = node
+		t.Cleanup(r.communicator.Close)
+		replicas = append(replicas, r)
+		byID[r.id] = r
+	}
+	for _, r := range replicas {
+		go r.communicator.Listen(func(message communication.Message) {
+			if sender, ok := byID[senderOf(message)]; ok && !r.down.Load() && !sender.down.Load() {
+				r.node.Handle(message)
+			}
+		})
+	}
+	return replicas
+}
+
+// eventually fails the test unless condition holds within a few seconds
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// leaderOf returns the only replica among replicas that leads and that the
+// others follow, or nil while there is none
+func leaderOf(replicas []*replica) *replica {
+	var leader *replica
+	for _, r := range replicas {
+		if r.node.IsLeader() {
+			if leader != nil {
+				return nil
+			}
+			leader = r
+		}
+	}
+	if leader == nil {
+		return nil
+	}
+	for _, r := range replicas {
+		if known, ok := r.node.Leader(); !ok || known.ID != leader.id {
+			return nil
+		}
+	}
+	return leader
+}
+
+func TestClusterElectsOneLeader(t *testing.T) {
+	replicas := startCluster(t, 3)
+	eventually(t, "a leader", func() bool { return leaderOf(replicas) != nil })
+}
+
+func TestClusterReplicatesCommands(t *testing.T) {
+	replicas := startCluster(t, 3)
+	var leader *replica
+	eventually(t, "a leader", func() bool {
+		leader = leaderOf(replicas)
+		return leader != nil
+	})
+
+	commands := []string{"join n5", "join n66", "leave n5"}
+	for _, command := range commands {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := leader.node.Propose(ctx, []byte(command))
+		cancel()
+		if err != nil {
+			t.Fatalf("Propose(%q): %v", command, err)
+		}
+	}
+	for _, r := range replicas {
+		eventually(t, r.id+" to apply every command", func() bool {
+			return slices.Equal(r.appliedCommands(), commands)
+		})
+		if r != leader {
+			if err := r.node.Propose(context.Background(), []byte("join n30")); !errors.Is(err, ErrNotLeader) {
+				t.Errorf("Propose on follower %s: err = %v, want %v", r.id, err, ErrNotLeader)
+			}
+		}
+	}
+}
+
+func TestClusterReelectsWhenLeaderFails(t *testing.T) {
+	replicas := startCluster(t, 3)
+	var leader *replica
+	eventually(t, "a leader", func() bool {
+		leader = leaderOf(replicas)
+		return leader != nil
+	})
+	leader.down.Store(true)
+
+	rest := slices.DeleteFunc(slices.Clone(replicas), func(r *replica) bool { return r == leader })
+	var next *replica
+	eventually(t, "a new leader", func() bool {
+		next = leaderOf(rest)
+		return next != nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := next.node.Propose(ctx, []byte("join n5")); err != nil {
+		t.Fatalf("Propose with one replica down: %v", err)
+	}
+}
+
+// isolatedNode returns the replica b1 of a cluster with b2, which never
+// hears from b2 and does not start elections during a test
+func isolatedNode(t *testing.T, stateDir string) *Node {
+	t.Helper()
+	options := communication.DefaultOptions()
+	options.Connection.IdleTimeout = 0
+	options.Dial.MaxAttempts = 1
+	options.Logger = testLogger
+	communicator := communication.NewTcpCommunicator("b1", "127.0.0.1:0", "127.0.0.1:0", options)
+	t.Cleanup(communicator.Close)
+	node, err := NewNode("b1", Options{
+		Replicas:        []communication.NodeInfo{{ID: "b1", Address: freeAddress(t)}, {ID: "b2", Address: freeAddress(t)}},
+		StateDir:        stateDir,
+		ElectionTimeout: time.Hour,
+		Secret:          testSecret,
+	}, func([]byte) {}, communicator, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+// appendMessage returns an APPEND_ENTRIES from b2 as decoded off the wire
+func appendMessage(t *testing.T, request communication.AppendEntriesMessage, secret []byte) communication.Message {
+	t.Helper()
+	if len(secret) > 0 {
+		frame, err := communication.GetAppendEntriesMessage(request.Term, request.LeaderID, request.PrevLogIndex, request.PrevLogTerm, request.Entries, request.LeaderCommit, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The MAC is the last field: a u16 length and 32 bytes
+		request.MAC = frame[len(frame)-32:]
+	}
+	return communication.Message{Header: communication.MessageHeader{Type: communication.APPEND_ENTRIES}, Payload: &request}
+}
+
+func termAndLeader(n *Node) (uint64, string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.currentTerm, n.leaderID
+}
+
+func TestHandleIgnoresUnauthenticatedMessages(t *testing.T) {
+	heartbeat := communication.AppendEntriesMessage{Term: 5, LeaderID: "b2"}
+	tests := []struct {
+		name    string
+		message func(t *testing.T) communication.Message
+	}{
+		{"unsigned", func(t *testing.T) communication.Message { return appendMessage(t, heartbeat, nil) }},
+		{"wrong secret", func(t *testing.T) communication.Message { return appendMessage(t, heartbeat, []byte("guess")) }},
+		{"not a replica", func(t *testing.T) communication.Message {
+			outsider := heartbeat
+			outsider.LeaderID = "b9"
+			return appendMessage(t, outsider, testSecret)
+		}},
+		{"certificate of another replica", func(t *testing.T) communication.Message {
+			message := appendMessage(t, heartbeat, nil)
+			message.Sender = "b1"
+			return message
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := isolatedNode(t, "")
+			node.Handle(test.message(t))
+			if term, leader := termAndLeader(node); term != 0 || leader != "" {
+				t.Errorf("followed %q in term %d", leader, term)
+			}
+		})
+	}
+
+	t.Run("signed", func(t *testing.T) {
+		node := isolatedNode(t, "")
+		node.Handle(appendMessage(t, heartbeat, testSecret))
+		if term, leader := termAndLeader(node); term != 5 || leader != "b2" {
+			t.Errorf("followed %q in term %d, want b2 in term 5", leader, term)
+		}
+	})
+	t.Run("certificate", func(t *testing.T) {
+		node := isolatedNode(t, "")
+		message := appendMessage(t, heartbeat, nil)
+		message.Sender = "b2"
+		node.Handle(message)
+		if term, leader := termAndLeader(node); term != 5 || leader != "b2" {
+			t.Errorf("followed %q in term %d, want b2 in term 5", leader, term)
+		}
+	})
+}
+
+// logTerms returns the term of every entry in the node's log
+func logTerms(n *Node) []uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var terms []uint64
+	for _, e := range n.log[1:] {
+		terms = append(terms, e.Term)
+	}
+	return terms
+}
+
+// appendEntries runs n.appendEntries as a follower receiving request would
+func appendEntries(n *Node, request *communication.AppendEntriesMessage) (bool, uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.appendEntries(request)
+}
+
+func entries(terms ...uint64) []communication.LogEntry {
+	var log []communication.LogEntry
+	for _, term := range terms {
+		log = append(log, communication.LogEntry{Term: term, Command: []byte(fmt.Sprintf("in term %d", term))})
+	}
+	return log
+}
+
+func TestAppendEntries(t *testing.T) {
+	node := isolatedNode(t, "")
+	steps := []struct {
+		name       string
+		request    communication.AppendEntriesMessage
+		success    bool
+		matchIndex uint64
+		log        []uint64
+	}{
+		{"first entries", communication.AppendEntriesMessage{Term: 1, LeaderID: "b2", Entries: entries(1, 1)}, true, 2, []uint64{1, 1}},
+		{"repeated", communication.AppendEntriesMessage{Term: 1, LeaderID: "b2", Entries: entries(1, 1)}, true, 2, []uint64{1, 1}},
+		{"gap", communication.AppendEntriesMessage{Term: 1, LeaderID: "b2", PrevLogIndex: 4, PrevLogTerm: 1, Entries: entries(1)}, false, 2, []uint64{1, 1}},
+		{"wrong previous term", communication.AppendEntriesMessage{Term: 2, LeaderID: "b2", PrevLogIndex: 2, PrevLogTerm: 2, Entries: entries(2)}, false, 1, []uint64{1, 1}},
+		{"conflict", communication.AppendEntriesMessage{Term: 3, LeaderID: "b2", PrevLogIndex: 1, PrevLogTerm: 1, Entries: entries(3, 3)}, true, 3, []uint64{1, 3, 3}},
+		{"stale leader", communication.AppendEntriesMessage{Term: 2, LeaderID: "b2", PrevLogIndex: 3, PrevLogTerm: 3, Entries: entries(2)}, false, 0, []uint64{1, 3, 3}},
+	}
+	for _, step := range steps {
+		success, matchIndex, err := appendEntries(node, &step.request)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if success != step.success || matchIndex != step.matchIndex {
+			t.Errorf("%s: answered %v, %d, want %v, %d", step.name, success, matchIndex, step.success, step.matchIndex)
+		}
+		if log := logTerms(node); !slices.Equal(log, step.log) {
+			t.Errorf("%s: log terms %v, want %v", step.name, log, step.log)
+		}
+	}
+}
+
+func TestNodeRestoresStateFromDisk(t *testing.T) {
+	dir := t.TempDir()
+	node := isolatedNode(t, dir)
+	if _, _, err := appendEntries(node, &communication.AppendEntriesMessage{Term: 2, LeaderID: "b2", Entries: entries(1, 2)}); err != nil {
+		t.Fatal(err)
+	}
+	// Overwriting part of the log rewrites the file
+	if _, _, err := appendEntries(node, &communication.AppendEntriesMessage{Term: 3, LeaderID: "b2", PrevLogIndex: 1, PrevLogTerm: 1, Entries: entries(3)}); err != nil {
+		t.Fatal(err)
+	}
+	node.mu.Lock()
+	node.votedFor = "b2"
+	err := node.persistState()
+	node.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := isolatedNode(t, dir)
+	if log := logTerms(restarted); !slices.Equal(log, []uint64{1, 3}) {
+		t.Errorf("restored log terms %v, want [1 3]", log)
+	}
+	restarted.mu.Lock()
+	defer restarted.mu.Unlock()
+	if restarted.currentTerm != 3 || restarted.votedFor != "b2" {
+		t.Errorf("restored term %d and vote %q, want 3 and b2", restarted.currentTerm, restarted.votedFor)
+	}
+}
+
+func TestAppendEntriesStepsDownWhenLogCannotBePersisted(t *testing.T) {
+	node := isolatedNode(t, t.TempDir())
+	if _, _, err := appendEntries(node, &communication.AppendEntriesMessage{Term: 1, LeaderID: "b2", Entries: entries(1)}); err != nil {
+		t.Fatal(err)
+	}
+	node.storage.log.Close()
+
+	node.Handle(appendMessage(t, communication.AppendEntriesMessage{Term: 1, LeaderID: "b2", PrevLogIndex: 1, PrevLogTerm: 1, Entries: entries(1)}, testSecret))
+	if log := logTerms(node); !slices.Equal(log, []uint64{1}) {
+		t.Errorf("log terms %v after a failed write, want [1]", log)
+	}
+	if _, leader := termAndLeader(node); leader != "" {
+		t.Errorf("still following %q after a failed write", leader)
+	}
+}
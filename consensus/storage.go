@@ -0,0 +1,159 @@
+package consensus
+
+import (
+	"bufio"
+	"dht/util"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	stateFile = "raft.state"
+	logFile   = "raft.log"
+)
+
+// hardState is what a replica must remember across restarts besides its log
+type hardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for,omitempty"`
+}
+
+// storage keeps the term, vote and log of a replica on disk. The log is a
+// file of JSON lines, one per entry. A nil *storage keeps nothing.
+type storage struct {
+	dir string
+	log *os.File
+}
+
+// openStorage opens or creates the replica state in dir and returns what it holds.
+func openStorage(dir string) (*storage, hardState, []entry, error) {
+	var state hardState
+	if dir == "" {
+		return nil, state, nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, state, nil, err
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, state, nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, &state); err != nil {
+			return nil, state, nil, err
+		}
+	}
+
+	logPath := filepath.Join(dir, logFile)
+	entries, validSize, err := readLog(logPath)
+	if err != nil {
+		return nil, state, nil, err
+	}
+	file, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, state, nil, err
+	}
+	// Drop an entry torn by a crash mid-write, it was never acknowledged
+	if err := file.Truncate(validSize); err != nil {
+		file.Close()
+		return nil, state, nil, err
+	}
+	if _, err := file.Seek(validSize, 0); err != nil {
+		file.Close()
+		return nil, state, nil, err
+	}
+
+	return &storage{dir: dir, log: file}, state, entries, nil
+}
+
+// readLog returns the complete entries in the log file and the byte size they take up.
+func readLog(path string) ([]entry, int64, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var entries []entry
+	var size int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		var e entry
+		if json.Unmarshal(line, &e) != nil {
+			break
+		}
+		entries = append(entries, e)
+		size += int64(len(line))
+	}
+	return entries, size, nil
+}
+
+// saveState atomically replaces the stored term and vote
+func (s *storage) saveState(state hardState) error {
+	if s == nil {
+		return nil
+	}
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(filepath.Join(s.dir, stateFile), content)
+}
+
+// append adds entries to the end of the log and syncs them
+func (s *storage) append(entries []entry) error {
+	if s == nil {
+		return nil
+	}
+	var content []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		content = append(append(content, line...), '\n')
+	}
+	if _, err := s.log.Write(content); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// rewrite replaces the whole log, for when a leader overwrote part of it
+func (s *storage) rewrite(entries []entry) error {
+	if s == nil {
+		return nil
+	}
+	var content []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		content = append(append(content, line...), '\n')
+	}
+	logPath := filepath.Join(s.dir, logFile)
+	if err := util.WriteFileAtomic(logPath, content); err != nil {
+		return err
+	}
+
+	// Continue appending to the new file
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.log.Close()
+	s.log = file
+	return nil
+}
@@ -1,35 +1,127 @@
 package main
 
 import (
+	"context"
 	"dht/bootstrap"
 	"dht/client"
 	"dht/communication"
+	"dht/consensus"
+	"dht/membership"
+	"dht/metrics"
 	"dht/peer"
 	"dht/util"
 	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 func main() {
-	bootstrapName, objectFile, delay, testcase := util.ParseFlags()
-	me, _ := os.Hostname()
+	config := util.ParseFlags()
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	logger := config.Logger(os.Stderr)
+	slog.SetDefault(logger)
+	me := config.ID
+	testcase := config.Testcase
 
 	// Wait and block for the initial delay before proceeding with anything
-	time.Sleep(time.Duration(delay) * time.Second)
+	time.Sleep(time.Duration(config.Delay * float64(time.Second)))
+
+	if config.TLSCert != "" || config.TLSKey != "" || config.TLSCA != "" {
+		tlsConfig, err := communication.LoadTLSConfig(config.TLSCert, config.TLSKey, config.TLSCA, me)
+		if err != nil {
+			fatal(logger, "Failed to set up TLS", "err", err)
+		}
+		config.Network.TLS = tlsConfig
+	}
+
+	joinSecret, err := config.JoinSecret()
+	if err != nil {
+		fatal(logger, "Failed to read join secret", "err", err)
+	}
+	apiKeySecret, err := config.APIKeySecret()
+	if err != nil {
+		fatal(logger, "Failed to read API key", "err", err)
+	}
+	var accessPolicy *peer.AccessPolicy
+	if config.AccessPolicyFile != "" {
+		if accessPolicy, err = peer.LoadAccessPolicy(config.AccessPolicyFile); err != nil {
+			fatal(logger, "Failed to load access policy", "err", err)
+		}
+	}
 
-	communicator := communication.NewTcpCommunicator(me)
-	incomingMessagesCh := make(chan communication.Message)
-	go communicator.Listen(incomingMessagesCh)
+	config.Network.Logger = logger
+	communicator := communication.NewTcpCommunicator(me, config.ListenAddress, config.AdvertiseAddress, config.Network)
+	// Messages wait at the dispatcher until every handler is registered
+	dispatcher := communication.NewDispatcher(config.Dispatch, logger)
+	go communicator.Listen(dispatcher.Dispatch)
+
+	var metricsServer *http.Server
+	if config.MetricsAddress != "" {
+		metricsServer = &http.Server{Addr: config.MetricsAddress, Handler: metrics.Handler()}
+		go func() {
+			// Metrics are for watching the node, it keeps working without them
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("Failed to serve metrics", "address", config.MetricsAddress, "err", err)
+			}
+		}()
+	}
 
 	var bootstrapObject *bootstrap.Bootstrap
 	var clientObject *client.Client
 	var peerObject *peer.Peer
+	var members *membership.Memberlist
 
-	if me == "bootstrap" {
-		bootstrapObject = bootstrap.NewBootstrap(communicator)
-	} else if me == "client" {
-		clientObject = client.NewClient(testcase-2, bootstrapName, communicator)
+	if config.IsBootstrap() {
+		replicas, err := config.ReplicaSet()
+		if err != nil {
+			fatal(logger, "Invalid replica list", "err", err)
+		}
+		if len(replicas) > 0 {
+			replicaSecret, err := config.ReplicaSecret()
+			if err != nil {
+				fatal(logger, "Failed to read replica secret", "err", err)
+			}
+			// The replicated log is the durable record, the replicas keep it in the state directory
+			bootstrapObject = bootstrap.NewBootstrap(communicator, joinSecret, config.JoinMaxSkew, nil, logger)
+			err = bootstrapObject.Replicate(me, consensus.Options{
+				Replicas:        replicas,
+				StateDir:        config.StateDir,
+				ElectionTimeout: config.ElectionTimeout,
+				Secret:          replicaSecret,
+			})
+			if err != nil {
+				fatal(logger, "Failed to start replica", "err", err)
+			}
+		} else {
+			var ringLog *bootstrap.RingLog
+			if config.StateDir != "" {
+				ringLog, err = bootstrap.OpenRingLog(config.StateDir)
+				if err != nil {
+					fatal(logger, "Failed to open ring state", "err", err)
+				}
+			}
+			bootstrapObject = bootstrap.NewBootstrap(communicator, joinSecret, config.JoinMaxSkew, ringLog, logger)
+			// Drop peers that died while the bootstrap was down and relink the rest
+			go bootstrapObject.VerifyPeers(config.PeerProbeTimeout)
+		}
+	} else if config.IsClient() {
+		clientObject = client.NewClient(testcase-2, config.BootstrapAddresses, config.EntryPeers, config.APIKeyID, apiKeySecret, communicator, logger)
+		if config.RouteCache {
+			clientObject.CacheRoutes()
+		}
+		if config.Trace {
+			clientObject.TraceRequests()
+		}
+		if config.Lookup == "iterative" {
+			clientObject.UseIterativeLookup()
+		}
 		if testcase == 3 {
 			go clientObject.RequestStore(65) // 65 being the objectID
 		} else if testcase == 4 {
@@ -38,76 +130,282 @@ func main() {
 			go clientObject.RequestRetrieve(110) // 110 not being in the ring
 		}
 	} else {
-		peerObject = peer.NewPeer(me, objectFile, bootstrapName, communicator)
-		peerObject.JoinNetwork(bootstrapName)
+		var store peer.Store = peer.NewFileStore(config.ObjectFile)
+		if config.StoreEngine == "encrypted" {
+			keys, err := peer.LoadKeyRing(config.StoreKeyFile)
+			if err != nil {
+				fatal(logger, "Failed to load store keys", "err", err)
+			}
+			encryptedStore := peer.NewEncryptedStore(config.ObjectFile, keys)
+			if config.RotateStoreKey {
+				count, err := encryptedStore.Rotate()
+				if err != nil {
+					fatal(logger, "Failed to rotate store key", "err", err)
+				}
+				logger.Info("Re-encrypted stored objects with the active key", "count", count)
+			} else if _, err := encryptedStore.Entries(); err != nil {
+				// Refuse to start on a store that still needs migrating, or that the keys can't read
+				fatal(logger, "Failed to read encrypted store", "err", err)
+			}
+			store = encryptedStore
+		}
+		peerObject = peer.NewPeer(me, store, config.BootstrapAddresses, joinSecret, config.JoinMaxSkew, accessPolicy, communicator, logger)
+		peerObject.RecordStoreSize()
+		peerObject.JoinNetwork(config.Seeds)
+		if config.StabilizeInterval > 0 {
+			go peerObject.Stabilize(config.StabilizeInterval)
+		}
+		if config.GossipInterval > 0 {
+			gossipOptions := membership.DefaultOptions(config.GossipInterval)
+			gossipOptions.Secret = joinSecret
+			members = membership.New(communication.NodeInfo{ID: me, Address: peerObject.Address}, gossipOptions, communicator, logger)
+			members.Join(config.Seeds)
+			go members.Run()
+			peerObject.UseMembership(members)
+		}
 	}
 
-	for message := range incomingMessagesCh {
-		switch message.Header.Type {
-		case communication.JOIN:
-			if payload, ok := message.Payload.(*communication.JoinMessage); ok {
-				go bootstrapObject.RegisterPeer(payload.PeerID)
-			}
-		case communication.RING:
-			if payload, ok := message.Payload.(*communication.RingInformation); ok {
-				peerObject.UpdateLinks(payload.Predecessor, payload.Successor)
-			}
-		case communication.REQUEST:
-			if payload, ok := message.Payload.(*communication.RequestMessage); ok {
-				if me == "bootstrap" {
-					// Forward the request to the initial peer
-					requestMessage, err := communication.GetRequestMessage(payload.ReqID, payload.OperationType, payload.ObjectID, payload.ClientID)
-					if err != nil {
-						fmt.Println("Error encoding request message:", err)
-					} else {
-						go communicator.SendMessage(bootstrapObject.GetFirstPeer(), requestMessage)
-					}
-				} else {
-					// check the operation type and perform the operation
-					if payload.OperationType == communication.STORE {
-						peerObject.StoreObject(payload.ReqID, payload.ClientID, payload.ObjectID)
-					} else if payload.OperationType == communication.RETRIEVE {
-						peerObject.RetrieveObject(payload.ReqID, payload.ClientID, payload.ObjectID)
-					} else {
-						fmt.Println("Invalid operation type")
-					}
+	dispatcher.Handle(communication.JOIN, func(ctx context.Context, message communication.Message) {
+		if payload, ok := message.Payload.(*communication.JoinMessage); ok {
+			if bootstrapObject != nil {
+				bootstrapObject.HandleJoin(ctx, payload)
+			} else if peerObject != nil {
+				// Joining through this peer as a seed
+				peerObject.HandleJoin(ctx, payload)
+			}
+		}
+	})
+	dispatcher.Handle(communication.JOIN_REJECTED, func(ctx context.Context, message communication.Message) {
+		if payload, ok := message.Payload.(*communication.JoinRejectedMessage); ok && peerObject != nil {
+			peerObject.HandleJoinRejected(payload)
+		}
+	})
+	for _, messageType := range []communication.MessageType{communication.VOTE_REQUEST, communication.VOTE_RESPONSE, communication.APPEND_ENTRIES, communication.APPEND_RESPONSE} {
+		dispatcher.Handle(messageType, func(ctx context.Context, message communication.Message) {
+			if bootstrapObject != nil {
+				bootstrapObject.HandleConsensus(message)
+			}
+		})
+	}
+	dispatcher.HandleInOrder(communication.RING, func(ctx context.Context, message communication.Message) {
+		if payload, ok := message.Payload.(*communication.RingInformation); ok && peerObject != nil {
+			peerObject.UpdateLinks(payload.Predecessor, payload.Successor)
+			if members != nil {
+				// Ring neighbors are the first members a peer gossips with
+				members.Introduce(payload.Predecessor, payload.Successor)
+			}
+		}
+	})
+	dispatcher.Handle(communication.STABILIZE, func(ctx context.Context, message communication.Message) {
+		if payload, ok := message.Payload.(*communication.StabilizeMessage); ok && peerObject != nil {
+			peerObject.HandleStabilize(ctx, payload)
+		}
+	})
+	dispatcher.Handle(communication.STABILIZE_REPLY, func(ctx context.Context, message communication.Message) {
+		if payload, ok := message.Payload.(*communication.StabilizeReplyMessage); ok && peerObject != nil {
+			peerObject.HandleStabilizeReply(ctx, payload)
+		}
+	})
+	dispatcher.HandleInOrder(communication.LEAVE, func(ctx context.Context, message communication.Message) {
+		if payload, ok := message.Payload.(*communication.LeaveMessage); ok {
+			if bootstrapObject != nil {
+				bootstrapObject.HandleLeave(ctx, payload)
+			} else if peerObject != nil {
+				peerObject.HandleLeave(payload)
+			}
+		}
+	})
+	dispatcher.HandleInOrder(communication.NOTIFY, func(ctx context.Context, message communication.Message) {
+		if payload, ok := message.Payload.(*communication.NotifyMessage); ok && peerObject != nil {
+			peerObject.HandleNotify(payload)
+		}
+	})
+	for _, messageType := range []communication.MessageType{communication.PING, communication.PING_REQ, communication.ACK, communication.SYNC} {
+		dispatcher.Handle(messageType, func(ctx context.Context, message communication.Message) {
+			if members != nil {
+				members.Handle(message)
+			}
+		})
+	}
+	dispatcher.Handle(communication.LAYOUT_REQUEST, func(ctx context.Context, message communication.Message) {
+		if payload, ok := message.Payload.(*communication.LayoutRequestMessage); ok {
+			var layout []communication.NodeInfo
+			if bootstrapObject != nil {
+				layout = bootstrapObject.Peers()
+			} else if members != nil {
+				// The gossiped membership covers the whole ring
+				for _, member := range members.Members() {
+					layout = append(layout, member.Node)
 				}
+			} else if peerObject != nil {
+				layout = peerObject.Layout()
+			}
+			layoutMessage, err := communication.GetLayoutMessage(layout)
+			if err != nil {
+				logger.Error("Failed to encode message", "msg_type", communication.LAYOUT, "err", err)
+			} else {
+				communicator.Responder(message, payload.ReplyTo)(ctx, layoutMessage)
+			}
+		}
+	})
+	dispatcher.Handle(communication.WRONG_OWNER, func(ctx context.Context, message communication.Message) {
+		if payload, ok := message.Payload.(*communication.WrongOwnerMessage); ok && clientObject != nil {
+			clientObject.HandleWrongOwner(ctx, payload)
+		}
+	})
+	dispatcher.Handle(communication.NEXT_HOP_REQUEST, func(ctx context.Context, message communication.Message) {
+		if payload, ok := message.Payload.(*communication.NextHopRequestMessage); ok {
+			respond := communicator.Responder(message, payload.ReplyTo)
+			if bootstrapObject != nil {
+				bootstrapObject.HandleNextHopRequest(ctx, payload, respond)
+			} else if peerObject != nil {
+				peerObject.HandleNextHopRequest(ctx, payload, respond)
+			}
+		}
+	})
+	dispatcher.Handle(communication.FIND_SUCCESSOR, func(ctx context.Context, message communication.Message) {
+		if payload, ok := message.Payload.(*communication.FindSuccessorMessage); ok {
+			respond := communicator.Responder(message, payload.ReplyTo)
+			if bootstrapObject != nil {
+				bootstrapObject.HandleFindSuccessor(ctx, payload, respond)
+			} else if peerObject != nil {
+				peerObject.HandleFindSuccessor(ctx, payload, respond)
 			}
-		case communication.OBJ_STORED:
-			if payload, ok := message.Payload.(*communication.ObjectStoredMessage); ok {
-				if me == "bootstrap" {
-					// Send the response back to the client
-					responseMessage, err := communication.GetObjectStoredMessage(payload.PeerId, payload.ObjectID, payload.ClientID)
-					if err != nil {
-						fmt.Println("Error encoding response message:", err)
-					} else {
-						go communicator.SendMessage("client", responseMessage)
-					}
+		}
+	})
+	dispatcher.Handle(communication.GET_PREDECESSOR, func(ctx context.Context, message communication.Message) {
+		if payload, ok := message.Payload.(*communication.PredecessorRequestMessage); ok && peerObject != nil {
+			peerObject.HandleGetPredecessor(ctx, payload, communicator.Responder(message, payload.ReplyTo))
+		}
+	})
+	dispatcher.Handle(communication.REQUEST, func(ctx context.Context, message communication.Message) {
+		if payload, ok := message.Payload.(*communication.RequestMessage); ok {
+			if config.IsBootstrap() {
+				// Hand the request to the next peer in turn, which routes it to the owner
+				entry, ok := bootstrapObject.NextEntryPeer()
+				payload.AddHop(me)
+				requestMessage, err := communication.EncodeRequestMessage(payload)
+				if !ok {
+					logger.Warn("No peers to forward request to", "req_id", payload.ReqID)
+				} else if err != nil {
+					logger.Error("Failed to encode message", "msg_type", communication.REQUEST, "req_id", payload.ReqID, "err", err)
+				} else if err := communicator.SendMessage(ctx, entry.Address, requestMessage); err != nil {
+					logger.Warn("Failed to forward request", "req_id", payload.ReqID, "peer", entry.ID, "err", err)
+				}
+			} else if peerObject != nil {
+				// check the operation type and perform the operation
+				if payload.OperationType == communication.STORE {
+					peerObject.StoreObject(ctx, payload)
+				} else if payload.OperationType == communication.RETRIEVE {
+					peerObject.RetrieveObject(ctx, payload)
 				} else {
-					// print the message
-					fmt.Println("STORED: ", payload.ObjectID)
+					logger.Warn("Invalid operation type", "req_id", payload.ReqID, "operation", payload.OperationType)
+				}
+			}
+		}
+	})
+	dispatcher.Handle(communication.OBJ_STORED, func(ctx context.Context, message communication.Message) {
+		if payload, ok := message.Payload.(*communication.ObjectStoredMessage); ok {
+			if config.IsBootstrap() {
+				// Send the response back to the client
+				responseMessage, err := communication.GetObjectStoredMessage(payload.Status, payload.PeerId, payload.ObjectID, payload.ClientID, payload.ReplyTo, payload.Trace)
+				if err != nil {
+					logger.Error("Failed to encode message", "msg_type", message.Header.Type, "err", err)
+				} else if err := communicator.SendMessage(ctx, payload.ReplyTo, responseMessage); err != nil {
+					logger.Warn("Failed to relay result to client", "msg_type", message.Header.Type, "peer", payload.PeerId, "client_id", payload.ClientID, "address", payload.ReplyTo, "err", err)
 				}
+			} else if payload.Status == communication.STATUS_PERMISSION_DENIED {
+				fmt.Println("PERMISSION DENIED: ", payload.ObjectID)
+			} else if payload.Status == communication.STATUS_BUSY {
+				fmt.Println("BUSY: ", payload.ObjectID)
+			} else {
+				// print the message
+				fmt.Println("STORED: ", payload.ObjectID)
 			}
-		case communication.OBJ_RETRIEVED:
-			if payload, ok := message.Payload.(*communication.ObjectRetrievedMessage); ok {
-				if me == "bootstrap" {
-					// Send the response back to the client
-					responseMessage, err := communication.GetObjectRetrievedMessage(payload.Status, payload.ObjectId)
-					if err != nil {
-						fmt.Println("Error encoding response message:", err)
-					} else {
-						go communicator.SendMessage("client", responseMessage)
-					}
+			if !config.IsBootstrap() && len(payload.Trace) > 0 {
+				fmt.Print(client.FormatTrace(payload.Trace))
+			}
+		}
+	})
+	dispatcher.Handle(communication.OBJ_RETRIEVED, func(ctx context.Context, message communication.Message) {
+		if payload, ok := message.Payload.(*communication.ObjectRetrievedMessage); ok {
+			if config.IsBootstrap() {
+				// Send the response back to the client
+				responseMessage, err := communication.GetObjectRetrievedMessage(payload.Status, payload.ObjectId, payload.ReplyTo, payload.Trace)
+				if err != nil {
+					logger.Error("Failed to encode message", "msg_type", message.Header.Type, "err", err)
+				} else if err := communicator.SendMessage(ctx, payload.ReplyTo, responseMessage); err != nil {
+					logger.Warn("Failed to relay result to client", "msg_type", message.Header.Type, "object_id", payload.ObjectId, "address", payload.ReplyTo, "err", err)
+				}
+			} else {
+				if payload.Status == communication.STATUS_NOT_FOUND {
+					fmt.Println("NOT FOUND: ", payload.ObjectId)
+				} else if payload.Status == communication.STATUS_PERMISSION_DENIED {
+					fmt.Println("PERMISSION DENIED: ", payload.ObjectId)
+				} else if payload.Status == communication.STATUS_BUSY {
+					fmt.Println("BUSY: ", payload.ObjectId)
 				} else {
-					if payload.Status == -1 {
-						fmt.Println("NOT FOUND: ", payload.ObjectId)
-					} else {
-						fmt.Println("RETRIEVED: ", payload.ObjectId)
-					}
+					fmt.Println("RETRIEVED: ", payload.ObjectId)
+				}
+				if len(payload.Trace) > 0 {
+					fmt.Print(client.FormatTrace(payload.Trace))
 				}
 			}
 		}
+	})
+	dispatcher.OnReject(func(ctx context.Context, message communication.Message) {
+		// Tell clients straight away rather than leave them waiting for a result
+		if payload, ok := message.Payload.(*communication.RequestMessage); ok {
+			var busyMessage []byte
+			var err error
+			if payload.OperationType == communication.STORE {
+				busyMessage, err = communication.GetObjectStoredMessage(communication.STATUS_BUSY, me, payload.ObjectID, payload.ClientID, payload.ReplyTo, payload.Trace)
+			} else {
+				busyMessage, err = communication.GetObjectRetrievedMessage(communication.STATUS_BUSY, payload.ObjectID, payload.ReplyTo, payload.Trace)
+			}
+			if err != nil {
+				logger.Error("Failed to encode busy reply", "req_id", payload.ReqID, "err", err)
+			} else {
+				communicator.SendMessage(ctx, payload.ReplyTo, busyMessage)
+			}
+		} else {
+			logger.Warn("Too busy, dropping message", "msg_type", message.Header.Type)
+		}
+	})
+	dispatcher.Start()
+
+	// Run until asked to stop, then wind down within the shutdown timeout
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	<-ctx.Done()
+	stop() // A second signal ends the process straight away
+	logger.Info("Shutting down", "timeout", config.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	communicator.StopListening()
+	if err := dispatcher.Stop(shutdownCtx); err != nil {
+		logger.Warn("Gave up waiting for in-flight messages", "err", err)
+	}
+	if peerObject != nil {
+		if members != nil {
+			members.Leave()
+		}
+		if err := peerObject.Leave(shutdownCtx); err != nil {
+			logger.Warn("Failed to leave the ring cleanly", "err", err)
+		}
+		if err := peerObject.Flush(); err != nil {
+			logger.Error("Failed to flush stored objects", "err", err)
+		}
 	}
+	if bootstrapObject != nil {
+		if err := bootstrapObject.Close(); err != nil {
+			logger.Error("Failed to close ring state", "err", err)
+		}
+	}
+	if metricsServer != nil {
+		metricsServer.Shutdown(shutdownCtx)
+	}
+	communicator.Close()
 	// // Bootstrap
 	// - The first one to start and Talks to both Peer and Client
 	// - The first peer to join becomes point of contact for further actions
@@ -127,3 +425,9 @@ func main() {
 	// // Client
 	// - Sends a REQUEST message to the bootstrap server
 }
+
+// fatal logs an error the node cannot run with and exits
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
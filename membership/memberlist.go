@@ -0,0 +1,480 @@
+// Package membership keeps an eventually consistent list of the peers in
+// the ring with the SWIM gossip protocol. Each node probes one member per
+// round, asks others to probe it indirectly when it does not answer, and
+// piggybacks join, leave, suspect and dead news on its probe traffic.
+package membership
+
+import (
+	"context"
+	"dht/communication"
+	"log/slog"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Options tunes the gossip protocol.
+type Options struct {
+	ProbeInterval    time.Duration // Time between two probes
+	ProbeTimeout     time.Duration // Time a direct ping has to be answered before indirect probes start
+	IndirectProbes   int           // Members asked to probe an unresponsive member
+	SuspicionTimeout time.Duration // Time a suspect member has to refute before it is declared dead
+	RetransmitMult   int           // Each update is piggybacked this many times the log of the cluster size
+	MaxPiggyback     int           // Most updates carried by one message
+	Secret           []byte        // Join secret gossip is signed with, nil to accept it from anyone
+}
+
+// DefaultOptions returns gossip settings derived from the probe interval.
+func DefaultOptions(probeInterval time.Duration) Options {
+	return Options{
+		ProbeInterval:    probeInterval,
+		ProbeTimeout:     probeInterval / 2,
+		IndirectProbes:   3,
+		SuspicionTimeout: 5 * probeInterval,
+		RetransmitMult:   3,
+		MaxPiggyback:     8,
+	}
+}
+
+// Member is one node as seen by the local membership list.
+type Member struct {
+	Node        communication.NodeInfo
+	State       communication.MemberState
+	Incarnation uint64
+}
+
+// broadcast is an update waiting to be piggybacked
+type broadcast struct {
+	update    communication.MemberUpdate
+	transmits int
+}
+
+// relay remembers a PING_REQ this node is probing for
+type relay struct {
+	requester communication.NodeInfo
+	seq       uint64
+}
+
+// Memberlist is the local view of the membership and runs the protocol.
+type Memberlist struct {
+	self         communication.NodeInfo
+	options      Options
+	communicator *communication.TcpCommunicator
+	logger       *slog.Logger
+
+	mu          sync.Mutex
+	incarnation uint64
+	left        bool
+	members     map[string]*Member
+	broadcasts  map[string]*broadcast    // Pending updates, at most one per member
+	acks        map[uint64]chan struct{} // Probes of this node waiting for an ACK
+	relays      map[uint64]relay         // Pings sent on behalf of a PING_REQ
+	probeOrder  []string                 // Members left to probe in this round
+	suspicions  map[string]*time.Timer   // Suspect members and when they will be declared dead
+	seq         atomic.Uint64
+}
+
+// New creates the membership list for self. It holds only self until Join
+// or Introduce tell it about other members.
+func New(self communication.NodeInfo, options Options, communicator *communication.TcpCommunicator, logger *slog.Logger) *Memberlist {
+	m := &Memberlist{
+		self:         self,
+		options:      options,
+		communicator: communicator,
+		logger:       logger,
+		members:      make(map[string]*Member),
+		broadcasts:   make(map[string]*broadcast),
+		acks:         make(map[uint64]chan struct{}),
+		relays:       make(map[uint64]relay),
+		suspicions:   make(map[string]*time.Timer),
+	}
+	m.members[self.ID] = &Member{Node: self, State: communication.MemberAlive}
+	return m
+}
+
+// Run probes one member per probe interval until the list is left.
+func (m *Memberlist) Run() {
+	ticker := time.NewTicker(m.options.ProbeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.mu.Lock()
+		left := m.left
+		m.mu.Unlock()
+		if left {
+			return
+		}
+		m.probe()
+	}
+}
+
+// Join exchanges membership lists with the seeds, given as addresses.
+func (m *Memberlist) Join(seeds []string) {
+	message, err := communication.GetSyncMessage(m.self, false, m.snapshot(), m.options.Secret)
+	if err != nil {
+		m.logger.Error("Failed to encode message", "msg_type", communication.SYNC, "err", err)
+		return
+	}
+	for _, seed := range seeds {
+		go m.send(seed, message)
+	}
+}
+
+// Introduce adds nodes learned about elsewhere, such as ring neighbors, and
+// exchanges membership lists with the ones that were unknown.
+func (m *Memberlist) Introduce(nodes ...communication.NodeInfo) {
+	var unknown []string
+	m.mu.Lock()
+	for _, node := range nodes {
+		if node.ID == "" || node.ID == m.self.ID {
+			continue
+		}
+		if _, ok := m.members[node.ID]; !ok {
+			m.apply(communication.MemberUpdate{Node: node, State: communication.MemberAlive})
+			unknown = append(unknown, node.Address)
+		}
+	}
+	m.mu.Unlock()
+	if len(unknown) > 0 {
+		m.Join(unknown)
+	}
+}
+
+// Members returns the members currently believed to be up, this node included, sorted by ID.
+func (m *Memberlist) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := make([]Member, 0, len(m.members))
+	for _, member := range m.members {
+		if member.State == communication.MemberAlive || member.State == communication.MemberSuspect {
+			members = append(members, *member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Node.ID < members[j].Node.ID })
+	return members
+}
+
+// Leave announces that this node is leaving on purpose, so it is not
+// suspected, and stops probing.
+func (m *Memberlist) Leave() {
+	m.mu.Lock()
+	if m.left {
+		m.mu.Unlock()
+		return
+	}
+	m.left = true
+	m.incarnation++
+	update := communication.MemberUpdate{Node: m.self, State: communication.MemberLeft, Incarnation: m.incarnation}
+	m.members[m.self.ID].State = communication.MemberLeft
+	m.members[m.self.ID].Incarnation = m.incarnation
+	targets := m.randomMembers(m.options.IndirectProbes, "")
+	m.mu.Unlock()
+
+	// Nobody probes a node that left, so tell a few members directly
+	message, err := communication.GetPingMessage(m.seq.Add(1), m.self, []communication.MemberUpdate{update}, m.options.Secret)
+	if err != nil {
+		m.logger.Error("Failed to encode message", "msg_type", communication.PING, "err", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			m.send(address, message)
+		}(target.Node.Address)
+	}
+	wg.Wait()
+}
+
+// Handle processes a gossip message from another member, ignoring it unless
+// it is authenticated.
+func (m *Memberlist) Handle(message communication.Message) {
+	if err := m.authenticate(message); err != nil {
+		m.logger.Warn("Ignoring gossip", "msg_type", message.Header.Type, "err", err)
+		return
+	}
+	switch msg := message.Payload.(type) {
+	case *communication.PingMessage:
+		m.merge(msg.From, msg.Updates)
+		m.reply(msg.From.Address, msg.Seq, m.self)
+	case *communication.PingReqMessage:
+		m.merge(msg.From, msg.Updates)
+		m.relayPing(msg)
+	case *communication.AckMessage:
+		m.merge(communication.NodeInfo{}, msg.Updates)
+		m.handleAck(msg)
+	case *communication.SyncMessage:
+		m.merge(msg.From, msg.Members)
+		if !msg.Reply {
+			reply, err := communication.GetSyncMessage(m.self, true, m.snapshot(), m.options.Secret)
+			if err == nil {
+				m.send(msg.From.Address, reply)
+			}
+		}
+	}
+}
+
+// authenticate checks that gossip comes from a member of the ring: over a
+// connection authenticated with a certificate, or signed with the join
+// secret. Without a secret the ring is open and anyone may gossip.
+func (m *Memberlist) authenticate(message communication.Message) error {
+	if message.Sender != "" || len(m.options.Secret) == 0 {
+		return nil
+	}
+	return communication.VerifyGossip(m.options.Secret, message.Payload)
+}
+
+// probe checks the next member directly, then through others, and suspects it if nobody reaches it
+func (m *Memberlist) probe() {
+	target, ok := m.nextTarget()
+	if !ok {
+		return
+	}
+	seq := m.seq.Add(1)
+	acked := make(chan struct{})
+	m.mu.Lock()
+	m.acks[seq] = acked
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.acks, seq)
+		m.mu.Unlock()
+	}()
+
+	if message, err := communication.GetPingMessage(seq, m.self, m.piggyback(), m.options.Secret); err == nil {
+		go m.send(target.Node.Address, message)
+	}
+	select {
+	case <-acked:
+		return
+	case <-time.After(m.options.ProbeTimeout):
+	}
+
+	m.mu.Lock()
+	helpers := m.randomMembers(m.options.IndirectProbes, target.Node.ID)
+	m.mu.Unlock()
+	if message, err := communication.GetPingReqMessage(seq, m.self, target.Node, m.piggyback(), m.options.Secret); err == nil {
+		for _, helper := range helpers {
+			go m.send(helper.Node.Address, message)
+		}
+	}
+	select {
+	case <-acked:
+		return
+	case <-time.After(max(m.options.ProbeInterval-m.options.ProbeTimeout, m.options.ProbeTimeout)):
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if current, ok := m.members[target.Node.ID]; ok && current.State == communication.MemberAlive {
+		m.apply(communication.MemberUpdate{Node: current.Node, State: communication.MemberSuspect, Incarnation: current.Incarnation})
+	}
+}
+
+// nextTarget picks members round-robin in a random order that is reshuffled every round
+func (m *Memberlist) nextTarget() (Member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for attempts := 0; attempts < 2; attempts++ {
+		for len(m.probeOrder) > 0 {
+			id := m.probeOrder[0]
+			m.probeOrder = m.probeOrder[1:]
+			if member, ok := m.members[id]; ok && probeable(member) && id != m.self.ID {
+				return *member, true
+			}
+		}
+		for id, member := range m.members {
+			if id != m.self.ID && probeable(member) {
+				m.probeOrder = append(m.probeOrder, id)
+			}
+		}
+		rand.Shuffle(len(m.probeOrder), func(i, j int) {
+			m.probeOrder[i], m.probeOrder[j] = m.probeOrder[j], m.probeOrder[i]
+		})
+	}
+	return Member{}, false
+}
+
+func probeable(member *Member) bool {
+	return member.State == communication.MemberAlive || member.State == communication.MemberSuspect
+}
+
+// randomMembers returns up to count live members other than this node and exclude. Callers hold m.mu.
+func (m *Memberlist) randomMembers(count int, exclude string) []Member {
+	var candidates []Member
+	for id, member := range m.members {
+		if id != m.self.ID && id != exclude && member.State == communication.MemberAlive {
+			candidates = append(candidates, *member)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	return candidates[:min(count, len(candidates))]
+}
+
+// relayPing pings a target for a PING_REQ and remembers whom to pass the ACK to
+func (m *Memberlist) relayPing(request *communication.PingReqMessage) {
+	seq := m.seq.Add(1)
+	m.mu.Lock()
+	m.relays[seq] = relay{requester: request.From, seq: request.Seq}
+	m.mu.Unlock()
+	time.AfterFunc(m.options.ProbeInterval, func() {
+		m.mu.Lock()
+		delete(m.relays, seq)
+		m.mu.Unlock()
+	})
+
+	if message, err := communication.GetPingMessage(seq, m.self, m.piggyback(), m.options.Secret); err == nil {
+		m.send(request.Target.Address, message)
+	}
+}
+
+func (m *Memberlist) handleAck(ack *communication.AckMessage) {
+	m.mu.Lock()
+	acked, waiting := m.acks[ack.Seq]
+	if waiting {
+		delete(m.acks, ack.Seq)
+	}
+	forward, relayed := m.relays[ack.Seq]
+	if relayed {
+		delete(m.relays, ack.Seq)
+	}
+	m.mu.Unlock()
+
+	if waiting {
+		close(acked)
+	}
+	if relayed {
+		m.reply(forward.requester.Address, forward.seq, ack.From)
+	}
+}
+
+// reply sends an ACK for seq saying that from is alive
+func (m *Memberlist) reply(address string, seq uint64, from communication.NodeInfo) {
+	if message, err := communication.GetAckMessage(seq, from, m.piggyback(), m.options.Secret); err == nil {
+		m.send(address, message)
+	}
+}
+
+// merge applies gossip received from sender, who is evidently up
+func (m *Memberlist) merge(sender communication.NodeInfo, updates []communication.MemberUpdate) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sender.ID != "" {
+		if _, known := m.members[sender.ID]; !known {
+			m.apply(communication.MemberUpdate{Node: sender, State: communication.MemberAlive})
+		}
+	}
+	for _, update := range updates {
+		m.apply(update)
+	}
+}
+
+// apply merges one update into the list and queues it for gossip if it was news. Callers hold m.mu.
+func (m *Memberlist) apply(update communication.MemberUpdate) {
+	if update.Node.ID == m.self.ID {
+		m.refute(update)
+		return
+	}
+
+	current, known := m.members[update.Node.ID]
+	if known && !supersedes(update, current) {
+		return
+	}
+	if !known {
+		current = &Member{}
+		m.members[update.Node.ID] = current
+	}
+	current.Node = update.Node
+	current.State = update.State
+	current.Incarnation = update.Incarnation
+	m.logger.Info("Member state changed", "member", update.Node.ID, "state", update.State, "incarnation", update.Incarnation)
+
+	if timer, ok := m.suspicions[update.Node.ID]; ok {
+		timer.Stop()
+		delete(m.suspicions, update.Node.ID)
+	}
+	if update.State == communication.MemberSuspect {
+		m.suspicions[update.Node.ID] = time.AfterFunc(m.options.SuspicionTimeout, func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if member, ok := m.members[update.Node.ID]; ok && member.State == communication.MemberSuspect && member.Incarnation == update.Incarnation {
+				m.apply(communication.MemberUpdate{Node: member.Node, State: communication.MemberDead, Incarnation: member.Incarnation})
+			}
+		})
+	}
+	m.broadcasts[update.Node.ID] = &broadcast{update: update}
+}
+
+// supersedes reports whether an update is newer than what is known about a member
+func supersedes(update communication.MemberUpdate, current *Member) bool {
+	switch update.State {
+	case communication.MemberAlive:
+		return update.Incarnation > current.Incarnation
+	case communication.MemberSuspect:
+		return update.Incarnation > current.Incarnation ||
+			(update.Incarnation == current.Incarnation && current.State == communication.MemberAlive)
+	default:
+		gone := current.State == communication.MemberDead || current.State == communication.MemberLeft
+		return update.Incarnation > current.Incarnation || (update.Incarnation == current.Incarnation && !gone)
+	}
+}
+
+// refute answers a rumor that this node is suspect or dead by raising its incarnation. Callers hold m.mu.
+func (m *Memberlist) refute(update communication.MemberUpdate) {
+	if m.left || update.State == communication.MemberAlive || update.Incarnation < m.incarnation {
+		return
+	}
+	m.incarnation = update.Incarnation + 1
+	m.members[m.self.ID].Incarnation = m.incarnation
+	m.broadcasts[m.self.ID] = &broadcast{update: communication.MemberUpdate{
+		Node:        m.self,
+		State:       communication.MemberAlive,
+		Incarnation: m.incarnation,
+	}}
+}
+
+// piggyback takes the least gossiped pending updates for an outgoing message
+func (m *Memberlist) piggyback() []communication.MemberUpdate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pending := make([]*broadcast, 0, len(m.broadcasts))
+	for _, b := range m.broadcasts {
+		pending = append(pending, b)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].transmits < pending[j].transmits })
+
+	// Spread each update about log(n) times the multiplier so it reaches everyone with high probability
+	limit := m.options.RetransmitMult * int(math.Ceil(math.Log10(float64(len(m.members)+1))))
+	updates := make([]communication.MemberUpdate, 0, min(len(pending), m.options.MaxPiggyback))
+	for _, b := range pending[:min(len(pending), m.options.MaxPiggyback)] {
+		updates = append(updates, b.update)
+		b.transmits++
+		if b.transmits >= limit {
+			delete(m.broadcasts, b.update.Node.ID)
+		}
+	}
+	return updates
+}
+
+// snapshot returns everything known about every member, for a SYNC
+func (m *Memberlist) snapshot() []communication.MemberUpdate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	updates := make([]communication.MemberUpdate, 0, len(m.members))
+	for _, member := range m.members {
+		updates = append(updates, communication.MemberUpdate{Node: member.Node, State: member.State, Incarnation: member.Incarnation})
+	}
+	return updates
+}
+
+// send delivers a gossip message. Failures are not reported: an unreachable
+// member shows up as a probe that goes unanswered.
+func (m *Memberlist) send(address string, message []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.options.ProbeTimeout)
+	defer cancel()
+	m.communicator.SendMessage(ctx, address, message)
+}
@@ -0,0 +1,205 @@
+package membership
+
+import (
+	"dht/communication"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+var (
+	n5  = communication.NodeInfo{ID: "n5", Address: "n5:8888"}
+	n30 = communication.NodeInfo{ID: "n30", Address: "n30:8888"}
+)
+
+// newTestList returns the list of n5, which never sends anything in these tests
+func newTestList(options Options) *Memberlist {
+	return New(n5, options, nil, discardLogger)
+}
+
+// decode reads an encoded frame back as it arrives from sender
+func decode(t *testing.T, frame []byte, sender string) communication.Message {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write(frame)
+		client.Close()
+	}()
+	message, err := communication.ReadMessage(server, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message.Sender = sender
+	return *message
+}
+
+func update(state communication.MemberState, incarnation uint64) communication.MemberUpdate {
+	return communication.MemberUpdate{Node: n30, State: state, Incarnation: incarnation}
+}
+
+func TestSupersedes(t *testing.T) {
+	alive, suspect := communication.MemberAlive, communication.MemberSuspect
+	dead, left := communication.MemberDead, communication.MemberLeft
+	tests := []struct {
+		name    string
+		current Member
+		update  communication.MemberUpdate
+		want    bool
+	}{
+		{"alive at a higher incarnation", Member{State: suspect, Incarnation: 1}, update(alive, 2), true},
+		{"alive at the same incarnation", Member{State: suspect, Incarnation: 1}, update(alive, 1), false},
+		{"alive after death", Member{State: dead, Incarnation: 1}, update(alive, 1), false},
+		{"suspect of an alive member", Member{State: alive, Incarnation: 1}, update(suspect, 1), true},
+		{"suspect again", Member{State: suspect, Incarnation: 1}, update(suspect, 1), false},
+		{"suspect at an old incarnation", Member{State: alive, Incarnation: 2}, update(suspect, 1), false},
+		{"dead after suspect", Member{State: suspect, Incarnation: 1}, update(dead, 1), true},
+		{"dead of an alive member", Member{State: alive, Incarnation: 1}, update(dead, 1), true},
+		{"dead at an old incarnation", Member{State: alive, Incarnation: 2}, update(dead, 1), false},
+		{"dead after leaving", Member{State: left, Incarnation: 1}, update(dead, 1), false},
+		{"left of a dead member", Member{State: dead, Incarnation: 1}, update(left, 1), false},
+		{"left at a higher incarnation", Member{State: dead, Incarnation: 1}, update(left, 2), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := supersedes(test.update, &test.current); got != test.want {
+				t.Errorf("supersedes(%v %d over %v %d) = %v, want %v", test.update.State, test.update.Incarnation,
+					test.current.State, test.current.Incarnation, got, test.want)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		updates []communication.MemberUpdate
+		want    communication.MemberUpdate
+		gossip  bool // Whether the last update is queued for gossip
+	}{
+		{"new member", []communication.MemberUpdate{update(communication.MemberAlive, 0)}, update(communication.MemberAlive, 0), true},
+		{"suspected", []communication.MemberUpdate{update(communication.MemberAlive, 0), update(communication.MemberSuspect, 0)}, update(communication.MemberSuspect, 0), true},
+		{"refuted", []communication.MemberUpdate{update(communication.MemberSuspect, 0), update(communication.MemberAlive, 1)}, update(communication.MemberAlive, 1), true},
+		{"stale news", []communication.MemberUpdate{update(communication.MemberAlive, 2), update(communication.MemberDead, 1)}, update(communication.MemberAlive, 2), false},
+		{"dead stays dead", []communication.MemberUpdate{update(communication.MemberDead, 1), update(communication.MemberAlive, 1)}, update(communication.MemberDead, 1), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newTestList(DefaultOptions(time.Hour))
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			for i, u := range test.updates {
+				if i == len(test.updates)-1 {
+					clear(m.broadcasts)
+				}
+				m.apply(u)
+			}
+			got := m.members[n30.ID]
+			if got.State != test.want.State || got.Incarnation != test.want.Incarnation {
+				t.Errorf("n30 is %v at %d, want %v at %d", got.State, got.Incarnation, test.want.State, test.want.Incarnation)
+			}
+			if _, queued := m.broadcasts[n30.ID]; queued != test.gossip {
+				t.Errorf("queued for gossip = %v, want %v", queued, test.gossip)
+			}
+		})
+	}
+}
+
+func TestApplyRefutesRumorsAboutSelf(t *testing.T) {
+	m := newTestList(DefaultOptions(time.Hour))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apply(communication.MemberUpdate{Node: n5, State: communication.MemberDead, Incarnation: 3})
+	self := m.members[n5.ID]
+	if self.State != communication.MemberAlive || self.Incarnation != 4 {
+		t.Errorf("self is %v at %d, want alive at 4", self.State, self.Incarnation)
+	}
+	if refutation := m.broadcasts[n5.ID]; refutation == nil || refutation.update.State != communication.MemberAlive {
+		t.Errorf("queued %v, want a refutation", refutation)
+	}
+}
+
+func TestSuspectIsDeclaredDead(t *testing.T) {
+	options := DefaultOptions(time.Hour)
+	options.SuspicionTimeout = 10 * time.Millisecond
+	m := newTestList(options)
+	m.mu.Lock()
+	m.apply(update(communication.MemberSuspect, 1))
+	m.mu.Unlock()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		m.mu.Lock()
+		state := m.members[n30.ID].State
+		m.mu.Unlock()
+		if state == communication.MemberDead {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("n30 is still %v", state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if members := m.Members(); len(members) != 1 || members[0].Node.ID != n5.ID {
+		t.Errorf("Members() = %v, want only n5", members)
+	}
+}
+
+func TestRefutedSuspectStaysAlive(t *testing.T) {
+	options := DefaultOptions(time.Hour)
+	options.SuspicionTimeout = 10 * time.Millisecond
+	m := newTestList(options)
+	m.mu.Lock()
+	m.apply(update(communication.MemberSuspect, 1))
+	m.apply(update(communication.MemberAlive, 2))
+	m.mu.Unlock()
+
+	time.Sleep(5 * options.SuspicionTimeout)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if member := m.members[n30.ID]; member.State != communication.MemberAlive {
+		t.Errorf("n30 is %v after refuting, want alive", member.State)
+	}
+}
+
+func TestHandleIgnoresUnauthenticatedGossip(t *testing.T) {
+	secret := []byte("join secret")
+	dead := []communication.MemberUpdate{update(communication.MemberDead, 1)}
+	tests := []struct {
+		name   string
+		secret []byte // Signs the gossip
+		sender string // Proven with TLS
+		want   bool   // Whether n30 is declared dead
+	}{
+		{"signed", secret, "", true},
+		{"unsigned", nil, "", false},
+		{"other secret", []byte("guess"), "", false},
+		{"over TLS", nil, "n66", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := DefaultOptions(time.Hour)
+			options.Secret = secret
+			m := newTestList(options)
+			m.mu.Lock()
+			m.apply(update(communication.MemberAlive, 1))
+			m.mu.Unlock()
+
+			// A reply, so the list doesn't answer it
+			frame, err := communication.GetSyncMessage(communication.NodeInfo{ID: "n66", Address: "n66:8888"}, true, dead, test.secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Handle(decode(t, frame, test.sender))
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if got := m.members[n30.ID].State == communication.MemberDead; got != test.want {
+				t.Errorf("n30 dead = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+// Package metrics keeps counters, gauges and histograms in memory and serves
+// them over HTTP in the Prometheus text exposition format, so any Prometheus
+// server can scrape a node without the node depending on a client library.
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram bucket upper bounds, in seconds, suited to
+// operations taking between a few milliseconds and a few seconds.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// LinearBuckets returns count bucket upper bounds starting at start, width apart.
+func LinearBuckets(start, width float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start + float64(i)*width
+	}
+	return buckets
+}
+
+// Metric is anything a Registry can expose.
+type Metric interface {
+	Name() string
+	// write appends the metric's HELP and TYPE lines and its samples
+	write(b *strings.Builder)
+}
+
+// Registry holds the metrics a node exposes.
+type Registry struct {
+	metrics []Metric
+	names   map[string]bool
+	mu      sync.Mutex
+}
+
+// Default is the registry metrics are kept in unless stated otherwise.
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// Register adds metrics to the registry. Names must be unique.
+func (r *Registry) Register(metrics ...Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, metric := range metrics {
+		if r.names[metric.Name()] {
+			panic(fmt.Sprintf("metric %s registered twice", metric.Name()))
+		}
+		r.names[metric.Name()] = true
+		r.metrics = append(r.metrics, metric)
+	}
+}
+
+// Counter creates and registers a counter.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	counter := NewCounter(name, help, labels...)
+	r.Register(counter)
+	return counter
+}
+
+// Gauge creates and registers a gauge.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	gauge := NewGauge(name, help, labels...)
+	r.Register(gauge)
+	return gauge
+}
+
+// Histogram creates and registers a histogram.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	histogram := NewHistogram(name, help, buckets, labels...)
+	r.Register(histogram)
+	return histogram
+}
+
+// Text returns every registered metric in the Prometheus text format.
+func (r *Registry) Text() string {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name() < metrics[j].Name() })
+
+	var b strings.Builder
+	for _, metric := range metrics {
+		metric.write(&b)
+	}
+	return b.String()
+}
+
+// ServeHTTP answers a scrape.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprint(w, r.Text())
+}
+
+// Handler serves the default registry at /metrics.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Default)
+	return mux
+}
+
+// vector is the set of series of one metric, one per combination of label values.
+type vector[S any] struct {
+	name   string
+	help   string
+	labels []string
+	series map[string]*S // By label values, joined with a separator no value contains
+	newS   func() *S
+	mu     sync.Mutex
+}
+
+func (v *vector[S]) init(name, help string, labels []string, newS func() *S) {
+	v.name, v.help, v.labels = name, help, labels
+	v.series = make(map[string]*S)
+	v.newS = newS
+	if len(labels) == 0 {
+		// A metric without labels has a single series, exposed from the start
+		v.series[""] = newS()
+	}
+}
+
+func (v *vector[S]) Name() string {
+	return v.name
+}
+
+// with returns the series for the label values, creating it on first use.
+// Callers hold v.mu.
+func (v *vector[S]) with(values []string) *S {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = v.newS()
+		v.series[key] = s
+	}
+	return s
+}
+
+// each calls write for every series in label order, with its label pairs
+// formatted for a sample line. Callers hold v.mu.
+func (v *vector[S]) each(write func(labels string, s *S)) {
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var values []string
+		if len(v.labels) > 0 {
+			values = strings.Split(key, "\xff")
+		}
+		write(labelPairs(v.labels, values), v.series[key])
+	}
+}
+
+func (v *vector[S]) header(b *strings.Builder, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n", v.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(v.help))
+	fmt.Fprintf(b, "# TYPE %s %s\n", v.name, kind)
+}
+
+// labelPairs formats label names and values as name="value" pairs
+func labelPairs(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+// sample appends one sample line
+func sample(b *strings.Builder, name, labels string, value float64) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	fmt.Fprintf(b, "%s %s\n", name, formatValue(value))
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// joinLabels adds a label pair to formatted ones
+func joinLabels(labels, pair string) string {
+	if labels == "" {
+		return pair
+	}
+	return labels + "," + pair
+}
+
+// Counter is a value that only goes up, such as a number of messages.
+type Counter struct {
+	vector[float64]
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{}
+	c.init(name, help, labels, func() *float64 { return new(float64) })
+	return c
+}
+
+// Inc adds one to the series with the given label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds delta, which must not be negative, to the series with the given label values.
+func (c *Counter) Add(delta float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*c.with(values) += delta
+}
+
+func (c *Counter) write(b *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(b, "counter")
+	c.each(func(labels string, value *float64) {
+		sample(b, c.name, labels, *value)
+	})
+}
+
+// Gauge is a value that goes up and down, such as a number of open connections.
+type Gauge struct {
+	vector[float64]
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{}
+	g.init(name, help, labels, func() *float64 { return new(float64) })
+	return g
+}
+
+// Set sets the series with the given label values.
+func (g *Gauge) Set(value float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	*g.with(values) = value
+}
+
+// Add adds delta, which may be negative, to the series with the given label values.
+func (g *Gauge) Add(delta float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	*g.with(values) += delta
+}
+
+func (g *Gauge) write(b *strings.Builder) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.header(b, "gauge")
+	g.each(func(labels string, value *float64) {
+		sample(b, g.name, labels, *value)
+	})
+}
+
+// histogramSeries counts the observations of one series per bucket
+type histogramSeries struct {
+	buckets []uint64 // Observations up to each bucket's upper bound, not cumulative
+	count   uint64
+	sum     float64
+}
+
+// Histogram counts observations, such as latencies, in buckets.
+type Histogram struct {
+	vector[histogramSeries]
+	upperBounds []float64
+}
+
+// NewHistogram creates a histogram with the given bucket upper bounds, in
+// increasing order. A bucket for everything above them is implied.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	upperBounds := slices.Clone(buckets)
+	sort.Float64s(upperBounds)
+	h := &Histogram{upperBounds: upperBounds}
+	h.init(name, help, labels, func() *histogramSeries {
+		return &histogramSeries{buckets: make([]uint64, len(upperBounds))}
+	})
+	return h
+}
+
+// Observe records a value in the series with the given label values.
+func (h *Histogram) Observe(value float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.with(values)
+	if i := sort.SearchFloat64s(h.upperBounds, value); i < len(h.upperBounds) {
+		s.buckets[i]++
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *Histogram) write(b *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(b, "histogram")
+	h.each(func(labels string, s *histogramSeries) {
+		var cumulative uint64
+		for i, upperBound := range h.upperBounds {
+			cumulative += s.buckets[i]
+			sample(b, h.name+"_bucket", joinLabels(labels, `le="`+formatValue(upperBound)+`"`), float64(cumulative))
+		}
+		sample(b, h.name+"_bucket", joinLabels(labels, `le="+Inf"`), float64(s.count))
+		sample(b, h.name+"_sum", labels, s.sum)
+		sample(b, h.name+"_count", labels, float64(s.count))
+	})
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTextEscapesLabelValuesAndHelp(t *testing.T) {
+	r := NewRegistry()
+	counter := r.Counter("dht_test_total", "Help with a \\ and a\nnewline.", "reason")
+	counter.Inc(`say "hi"` + "\n" + `C:\dht`)
+
+	want := `# HELP dht_test_total Help with a \\ and a\nnewline.
+# TYPE dht_test_total counter
+dht_test_total{reason="say \"hi\"\nC:\\dht"} 1
+`
+	if got := r.Text(); got != want {
+		t.Errorf("Text() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestTextWritesHistogramSeries(t *testing.T) {
+	r := NewRegistry()
+	histogram := r.Histogram("dht_test_seconds", "Latency.", []float64{1, 0.5}, "type")
+	for _, value := range []float64{0.2, 0.5, 0.7, 3} {
+		histogram.Observe(value, "STORE")
+	}
+
+	want := `# HELP dht_test_seconds Latency.
+# TYPE dht_test_seconds histogram
+dht_test_seconds_bucket{type="STORE",le="0.5"} 2
+dht_test_seconds_bucket{type="STORE",le="1"} 3
+dht_test_seconds_bucket{type="STORE",le="+Inf"} 4
+dht_test_seconds_sum{type="STORE"} 4.4
+dht_test_seconds_count{type="STORE"} 4
+`
+	if got := r.Text(); got != want {
+		t.Errorf("Text() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestTextSortsMetricsAndSeries(t *testing.T) {
+	r := NewRegistry()
+	gauge := r.Gauge("dht_b", "B.", "direction")
+	counter := r.Counter("dht_a", "A.")
+	gauge.Set(2, "outgoing")
+	gauge.Add(-1, "incoming")
+	counter.Add(3)
+
+	want := `# HELP dht_a A.
+# TYPE dht_a counter
+dht_a 3
+# HELP dht_b B.
+# TYPE dht_b gauge
+dht_b{direction="incoming"} -1
+dht_b{direction="outgoing"} 2
+`
+	if got := r.Text(); got != want {
+		t.Errorf("Text() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRegisterRefusesDuplicateNames(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("dht_test_total", "Once.")
+	defer func() {
+		if recover() == nil {
+			t.Error("registered dht_test_total twice")
+		}
+	}()
+	r.Gauge("dht_test_total", "Twice.")
+}
+
+func TestLabelValuesMustMatchLabels(t *testing.T) {
+	counter := NewCounter("dht_test_total", "Labelled.", "type", "reason")
+	defer func() {
+		if message, _ := recover().(string); !strings.Contains(message, "takes 2 label values") {
+			t.Errorf("recovered %q", message)
+		}
+	}()
+	counter.Inc("STORE")
+}
@@ -0,0 +1,125 @@
+package peer
+
+import (
+	"dht/communication"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// ErrPermissionDenied is wrapped by every authorization failure.
+var ErrPermissionDenied = errors.New("permission denied")
+
+// AccessPolicy decides which API keys may store and retrieve objects under which client IDs.
+type AccessPolicy struct {
+	keys    map[string]accessKey
+	maxSkew time.Duration
+	seen    *communication.ReplayCache // Nonces of the requests already served
+}
+
+// accessKey is one API key and what it is allowed to do.
+type accessKey struct {
+	secret     []byte
+	namespaces []string // Client IDs the key may act for, "*" for all of them
+	operations []communication.OperationType
+}
+
+// accessPolicyFile is the JSON layout of a policy file:
+//
+//	{
+//	  "max_skew": "5m",
+//	  "keys": [
+//	    {"id": "svc-a", "secret": "...", "namespaces": ["1", "2"], "operations": ["store", "retrieve"]},
+//	    {"id": "audit", "secret": "...", "namespaces": ["*"], "operations": ["retrieve"]}
+//	  ]
+//	}
+type accessPolicyFile struct {
+	MaxSkew string `json:"max_skew"`
+	Keys    []struct {
+		ID         string   `json:"id"`
+		Secret     string   `json:"secret"`
+		Namespaces []string `json:"namespaces"`
+		Operations []string `json:"operations"`
+	} `json:"keys"`
+}
+
+// LoadAccessPolicy reads and validates a JSON access policy file.
+func LoadAccessPolicy(path string) (*AccessPolicy, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file accessPolicyFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("parsing access policy %s: %w", path, err)
+	}
+
+	policy := &AccessPolicy{
+		keys:    make(map[string]accessKey),
+		maxSkew: 5 * time.Minute,
+		seen:    communication.NewReplayCache(),
+	}
+	if file.MaxSkew != "" {
+		if policy.maxSkew, err = time.ParseDuration(file.MaxSkew); err != nil {
+			return nil, fmt.Errorf("access policy %s: invalid max_skew: %w", path, err)
+		}
+	}
+
+	for i, key := range file.Keys {
+		if key.ID == "" || key.Secret == "" {
+			return nil, fmt.Errorf("access policy %s: key %d needs an id and a secret", path, i)
+		}
+		if _, exists := policy.keys[key.ID]; exists {
+			return nil, fmt.Errorf("access policy %s: duplicate key %q", path, key.ID)
+		}
+		for _, namespace := range key.Namespaces {
+			if _, err := strconv.Atoi(namespace); err != nil && namespace != "*" {
+				return nil, fmt.Errorf("access policy %s: key %q: namespace %q is not a client ID or \"*\"", path, key.ID, namespace)
+			}
+		}
+		operations := make([]communication.OperationType, 0, len(key.Operations))
+		for _, operation := range key.Operations {
+			switch operation {
+			case "store":
+				operations = append(operations, communication.STORE)
+			case "retrieve":
+				operations = append(operations, communication.RETRIEVE)
+			default:
+				return nil, fmt.Errorf("access policy %s: key %q: unknown operation %q", path, key.ID, operation)
+			}
+		}
+		policy.keys[key.ID] = accessKey{
+			secret:     []byte(key.Secret),
+			namespaces: key.Namespaces,
+			operations: operations,
+		}
+	}
+
+	return policy, nil
+}
+
+// Authorize checks that a request is signed by a known key that may perform
+// its operation on its client ID. A nil policy allows everything.
+func (a *AccessPolicy) Authorize(request *communication.RequestMessage) error {
+	if a == nil {
+		return nil
+	}
+	key, ok := a.keys[request.KeyID]
+	if !ok {
+		return fmt.Errorf("%w: unknown API key %q", ErrPermissionDenied, request.KeyID)
+	}
+	if err := communication.VerifyRequest(key.secret, request, time.Now(), a.maxSkew, a.seen); err != nil {
+		return fmt.Errorf("%w: %v", ErrPermissionDenied, err)
+	}
+	if !slices.Contains(key.operations, request.OperationType) {
+		return fmt.Errorf("%w: key %q may not perform operation %s", ErrPermissionDenied, request.KeyID, request.OperationType)
+	}
+	if !slices.Contains(key.namespaces, "*") && !slices.Contains(key.namespaces, strconv.Itoa(request.ClientID)) {
+		return fmt.Errorf("%w: key %q may not access client %d", ErrPermissionDenied, request.KeyID, request.ClientID)
+	}
+	return nil
+}
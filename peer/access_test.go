@@ -0,0 +1,106 @@
+package peer
+
+import (
+	"dht/communication"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writePolicy writes an access policy file into a temporary directory
+func writePolicy(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuthorize(t *testing.T) {
+	policy, err := LoadAccessPolicy(writePolicy(t, `{
+		"keys": [
+			{"id": "svc-a", "secret": "a-secret", "namespaces": ["1", "2"], "operations": ["store", "retrieve"]},
+			{"id": "audit", "secret": "audit-secret", "namespaces": ["*"], "operations": ["retrieve"]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		key       string
+		secret    string
+		operation communication.OperationType
+		clientID  int
+		allowed   bool
+	}{
+		{"own namespace", "svc-a", "a-secret", communication.STORE, 2, true},
+		{"other namespace", "svc-a", "a-secret", communication.STORE, 3, false},
+		{"wildcard namespace", "audit", "audit-secret", communication.RETRIEVE, 42, true},
+		{"operation not granted", "audit", "audit-secret", communication.STORE, 42, false},
+		{"unknown key", "nobody", "a-secret", communication.STORE, 1, false},
+		{"wrong secret", "svc-a", "audit-secret", communication.STORE, 1, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &communication.RequestMessage{OperationType: test.operation, ObjectID: 65, ClientID: test.clientID, ReplyTo: "127.0.0.1:9100"}
+			communication.SignRequest(request, test.key, []byte(test.secret))
+			err := policy.Authorize(request)
+			if allowed := err == nil; allowed != test.allowed {
+				t.Fatalf("err = %v, want allowed %v", err, test.allowed)
+			}
+			if err != nil && !errors.Is(err, ErrPermissionDenied) {
+				t.Errorf("err = %v, want it to wrap %v", err, ErrPermissionDenied)
+			}
+		})
+	}
+}
+
+func TestAuthorizeRefusesReplays(t *testing.T) {
+	policy, err := LoadAccessPolicy(writePolicy(t, `{"keys": [{"id": "svc-a", "secret": "a-secret", "namespaces": ["*"], "operations": ["store"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := &communication.RequestMessage{OperationType: communication.STORE, ObjectID: 65, ClientID: 1}
+	communication.SignRequest(request, "svc-a", []byte("a-secret"))
+	if err := policy.Authorize(request); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.Authorize(request); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("replayed request: err = %v, want it refused", err)
+	}
+}
+
+func TestNilPolicyAllowsEverything(t *testing.T) {
+	var policy *AccessPolicy
+	if err := policy.Authorize(&communication.RequestMessage{OperationType: communication.STORE}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadAccessPolicyRejectsInvalidFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		problem string
+	}{
+		{"not JSON", `{`, "parsing"},
+		{"missing secret", `{"keys": [{"id": "svc-a"}]}`, "needs an id and a secret"},
+		{"duplicate key", `{"keys": [{"id": "a", "secret": "s"}, {"id": "a", "secret": "t"}]}`, "duplicate key"},
+		{"bad namespace", `{"keys": [{"id": "a", "secret": "s", "namespaces": ["one"]}]}`, "is not a client ID"},
+		{"unknown operation", `{"keys": [{"id": "a", "secret": "s", "operations": ["delete"]}]}`, "unknown operation"},
+		{"bad max skew", `{"max_skew": "soon", "keys": []}`, "invalid max_skew"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := LoadAccessPolicy(writePolicy(t, test.content))
+			if err == nil || !strings.Contains(err.Error(), test.problem) {
+				t.Errorf("err = %v, want one mentioning %q", err, test.problem)
+			}
+		})
+	}
+}
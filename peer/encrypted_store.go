@@ -0,0 +1,234 @@
+package peer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"dht/util"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrPlaintextEntry is returned when an encrypted store file holds an
+// unencrypted line, which only a rotation may read and encrypt.
+var ErrPlaintextEntry = errors.New("plaintext entry in encrypted store, rotate the store key once to encrypt it")
+
+// encryptedPrefix marks an encrypted line: enc1:<key ID>:<base64 of nonce and ciphertext>.
+const encryptedPrefix = "enc1:"
+
+// KeyRing holds the AES keys of an encrypted store. Every key can decrypt,
+// only the active one, the last in the key file, encrypts new entries.
+type KeyRing struct {
+	ciphers map[string]cipher.AEAD
+	active  string
+}
+
+// LoadKeyRing reads a key file with one "<key ID> <base64 AES key>" pair per
+// line. Blank lines and lines starting with # are ignored. To rotate keys,
+// append a new line and run Rotate on the store.
+func LoadKeyRing(path string) (*KeyRing, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ring := &KeyRing{ciphers: make(map[string]cipher.AEAD)}
+	for number, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.Contains(fields[0], ":") {
+			return nil, fmt.Errorf("key file %s line %d: expected \"<key ID> <base64 key>\"", path, number+1)
+		}
+		id := fields[0]
+		if _, exists := ring.ciphers[id]; exists {
+			return nil, fmt.Errorf("key file %s line %d: duplicate key ID %q", path, number+1, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("key file %s line %d: %w", path, number+1, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key file %s line %d: %w", path, number+1, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		ring.ciphers[id] = aead
+		ring.active = id
+	}
+
+	if ring.active == "" {
+		return nil, fmt.Errorf("key file %s contains no keys", path)
+	}
+	return ring, nil
+}
+
+// EncryptedStore keeps entries in a file with every line sealed by AES-GCM.
+// Plaintext lines left over from a FileStore are refused, except by Rotate,
+// which migrates an existing store file by encrypting them once.
+type EncryptedStore struct {
+	path string
+	keys *KeyRing
+	mu   sync.Mutex
+}
+
+// NewEncryptedStore returns an encrypted store backed by the file at path.
+func NewEncryptedStore(path string, keys *KeyRing) *EncryptedStore {
+	return &EncryptedStore{path: path, keys: keys}
+}
+
+func (s *EncryptedStore) Add(entry Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	line, err := s.seal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(line + "\n")
+	return err
+}
+
+func (s *EncryptedStore) Contains(entry Entry) (bool, error) {
+	entries, err := s.Entries()
+	if err != nil {
+		return false, err
+	}
+	for _, stored := range entries {
+		if stored == entry {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *EncryptedStore) Entries() ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readEntries(false)
+}
+
+func (s *EncryptedStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return syncFile(s.path)
+}
+
+func (s *EncryptedStore) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fileSize(s.path)
+}
+
+// Rotate rewrites the whole file with every entry encrypted under the active
+// key, after which retired keys can be removed from the key file. The new
+// file replaces the old one atomically.
+func (s *EncryptedStore) Rotate() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.readEntries(true)
+	if err != nil {
+		return 0, err
+	}
+
+	var content strings.Builder
+	for _, entry := range entries {
+		line, err := s.seal(entry)
+		if err != nil {
+			return 0, err
+		}
+		content.WriteString(line + "\n")
+	}
+	if err := util.WriteFileAtomic(s.path, []byte(content.String())); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// readEntries decrypts every line of the store file, failing on plaintext
+// lines unless they are being migrated. Callers hold s.mu.
+func (s *EncryptedStore) readEntries(migrating bool) ([]Entry, error) {
+	lines, err := readLines(s.path)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(lines))
+	for number, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, encryptedPrefix) {
+			if !migrating {
+				return nil, fmt.Errorf("store %s line %d: %w", s.path, number+1, ErrPlaintextEntry)
+			}
+			// A line that can't be migrated stops the rotation rather than lose an object
+			entry, ok := parseEntry(strings.TrimSpace(line))
+			if !ok {
+				return nil, fmt.Errorf("store %s line %d: %q is not a clientID::objectID entry", s.path, number+1, line)
+			}
+			entries = append(entries, entry)
+			continue
+		}
+		entry, err := s.open(line)
+		if err != nil {
+			return nil, fmt.Errorf("store %s line %d: %w", s.path, number+1, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// seal encrypts an entry under the active key. The key ID is bound in as
+// additional data so a line cannot be relabelled to another key.
+func (s *EncryptedStore) seal(entry Entry) (string, error) {
+	aead := s.keys.ciphers[s.keys.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	header := encryptedPrefix + s.keys.active
+	sealed := aead.Seal(nonce, nonce, []byte(entry.String()), []byte(header))
+	return header + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts one encrypted line.
+func (s *EncryptedStore) open(line string) (Entry, error) {
+	keyID, encoded, ok := strings.Cut(strings.TrimPrefix(line, encryptedPrefix), ":")
+	if !ok {
+		return Entry{}, fmt.Errorf("malformed encrypted entry")
+	}
+	aead, ok := s.keys.ciphers[keyID]
+	if !ok {
+		return Entry{}, fmt.Errorf("entry encrypted with unknown key %q", keyID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return Entry{}, fmt.Errorf("malformed encrypted entry")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(encryptedPrefix+keyID))
+	if err != nil {
+		return Entry{}, fmt.Errorf("decrypting entry: %w", err)
+	}
+	entry, ok := parseEntry(string(plaintext))
+	if !ok {
+		return Entry{}, fmt.Errorf("decrypted entry is malformed")
+	}
+	return entry, nil
+}
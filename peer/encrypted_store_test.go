@@ -0,0 +1,213 @@
+package peer
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// keyLine returns a key file line for a fresh random AES-256 key
+func keyLine(t *testing.T, id string) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%s %s\n", id, base64.StdEncoding.EncodeToString(key))
+}
+
+// loadKeys writes lines to a key file in dir and loads it
+func loadKeys(t *testing.T, dir string, lines ...string) *KeyRing {
+	t.Helper()
+	path := filepath.Join(dir, "store.key")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadKeyRing(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestEncryptedStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "objects.txt")
+	store := NewEncryptedStore(path, loadKeys(t, dir, keyLine(t, "k1")))
+
+	want := []Entry{{ClientID: 1, ObjectID: 65}, {ClientID: 2, ObjectID: 66}}
+	for _, entry := range want {
+		if err := store.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := store.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Entries() = %v, want %v", got, want)
+	}
+	if found, err := store.Contains(Entry{ClientID: 2, ObjectID: 66}); err != nil || !found {
+		t.Errorf("Contains(2::66) = %v, %v", found, err)
+	}
+	if found, err := store.Contains(Entry{ClientID: 1, ObjectID: 66}); err != nil || found {
+		t.Errorf("Contains(1::66) = %v, %v", found, err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range want {
+		if strings.Contains(string(content), entry.String()) {
+			t.Errorf("store file holds %s in plaintext", entry)
+		}
+	}
+}
+
+func TestEncryptedStoreDetectsTampering(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "objects.txt")
+	first, second := keyLine(t, "k1"), keyLine(t, "k2")
+	store := NewEncryptedStore(path, loadKeys(t, dir, first, second))
+	if err := store.Add(Entry{ClientID: 1, ObjectID: 65}); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.TrimSpace(string(content))
+
+	keyID, sealed, _ := strings.Cut(strings.TrimPrefix(line, encryptedPrefix), ":")
+	raw, _ := base64.StdEncoding.DecodeString(sealed)
+	raw[len(raw)-1] ^= 1
+	tests := map[string]string{
+		"flipped bit":   encryptedPrefix + keyID + ":" + base64.StdEncoding.EncodeToString(raw),
+		"relabelled":    strings.Replace(line, "k2", "k1", 1),
+		"unknown key":   strings.Replace(line, "k2", "k3", 1),
+		"not base64":    encryptedPrefix + keyID + ":!!!",
+		"no ciphertext": encryptedPrefix + keyID,
+	}
+	for name, tampered := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := os.WriteFile(path, []byte(tampered+"\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if entries, err := store.Entries(); err == nil {
+				t.Errorf("Entries() = %v, want an error", entries)
+			}
+		})
+	}
+}
+
+func TestEncryptedStoreRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "objects.txt")
+	first, second := keyLine(t, "k1"), keyLine(t, "k2")
+	if err := NewEncryptedStore(path, loadKeys(t, dir, first)).Add(Entry{ClientID: 1, ObjectID: 65}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both keys are needed until the store is rotated
+	if _, err := NewEncryptedStore(path, loadKeys(t, dir, second)).Entries(); err == nil {
+		t.Fatal("read entries without the key they were sealed with")
+	}
+	store := NewEncryptedStore(path, loadKeys(t, dir, first, second))
+	if err := store.Add(Entry{ClientID: 2, ObjectID: 66}); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := store.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated != 2 {
+		t.Errorf("Rotate() = %d, want 2", rotated)
+	}
+
+	// Afterwards the retired key can go
+	entries, err := NewEncryptedStore(path, loadKeys(t, dir, second)).Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Entry{{ClientID: 1, ObjectID: 65}, {ClientID: 2, ObjectID: 66}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("Entries() = %v, want %v", entries, want)
+	}
+	if leftovers, _ := filepath.Glob(path + ".*"); len(leftovers) != 0 {
+		t.Errorf("rotation left %v behind", leftovers)
+	}
+}
+
+func TestEncryptedStoreRefusesPlaintextUntilRotated(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "objects.txt")
+	if err := os.WriteFile(path, []byte("1::65\n\n2::66\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store := NewEncryptedStore(path, loadKeys(t, dir, keyLine(t, "k1")))
+
+	if _, err := store.Entries(); !errors.Is(err, ErrPlaintextEntry) {
+		t.Fatalf("Entries() err = %v, want %v", err, ErrPlaintextEntry)
+	}
+	if found, err := store.Contains(Entry{ClientID: 1, ObjectID: 65}); !errors.Is(err, ErrPlaintextEntry) {
+		t.Errorf("Contains() = %v, %v, want %v", found, err, ErrPlaintextEntry)
+	}
+
+	if migrated, err := store.Rotate(); err != nil || migrated != 2 {
+		t.Fatalf("Rotate() = %d, %v", migrated, err)
+	}
+	entries, err := store.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Entry{{ClientID: 1, ObjectID: 65}, {ClientID: 2, ObjectID: 66}}; !reflect.DeepEqual(entries, want) {
+		t.Errorf("Entries() = %v, want %v", entries, want)
+	}
+}
+
+func TestEncryptedStoreRotationKeepsUnreadableLines(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "objects.txt")
+	content := "1::65\n1:66\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store := NewEncryptedStore(path, loadKeys(t, dir, keyLine(t, "k1")))
+
+	if migrated, err := store.Rotate(); err == nil {
+		t.Fatalf("Rotate() = %d, want an error for line 2", migrated)
+	}
+	if kept, err := os.ReadFile(path); err != nil || string(kept) != content {
+		t.Errorf("store file after a failed rotation = %q, %v, want it untouched", kept, err)
+	}
+}
+
+func TestLoadKeyRingRejectsInvalidFiles(t *testing.T) {
+	tests := map[string]string{
+		"empty":            "# no keys yet\n",
+		"missing key":      "k1\n",
+		"colon in ID":      "k:1 " + base64.StdEncoding.EncodeToString(make([]byte, 32)) + "\n",
+		"not base64":       "k1 !!!\n",
+		"short key":        "k1 " + base64.StdEncoding.EncodeToString(make([]byte, 7)) + "\n",
+		"duplicate key ID": "k1 " + base64.StdEncoding.EncodeToString(make([]byte, 16)) + "\nk1 " + base64.StdEncoding.EncodeToString(make([]byte, 32)) + "\n",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "store.key")
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadKeyRing(path); err == nil {
+				t.Error("LoadKeyRing accepted the file")
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package peer
+
+import (
+	"context"
+	"dht/communication"
+	"dht/membership"
+	"slices"
+	"sort"
+)
+
+// successorListLength is how many next hops a peer offers in an iterative
+// lookup, so the querier can route around some that are down.
+const successorListLength = 3
+
+// UseMembership lets the peer consult the gossiped membership, which knows
+// more of the ring than the two links.
+func (p *Peer) UseMembership(members *membership.Memberlist) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.members = members
+}
+
+// successors returns up to count peers following this one around the ring,
+// nearest first. Without gossiped membership only the successor is known.
+func (p *Peer) successors(count int) []communication.NodeInfo {
+	p.mu.Lock()
+	successor, members := p.Successor, p.members
+	p.mu.Unlock()
+
+	var nodes []communication.NodeInfo
+	if members != nil {
+		for _, member := range members.Members() {
+			nodes = append(nodes, member.Node)
+		}
+	}
+	if len(nodes) <= 1 {
+		if successor.ID == "" || successor.ID == p.ID {
+			return nil
+		}
+		return []communication.NodeInfo{successor}
+	}
+
+	// Walk the ring clockwise starting just after this peer
+	sort.Slice(nodes, func(i, j int) bool { return ringPosition(nodes[i].ID) < ringPosition(nodes[j].ID) })
+	self := ringPosition(p.ID)
+	start := sort.Search(len(nodes), func(i int) bool { return ringPosition(nodes[i].ID) > self })
+	var following []communication.NodeInfo
+	for i := range nodes {
+		node := nodes[(start+i)%len(nodes)]
+		if node.ID != p.ID && len(following) < count {
+			following = append(following, node)
+		}
+	}
+	return following
+}
+
+// rangeStart returns the node after which this peer's range of objects
+// begins. That is the predecessor, unless gossip has found it gone, in which
+// case this peer takes over its range from the nearest live member before it.
+func (p *Peer) rangeStart() communication.NodeInfo {
+	p.mu.Lock()
+	predecessor, members := p.Predecessor, p.members
+	p.mu.Unlock()
+	if members == nil || predecessor.ID == "" {
+		return predecessor
+	}
+
+	live := members.Members()
+	if len(live) <= 1 || slices.ContainsFunc(live, func(member membership.Member) bool { return member.Node.ID == predecessor.ID }) {
+		return predecessor
+	}
+	// The closest member before this peer, wrapping around to the highest one
+	self := ringPosition(p.ID)
+	var before, highest communication.NodeInfo
+	for _, member := range live {
+		position := ringPosition(member.Node.ID)
+		if member.Node.ID == p.ID {
+			continue
+		}
+		if position < self && (before.ID == "" || position > ringPosition(before.ID)) {
+			before = member.Node
+		}
+		if highest.ID == "" || position > ringPosition(highest.ID) {
+			highest = member.Node
+		}
+	}
+	if before.ID != "" {
+		return before
+	}
+	return highest
+}
+
+// HandleNextHopRequest tells an iterative querier whether this peer owns the
+// object, and otherwise which peers to ask next.
+func (p *Peer) HandleNextHopRequest(ctx context.Context, request *communication.NextHopRequestMessage, respond communication.Responder) {
+	owner := p.owns(request.ObjectID)
+	var next []communication.NodeInfo
+	if !owner {
+		next = p.successors(successorListLength)
+	}
+	replyMessage, err := communication.GetNextHopMessage(request.LookupID, p.self(), owner, next)
+	if err != nil {
+		p.logger.Error("Failed to encode message", "msg_type", communication.NEXT_HOP, "err", err)
+		return
+	}
+	if err := respond(ctx, replyMessage); err != nil {
+		p.logger.Warn("Failed to answer next hop request", "req_id", request.LookupID, "err", err)
+	}
+}
@@ -0,0 +1,48 @@
+package peer
+
+import (
+	"dht/communication"
+	"dht/metrics"
+	"time"
+)
+
+var (
+	requestsForwarded  = metrics.Default.Counter("dht_requests_forwarded_total", "Requests passed on to the successor, one per hop, by operation.", "operation")
+	requestsRedirected = metrics.Default.Counter("dht_requests_redirected_total", "Direct requests answered with WRONG_OWNER, by operation.", "operation")
+	requestHops        = metrics.Default.Histogram("dht_request_hops", "Nodes a request passed through to reach the owning peer, the owner included, by operation.", metrics.LinearBuckets(1, 1, 10), "operation")
+	requestDuration    = metrics.Default.Histogram("dht_object_request_duration_seconds", "Time the owning peer took to store or retrieve an object, by operation.", metrics.DefaultBuckets, "operation")
+	storedObjects      = metrics.Default.Gauge("dht_stored_objects", "Objects held in the peer's store.")
+	storedBytes        = metrics.Default.Gauge("dht_stored_bytes", "Bytes the peer's store takes up on disk.")
+)
+
+// observeRequest records how long the owner took over a request since start
+func observeRequest(operation communication.OperationType, start time.Time) {
+	requestDuration.Observe(time.Since(start).Seconds(), operation.String())
+}
+
+// observeHops records how many nodes a request passed through to reach its owner
+func observeHops(request *communication.RequestMessage) {
+	requestHops.Observe(float64(request.HopCount), request.OperationType.String())
+}
+
+// RecordStoreSize reads the store to set the stored object metrics, which
+// are kept up to date from then on.
+func (p *Peer) RecordStoreSize() {
+	entries, err := p.store.Entries()
+	if err != nil {
+		p.logger.Warn("Failed to read store", "err", err)
+		return
+	}
+	p.recordStoreSize(entries)
+}
+
+// recordStoreSize updates the stored object gauges from the store's entries
+func (p *Peer) recordStoreSize(entries []Entry) {
+	storedObjects.Set(float64(len(entries)))
+	size, err := p.store.Size()
+	if err != nil {
+		p.logger.Warn("Failed to read store size", "err", err)
+		return
+	}
+	storedBytes.Set(float64(size))
+}
@@ -1,176 +1,299 @@
 package peer
 
 import (
-	"bufio"
+	"context"
 	"dht/communication"
+	"dht/membership"
 	"fmt"
-	"os"
-	"strconv"
-	"strings"
+	"log/slog"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Peer represents an individual peer node in the DHT.
 type Peer struct {
-	ID               string
-	Predecessor      string
-	Successor        string
-	StoreFilePath    string
-	bootstrapAddress string
-	communicator     *communication.TcpCommunicator
-	mu               sync.Mutex
+	ID           string
+	Address      string // Address advertised to the rest of the ring
+	Predecessor  communication.NodeInfo
+	Successor    communication.NodeInfo
+	store        Store                      // Objects owned by this peer
+	bootstrap    *communication.Failover    // Bootstrap replicas, any of which accepts joins and results
+	joinSecret   []byte                     // Shared secret used to sign JOIN messages, and to check those of nodes joining through this peer
+	joinMaxSkew  time.Duration              // Accepted age of a signed JOIN
+	seenNonces   *communication.ReplayCache // Nonces of the signed JOINs and LEAVEs already accepted
+	accessPolicy *AccessPolicy              // Decides which clients may use objects stored here, nil allows all
+	members      *membership.Memberlist     // Gossiped view of the whole ring, nil when only the ring links are known
+	joining      atomic.Bool                // Set while a JOIN is waiting for the ring to link this peer in
+	left         atomic.Bool                // Set once the peer has announced it is leaving
+	communicator *communication.TcpCommunicator
+	logger       *slog.Logger
+	mu           sync.Mutex
 }
 
 // NewPeer initializes a new peer with the given ID and communicator.
-func NewPeer(id string, storeFilePath string, bootstrapAddress string, communicator *communication.TcpCommunicator) *Peer {
+func NewPeer(id string, store Store, bootstrapAddresses []string, joinSecret []byte, joinMaxSkew time.Duration, accessPolicy *AccessPolicy, communicator *communication.TcpCommunicator, logger *slog.Logger) *Peer {
 	return &Peer{
-		ID:               id,
-		StoreFilePath:    storeFilePath,
-		communicator:     communicator,
-		bootstrapAddress: bootstrapAddress,
+		ID:           id,
+		Address:      communicator.AdvertiseAddress(),
+		store:        store,
+		communicator: communicator,
+		bootstrap:    communication.NewFailover(bootstrapAddresses),
+		joinSecret:   joinSecret,
+		joinMaxSkew:  joinMaxSkew,
+		seenNonces:   communication.NewReplayCache(),
+		accessPolicy: accessPolicy,
+		logger:       logger,
 	}
 }
 
-// JoinNetwork contacts the bootstrap server and registers the peer.
-func (p *Peer) JoinNetwork(bootstrapAddress string) {
-	// Send JOIN message to bootstrap server
-	byteMessage, err := communication.GetJoinMessage(p.ID)
-	if err == nil {
-		p.communicator.SendMessage(bootstrapAddress, byteMessage)
-	} else {
-		fmt.Println("Error encoding join message:", err)
+// requestLogger returns the peer's logger with the fields identifying a request
+func (p *Peer) requestLogger(request *communication.RequestMessage) *slog.Logger {
+	return p.logger.With("req_id", request.ReqID, "client_id", request.ClientID, "object_id", request.ObjectID)
+}
+
+// JoinNetwork joins the ring through the first reachable seed peer, which
+// looks up where this peer belongs. Without seeds it registers with the
+// bootstrap server, and without either it starts a new ring on its own.
+func (p *Peer) JoinNetwork(seeds []string) {
+	if len(seeds) == 0 && len(p.bootstrap.Addresses()) == 0 {
+		p.logger.Info("No seeds or bootstrap server, starting a new ring")
+		p.UpdateLinks(p.self(), p.self())
+		return
+	}
+
+	byteMessage, err := communication.GetJoinMessage(p.ID, p.Address, p.joinSecret)
+	if err != nil {
+		p.logger.Error("Failed to encode message", "msg_type", communication.JOIN, "err", err)
+		return
+	}
+	target := p.bootstrap
+	if len(seeds) > 0 {
+		target = communication.NewFailover(seeds)
+	}
+	p.joining.Store(true)
+	if err := target.Send(context.Background(), p.communicator, byteMessage); err != nil {
+		p.joining.Store(false)
+		p.logger.Error("Failed to join the ring", "err", err)
+	}
+}
+
+// HandleJoinRejected gives up joining when the ring refuses this peer's JOIN.
+// JOIN_REJECTED is not signed, so it is only believed while a join is in
+// flight and when it names this peer.
+func (p *Peer) HandleJoinRejected(rejected *communication.JoinRejectedMessage) {
+	if rejected.PeerID != p.ID || !p.joining.CompareAndSwap(true, false) {
+		p.logger.Warn("Ignoring unexpected join rejection", "peer", rejected.PeerID, "reason", rejected.Reason)
+		return
+	}
+	p.logger.Error("Join rejected, staying out of the ring", "reason", rejected.Reason)
+}
+
+// sendResult delivers a result to whichever bootstrap replica is reachable,
+// which relays it to the client. A ring without a bootstrap answers the client directly.
+func (p *Peer) sendResult(ctx context.Context, message []byte, replyTo string) {
+	if len(p.bootstrap.Addresses()) == 0 {
+		if err := p.communicator.SendMessage(ctx, replyTo, message); err != nil {
+			p.logger.Warn("Failed to send result to client", "address", replyTo, "err", err)
+		}
+		return
+	}
+	if err := p.bootstrap.Send(ctx, p.communicator, message); err != nil {
+		p.logger.Warn("Failed to send result to bootstrap", "err", err)
 	}
 }
 
 // UpdateLinks updates the predecessor and successor of the peer.
-func (p *Peer) UpdateLinks(predecessor, successor string) {
+func (p *Peer) UpdateLinks(predecessor, successor communication.NodeInfo) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	p.Predecessor = predecessor
 	p.Successor = successor
-	// Print once the links are updated
-	fmt.Printf("Predecessor: %s, Successor: %s\n", p.Predecessor, p.Successor)
+	p.joining.Store(false)
+	p.logLinks()
 }
-func (p *Peer) GetNeighbors() (string, string) {
+
+// logLinks logs the peer's current links. Callers hold p.mu.
+func (p *Peer) logLinks() {
+	p.logger.Info("Links updated", "predecessor", p.Predecessor.ID, "successor", p.Successor.ID)
+}
+func (p *Peer) GetNeighbors() (communication.NodeInfo, communication.NodeInfo) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	return p.Predecessor, p.Successor
 }
 
-// StoreObject saves an object in the peer's local store.
-func (p *Peer) StoreObject(reqID, clientID, objectID int) {
-	// Get the current peerID and trim the first character from it and convert it to int
-	nodeId, _ := strconv.Atoi(p.ID[1:])
-	if objectID <= nodeId {
+// StoreObject saves an object in the peer's local store, or passes the
+// request on towards its owner, and sends the result under ctx.
+func (p *Peer) StoreObject(ctx context.Context, request *communication.RequestMessage) {
+	request.AddHop(p.ID)
+	clientID, objectID, replyTo := request.ClientID, request.ObjectID, request.ReplyTo
+	if p.owns(objectID) {
+		defer observeRequest(communication.STORE, time.Now())
+		observeHops(request)
+		// Only the owning peer enforces access, forwarding peers don't need the keys
+		if err := p.accessPolicy.Authorize(request); err != nil {
+			p.requestLogger(request).Warn("Refusing store request", "err", err)
+			byteMessage, err := communication.GetObjectStoredMessage(communication.STATUS_PERMISSION_DENIED, p.ID, objectID, clientID, replyTo, request.Trace)
+			if err == nil {
+				p.sendResult(ctx, byteMessage, replyTo)
+			}
+			return
+		}
+
 		// store it here
-		// Open the file in append mode, create if not exists
-		file, err := os.OpenFile(p.StoreFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err := p.store.Add(Entry{ClientID: clientID, ObjectID: objectID}); err != nil {
+			p.requestLogger(request).Error("Failed to write to store", "err", err)
+			return
+		}
+
+		// Send OBJ_STORED message to the bootstrap server
+		byteMessage, err := communication.GetObjectStoredMessage(communication.STATUS_OK, p.ID, objectID, clientID, replyTo, request.Trace)
 		if err != nil {
-			fmt.Println("Error opening store file:", err)
+			p.requestLogger(request).Error("Failed to encode message", "msg_type", communication.OBJ_STORED, "err", err)
 			return
 		}
-		defer file.Close()
-
-		// Write the object ID to the file
-		entry := fmt.Sprintf("%d::%d\n", clientID, objectID)
-		if _, err := file.WriteString(entry); err != nil {
-			fmt.Println("Error writing to store file:", err)
-		} else {
-			// Send OBJ_STORED message to the bootstrap server
-			byteMessage, err := communication.GetObjectStoredMessage(p.ID, objectID, clientID)
-			if err == nil {
-				go p.communicator.SendMessage(p.bootstrapAddress, byteMessage)
-				// Print all the objects stored in the file
-				// Open the file in read mode
-				file, err := os.Open(p.StoreFilePath)
-				if err != nil {
-					fmt.Println("Error opening store file:", err)
-					return
-				}
-				defer file.Close()
-
-				// Read file line by line and check for the object
-				scanner := bufio.NewScanner(file)
-				for scanner.Scan() {
-					line := scanner.Text()
-					fmt.Println(line)
-				}
-			} else {
-				fmt.Println("Error encoding obj stored message:", err)
-			}
+		p.sendResult(ctx, byteMessage, replyTo)
+
+		entries, err := p.store.Entries()
+		if err != nil {
+			p.requestLogger(request).Error("Failed to read store", "err", err)
+			return
+		}
+		p.recordStoreSize(entries)
+		if _, encrypted := p.store.(*EncryptedStore); !encrypted {
+			// Log all the objects held by this peer, unless they are meant to stay secret
+			p.logger.Info("Stored objects", "objects", entries)
 		}
+	} else if request.Flags.Has(communication.FLAG_DIRECT) {
+		// The client's view of the ring is stale, let it correct itself
+		p.redirect(ctx, request)
 	} else {
 		// else forward it to the next peer
-		go p.ForwardRequest(reqID, clientID, objectID, communication.STORE)
+		p.forward(ctx, request)
 	}
 }
 
-// RetrieveObject fetches an object from the peer's store.
-func (p *Peer) RetrieveObject(reqID, clientID, objectID int) {
-	// Get the current peerID and trim the first character from it and convert it to int
-	nodeId, _ := strconv.Atoi(p.ID[1:])
-	if objectID <= nodeId {
-		// Try retrieving the object from the local store
+// RetrieveObject fetches an object from the peer's store, or passes the
+// request on towards its owner, and sends the result under ctx.
+func (p *Peer) RetrieveObject(ctx context.Context, request *communication.RequestMessage) {
+	request.AddHop(p.ID)
+	clientID, objectID, replyTo := request.ClientID, request.ObjectID, request.ReplyTo
+	if p.owns(objectID) {
+		defer observeRequest(communication.RETRIEVE, time.Now())
+		observeHops(request)
+		// Only the owning peer enforces access, forwarding peers don't need the keys
+		if err := p.accessPolicy.Authorize(request); err != nil {
+			p.requestLogger(request).Warn("Refusing retrieve request", "err", err)
+			byteMessage, err := communication.GetObjectRetrievedMessage(communication.STATUS_PERMISSION_DENIED, objectID, replyTo, request.Trace)
+			if err == nil {
+				p.sendResult(ctx, byteMessage, replyTo)
+			}
+			return
+		}
 
-		// Open the file in read mode
-		file, err := os.Open(p.StoreFilePath)
+		// Try retrieving the object from the local store
+		found, err := p.store.Contains(Entry{ClientID: clientID, ObjectID: objectID})
 		if err != nil {
-			fmt.Println("Error opening store file:", err)
+			p.requestLogger(request).Error("Failed to read store", "err", err)
 			return
 		}
-		defer file.Close()
-
-		// Read file line by line and check for the object
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			line := scanner.Text()
-			parts := strings.Split(line, "::")
-			if len(parts) == 2 {
-				savedClientID, _ := strconv.Atoi(parts[0])
-				savedObjectID, _ := strconv.Atoi(parts[1])
-				if savedClientID == clientID && savedObjectID == objectID {
-					// Send OBJ_RETRIEVED message to the bootstrap server with status 1
-					byteMessage, err := communication.GetObjectRetrievedMessage(1, objectID)
-					if err == nil {
-						go p.communicator.SendMessage(p.bootstrapAddress, byteMessage)
-						return
-					} else {
-						fmt.Println("Error encoding obj retrieved message:", err)
-					}
-				}
+		if found {
+			// Send OBJ_RETRIEVED message to the bootstrap server with status 1
+			byteMessage, err := communication.GetObjectRetrievedMessage(communication.STATUS_OK, objectID, replyTo, request.Trace)
+			if err == nil {
+				p.sendResult(ctx, byteMessage, replyTo)
+			} else {
+				p.requestLogger(request).Error("Failed to encode message", "msg_type", communication.OBJ_RETRIEVED, "err", err)
 			}
-		}
-
-		if err := scanner.Err(); err != nil {
-			fmt.Println("Error reading store file:", err)
+			return
 		}
 
 		// Send OBJ_RETRIEVED message to the bootstrap server with status -1
-		byteMessage, err := communication.GetObjectRetrievedMessage(-1, objectID)
+		byteMessage, err := communication.GetObjectRetrievedMessage(communication.STATUS_NOT_FOUND, objectID, replyTo, request.Trace)
 		if err == nil {
-			go p.communicator.SendMessage(p.bootstrapAddress, byteMessage)
+			p.sendResult(ctx, byteMessage, replyTo)
 		}
 
+	} else if request.Flags.Has(communication.FLAG_DIRECT) {
+		// The client's view of the ring is stale, let it correct itself
+		p.redirect(ctx, request)
 	} else {
 		// else forward it to the next peer
-		go p.ForwardRequest(reqID, clientID, objectID, communication.RETRIEVE)
+		p.forward(ctx, request)
+	}
+}
+
+// owns reports whether objectID falls in the part of the ring this peer is
+// responsible for, from just after its predecessor up to itself. The lowest
+// peer also owns the objects past the highest one, so a request entering the
+// ring at any peer reaches its owner.
+func (p *Peer) owns(objectID int) bool {
+	predecessor := p.rangeStart()
+	if predecessor.ID == "" {
+		// Not linked yet, fall back to comparing against this peer alone
+		return objectID <= ringPosition(p.ID)
+	}
+	return between(objectID, ringPosition(predecessor.ID), ringPosition(p.ID))
+}
+
+// redirect answers a direct request for an object this peer does not own with
+// WRONG_OWNER, naming the successor when the object belongs to it.
+func (p *Peer) redirect(ctx context.Context, request *communication.RequestMessage) {
+	var owner communication.NodeInfo
+	if _, successor := p.GetNeighbors(); successor.ID != "" && between(request.ObjectID, ringPosition(p.ID), ringPosition(successor.ID)) {
+		owner = successor
+	}
+	byteMessage, err := communication.GetWrongOwnerMessage(request.ReqID, request.ObjectID, owner)
+	if err != nil {
+		p.requestLogger(request).Error("Failed to encode message", "msg_type", communication.WRONG_OWNER, "err", err)
+		return
+	}
+	if err := p.communicator.SendMessage(ctx, request.ReplyTo, byteMessage); err != nil {
+		p.requestLogger(request).Warn("Failed to redirect client", "address", request.ReplyTo, "err", err)
+		return
+	}
+	requestsRedirected.Inc(request.OperationType.String())
+}
+
+// Layout returns the peers this peer knows of: itself and its ring links.
+func (p *Peer) Layout() []communication.NodeInfo {
+	layout := []communication.NodeInfo{p.self()}
+	predecessor, successor := p.GetNeighbors()
+	for _, neighbor := range []communication.NodeInfo{predecessor, successor} {
+		if neighbor.ID != "" && !slices.Contains(layout, neighbor) {
+			layout = append(layout, neighbor)
+		}
+	}
+	return layout
+}
+
+// forward runs ForwardRequest and reports a failure.
+func (p *Peer) forward(ctx context.Context, request *communication.RequestMessage) {
+	if err := p.ForwardRequest(ctx, request); err != nil {
+		p.requestLogger(request).Warn("Failed to forward request", "err", err)
 	}
 }
 
 // ForwardRequest forwards a lookup/store request to the appropriate peer in the ring.
-func (p *Peer) ForwardRequest(reqID, clientID, objectID int, operationType communication.OperationType) {
+// The request is passed on unchanged so the owning peer can check its signature.
+func (p *Peer) ForwardRequest(ctx context.Context, request *communication.RequestMessage) error {
 	// Get the successor of the peer
-	successor := p.Successor
-	if successor == "" {
-		fmt.Println("No successor found")
-		return
+	_, successor := p.GetNeighbors()
+	if successor.Address == "" {
+		return fmt.Errorf("no successor found")
 	}
 
 	// Send the request to the successor
-	requestMessage, err := communication.GetRequestMessage(reqID, operationType, objectID, clientID)
-	if err == nil {
-		p.communicator.SendMessage(successor, requestMessage)
-	} else {
-		fmt.Println("Error encoding request message:", err)
+	p.requestLogger(request).Debug("Forwarding request", "peer", successor.ID)
+	requestMessage, err := communication.EncodeRequestMessage(request)
+	if err != nil {
+		return fmt.Errorf("encoding request message: %w", err)
+	}
+	if err := p.communicator.SendMessage(ctx, successor.Address, requestMessage); err != nil {
+		return fmt.Errorf("forwarding request %d to successor %s: %w", request.ReqID, successor.ID, err)
 	}
+	requestsForwarded.Inc(request.OperationType.String())
+	return nil
 }
@@ -0,0 +1,292 @@
+package peer
+
+import (
+	"context"
+	"dht/communication"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ringPosition returns where a node ID sits on the ring
+func ringPosition(id string) int {
+	position, _ := strconv.Atoi(strings.TrimPrefix(id, "n"))
+	return position
+}
+
+// between reports whether position lies after from and up to and including
+// to, going clockwise around the ring. When from equals to it covers the whole ring.
+func between(position, from, to int) bool {
+	if from < to {
+		return from < position && position <= to
+	}
+	return position > from || position <= to
+}
+
+// strictlyBetween is between without the upper end
+func strictlyBetween(position, from, to int) bool {
+	return position != to && between(position, from, to)
+}
+
+func (p *Peer) self() communication.NodeInfo {
+	return communication.NodeInfo{ID: p.ID, Address: p.Address}
+}
+
+// HandleJoin links a joining node in when it belongs between this peer and
+// its successor, and otherwise passes the JOIN on around the ring. The joiner
+// is told its links; stabilization then tells this peer and the successor.
+func (p *Peer) HandleJoin(ctx context.Context, join *communication.JoinMessage) {
+	self := p.self()
+	_, successor := p.GetNeighbors()
+	if successor.ID == "" {
+		// Not linked yet, so the ring is just this peer
+		successor = self
+	}
+
+	position := ringPosition(join.PeerID)
+	if join.PeerID != self.ID && join.PeerID != successor.ID &&
+		!between(position, ringPosition(self.ID), ringPosition(successor.ID)) {
+		// Pass it on unchanged so the owner can still check the MAC
+		joinMessage, err := communication.EncodeJoinMessage(join)
+		if err != nil {
+			p.logger.Error("Failed to encode message", "msg_type", communication.JOIN, "err", err)
+			return
+		}
+		if err := p.communicator.SendMessage(ctx, successor.Address, joinMessage); err != nil {
+			p.logger.Warn("Failed to forward join", "joiner", join.PeerID, "peer", successor.ID, "err", err)
+		}
+		return
+	}
+
+	err := communication.ValidateJoin(p.joinSecret, join, time.Now(), p.joinMaxSkew, p.seenNonces)
+	if err == nil && (position == ringPosition(self.ID) || position == ringPosition(successor.ID)) {
+		if join.Address == self.Address || join.Address == successor.Address {
+			// Already in the ring, stabilization keeps its links up to date
+			return
+		}
+		err = fmt.Errorf("peer ID %s already in use", join.PeerID)
+	}
+	if err != nil {
+		p.logger.Warn("Rejecting join", "joiner", join.PeerID, "address", join.Address, "err", err)
+		if _, _, addrErr := net.SplitHostPort(join.Address); addrErr != nil {
+			// Nowhere to send the rejection
+			return
+		}
+		rejectMessage, encodeErr := communication.GetJoinRejectedMessage(join.PeerID, err.Error())
+		if encodeErr != nil {
+			p.logger.Error("Failed to encode message", "msg_type", communication.JOIN_REJECTED, "err", encodeErr)
+		} else if sendErr := p.communicator.SendMessage(ctx, join.Address, rejectMessage); sendErr != nil {
+			p.logger.Warn("Failed to send join rejection", "joiner", join.PeerID, "err", sendErr)
+		}
+		return
+	}
+
+	ringMessage, err := communication.GetRingMessage(self, successor)
+	if err != nil {
+		p.logger.Error("Failed to encode message", "msg_type", communication.RING, "err", err)
+		return
+	}
+	if err := p.communicator.SendMessage(ctx, join.Address, ringMessage); err != nil {
+		p.logger.Warn("Failed to send links to joiner", "joiner", join.PeerID, "err", err)
+	}
+}
+
+// Stabilize periodically checks that the successor is still the closest node
+// after this peer and reminds it that this peer is its predecessor.
+func (p *Peer) Stabilize(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if p.left.Load() {
+			// Reminding the successor would undo the LEAVE
+			return
+		}
+		p.stabilize()
+	}
+}
+
+func (p *Peer) stabilize() {
+	self := p.self()
+	predecessor, successor := p.GetNeighbors()
+	if successor.ID == "" {
+		// Not linked into a ring yet
+		return
+	}
+	if successor.ID == self.ID {
+		// Alone in the ring, so whoever notified this peer is its successor as well
+		if predecessor.ID != "" && predecessor.ID != self.ID {
+			p.setSuccessor(predecessor)
+		}
+		return
+	}
+
+	stabilizeMessage, err := communication.GetStabilizeMessage(self)
+	if err != nil {
+		p.logger.Error("Failed to encode message", "msg_type", communication.STABILIZE, "err", err)
+		return
+	}
+	if err := p.communicator.SendMessage(context.Background(), successor.Address, stabilizeMessage); err != nil {
+		p.logger.Warn("Failed to stabilize with successor", "peer", successor.ID, "err", err)
+	}
+}
+
+// HandleStabilize tells the asking peer who this peer's predecessor is
+func (p *Peer) HandleStabilize(ctx context.Context, message *communication.StabilizeMessage) {
+	predecessor, _ := p.GetNeighbors()
+	replyMessage, err := communication.GetStabilizeReplyMessage(p.self(), predecessor)
+	if err != nil {
+		p.logger.Error("Failed to encode message", "msg_type", communication.STABILIZE_REPLY, "err", err)
+		return
+	}
+	if err := p.communicator.SendMessage(ctx, message.From.Address, replyMessage); err != nil {
+		p.logger.Warn("Failed to answer stabilize", "peer", message.From.ID, "err", err)
+	}
+}
+
+// HandleStabilizeReply moves the successor to a node that joined in between,
+// then notifies the successor.
+func (p *Peer) HandleStabilizeReply(ctx context.Context, message *communication.StabilizeReplyMessage) {
+	self := p.self()
+	_, successor := p.GetNeighbors()
+	if message.From.ID != successor.ID {
+		// The successor changed since the question was asked
+		return
+	}
+	candidate := message.Predecessor
+	if candidate.ID != "" && candidate.ID != self.ID &&
+		strictlyBetween(ringPosition(candidate.ID), ringPosition(self.ID), ringPosition(successor.ID)) {
+		p.setSuccessor(candidate)
+		successor = candidate
+	}
+
+	notifyMessage, err := communication.GetNotifyMessage(self)
+	if err != nil {
+		p.logger.Error("Failed to encode message", "msg_type", communication.NOTIFY, "err", err)
+		return
+	}
+	if err := p.communicator.SendMessage(ctx, successor.Address, notifyMessage); err != nil {
+		p.logger.Warn("Failed to notify successor", "peer", successor.ID, "err", err)
+	}
+}
+
+// HandleNotify takes the sender as predecessor if it is closer than the current one
+func (p *Peer) HandleNotify(message *communication.NotifyMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	candidate := message.From
+	if candidate.ID == p.ID || candidate.ID == p.Predecessor.ID {
+		return
+	}
+	if p.Predecessor.ID == "" || p.Predecessor.ID == p.ID ||
+		strictlyBetween(ringPosition(candidate.ID), ringPosition(p.Predecessor.ID), ringPosition(p.ID)) {
+		p.Predecessor = candidate
+		p.logLinks()
+	}
+}
+
+func (p *Peer) setSuccessor(successor communication.NodeInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Successor = successor
+	p.logLinks()
+}
+
+// HandleFindSuccessor answers with itself when this peer owns a ring
+// position, and otherwise with its successor: the owner, or the next peer to
+// ask. The asker walks the ring, so no peer waits on another to answer.
+func (p *Peer) HandleFindSuccessor(ctx context.Context, message *communication.FindSuccessorMessage, respond communication.Responder) {
+	self := p.self()
+	_, successor := p.GetNeighbors()
+	answer := successor
+	if p.owns(message.Position) || successor.ID == "" || successor.ID == self.ID {
+		answer = self
+	}
+
+	replyMessage, err := communication.GetSuccessorMessage(message.RequestID, message.Position, answer)
+	if err != nil {
+		p.logger.Error("Failed to encode message", "msg_type", communication.SUCCESSOR, "err", err)
+		return
+	}
+	if err := respond(ctx, replyMessage); err != nil {
+		p.logger.Warn("Failed to answer find successor", "req_id", message.RequestID, "err", err)
+	}
+}
+
+// HandleGetPredecessor tells the asker who this peer's predecessor is
+func (p *Peer) HandleGetPredecessor(ctx context.Context, message *communication.PredecessorRequestMessage, respond communication.Responder) {
+	predecessor, _ := p.GetNeighbors()
+	replyMessage, err := communication.GetPredecessorMessage(message.RequestID, p.self(), predecessor)
+	if err != nil {
+		p.logger.Error("Failed to encode message", "msg_type", communication.PREDECESSOR, "err", err)
+		return
+	}
+	if err := respond(ctx, replyMessage); err != nil {
+		p.logger.Warn("Failed to answer get predecessor", "req_id", message.RequestID, "err", err)
+	}
+}
+
+// Leave tells the peer's neighbors and the bootstrap that it is leaving, so
+// the neighbors link to each other and the bootstrap drops it from the ring.
+// Objects stored here are not handed over.
+func (p *Peer) Leave(ctx context.Context) error {
+	p.left.Store(true)
+	self := p.self()
+	predecessor, successor := p.GetNeighbors()
+	leaveMessage, err := communication.GetLeaveMessage(self, predecessor, successor, p.joinSecret)
+	if err != nil {
+		return err
+	}
+
+	neighbors := []communication.NodeInfo{predecessor}
+	if successor.ID != predecessor.ID {
+		neighbors = append(neighbors, successor)
+	}
+	var errs []error
+	for _, neighbor := range neighbors {
+		if neighbor.ID == "" || neighbor.ID == self.ID {
+			continue
+		}
+		if err := p.communicator.SendMessage(ctx, neighbor.Address, leaveMessage); err != nil {
+			errs = append(errs, fmt.Errorf("telling %s: %w", neighbor.ID, err))
+		}
+	}
+	if len(p.bootstrap.Addresses()) > 0 {
+		if err := p.bootstrap.Send(ctx, p.communicator, leaveMessage); err != nil {
+			errs = append(errs, fmt.Errorf("telling the bootstrap: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// HandleLeave links past a neighbor that is leaving the ring
+func (p *Peer) HandleLeave(leave *communication.LeaveMessage) {
+	if err := communication.ValidateLeave(p.joinSecret, leave, time.Now(), p.joinMaxSkew, p.seenNonces); err != nil {
+		p.logger.Warn("Ignoring leave", "peer", leave.Node.ID, "err", err)
+		return
+	}
+	self := p.self()
+	predecessor, successor := p.GetNeighbors()
+	if predecessor.ID != leave.Node.ID && successor.ID != leave.Node.ID {
+		return
+	}
+	if predecessor.ID == leave.Node.ID {
+		predecessor = leave.Predecessor
+	}
+	if successor.ID == leave.Node.ID {
+		successor = leave.Successor
+	}
+	if successor.ID == "" {
+		// The leaving peer had no successor to pass on, which leaves this one alone
+		successor = self
+	}
+	p.logger.Info("Neighbor is leaving the ring", "peer", leave.Node.ID)
+	p.UpdateLinks(predecessor, successor)
+}
+
+// Flush makes sure every object stored here has reached the disk
+func (p *Peer) Flush() error {
+	return p.store.Flush()
+}
@@ -0,0 +1,165 @@
+package peer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Entry is one object held by a peer, keyed by the client that stored it.
+type Entry struct {
+	ClientID int
+	ObjectID int
+}
+
+func (e Entry) String() string {
+	return fmt.Sprintf("%d::%d", e.ClientID, e.ObjectID)
+}
+
+// parseEntry reads the clientID::objectID form used in store files.
+func parseEntry(line string) (Entry, bool) {
+	parts := strings.Split(line, "::")
+	if len(parts) != 2 {
+		return Entry{}, false
+	}
+	clientID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Entry{}, false
+	}
+	objectID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Entry{}, false
+	}
+	return Entry{ClientID: clientID, ObjectID: objectID}, true
+}
+
+// Store persists the objects owned by a peer.
+type Store interface {
+	// Add records an entry.
+	Add(entry Entry) error
+	// Contains reports whether an entry has been recorded.
+	Contains(entry Entry) (bool, error)
+	// Entries lists every recorded entry in insertion order.
+	Entries() ([]Entry, error)
+	// Flush makes sure every recorded entry has reached the disk.
+	Flush() error
+	// Size returns how many bytes the entries take up on disk.
+	Size() (int64, error)
+}
+
+// FileStore keeps one clientID::objectID line per entry in a plain text file.
+type FileStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileStore returns a store backed by the file at path, which is created on first write.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+func (s *FileStore) Add(entry Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Open the file in append mode, create if not exists
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(entry.String() + "\n")
+	return err
+}
+
+func (s *FileStore) Contains(entry Entry) (bool, error) {
+	entries, err := s.Entries()
+	if err != nil {
+		return false, err
+	}
+	for _, stored := range entries {
+		if stored == entry {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *FileStore) Entries() ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lines, err := readLines(s.path)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(lines))
+	for _, line := range lines {
+		if entry, ok := parseEntry(line); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (s *FileStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return syncFile(s.path)
+}
+
+func (s *FileStore) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fileSize(s.path)
+}
+
+// fileSize returns the size of a file, or 0 if it does not exist yet.
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// syncFile flushes a file to disk, if it exists yet.
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// readLines returns the lines of a file, or nothing if it does not exist yet.
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
@@ -1,15 +1,277 @@
 package util
 
-import "flag"
+import (
+	"dht/communication"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
 
-func ParseFlags() (string, string, float64, int) {
-	bootstrap := flag.String("b", "", "Bootstrap server")
+// Config holds the per-node settings parsed from the command line.
+type Config struct {
+	ID                 string   // Node identity, defaults to the hostname
+	BootstrapAddresses []string // host:port of each bootstrap server, tried in order
+	ObjectFile         string   // Object file path
+	Delay              float64  // Initial delay in seconds
+	Testcase           int      // Testcase object ID
+	ListenAddress      string   // host:port to accept connections on
+	AdvertiseAddress   string   // host:port other nodes use to reach this node
+	Network            communication.Options
+	Dispatch           communication.DispatchOptions
+	TLSCert            string        // PEM certificate naming this node, enables mutual TLS
+	TLSKey             string        // PEM private key for TLSCert
+	TLSCA              string        // PEM CA bundle that peer certificates must chain to
+	JoinSecretFile     string        // File holding the shared secret JOINs are signed with
+	JoinMaxSkew        time.Duration // Accepted age of a signed JOIN at the bootstrap
+	AccessPolicyFile   string        // Peers: JSON policy of API keys allowed to use stored objects
+	APIKeyID           string        // Clients: API key to sign requests with
+	APIKeyFile         string        // Clients: file holding the API key's secret
+	StoreEngine        string        // Peers: "file" for plain text objects, "encrypted" to seal them with StoreKeyFile
+	StoreKeyFile       string        // Peers: AES key file for the encrypted store
+	RotateStoreKey     bool          // Peers: re-encrypt the object store with the newest key at startup
+	StateDir           string        // Bootstrap: directory the ring is persisted in, empty to keep it in memory
+	PeerProbeTimeout   time.Duration // Bootstrap: how long a recovered peer has to answer at startup
+	Replicas           string        // Bootstrap: id=host:port list of every bootstrap replica, empty for a single bootstrap
+	ElectionTimeout    time.Duration // Bootstrap: how long replicas wait for the leader before electing a new one
+	ReplicaSecretFile  string        // Bootstrap: file holding the secret replicas sign their messages with when not using TLS
+	Seeds              []string      // Peers: host:port of ring members to join through instead of the bootstrap
+	StabilizeInterval  time.Duration // Peers: how often links are checked with the successor, 0 to disable
+	GossipInterval     time.Duration // Peers: how often a member is probed for the membership list, 0 to disable
+	EntryPeers         []string      // Clients: host:port of peers to send requests to instead of the bootstrap
+	RouteCache         bool          // Clients: cache the ring layout and send requests straight to the owning peer
+	Lookup             string        // Clients: "recursive" to let peers forward requests, "iterative" to find the owner first
+	Trace              bool          // Clients: print the path each request took
+	ShutdownTimeout    time.Duration // How long a node has to wind down after SIGTERM
+	LogLevel           string        // Least severe log level written: debug, info, warn or error
+	LogFormat          string        // Log line format: text (logfmt) or json
+	MetricsAddress     string        // Where /metrics is served over HTTP, empty to serve no metrics
+}
+
+// ParseFlags reads the configuration from the command line and from the
+// config file named by -config, whose settings apply to the flags not given.
+func ParseFlags() Config {
+	hostname, _ := os.Hostname()
+
+	configFile := flag.String("config", "", "JSON config file, flags given on the command line override its settings")
+	id := flag.String("id", hostname, "Node ID")
+	bootstrap := flag.String("b", "", "Bootstrap server addresses (host[:port]), comma separated")
 	objectFile := flag.String("o", "", "Object file path")
 	timeDelay := flag.Float64("d", 0.0, "Initial delay")
 	testcase := flag.Int("t", 0, "Testcase object ID")
+	listenAddress := flag.String("l", ":"+communication.DefaultPort, "Listen address (host:port)")
+	advertiseAddress := flag.String("a", "", "Advertised address (host:port), defaults to <id>:<listen port>")
+	network := communication.DefaultOptions()
+	flag.DurationVar(&network.Dial.Timeout, "dial-timeout", network.Dial.Timeout, "Timeout for a single dial attempt")
+	flag.IntVar(&network.Dial.MaxAttempts, "dial-attempts", network.Dial.MaxAttempts, "Dial attempts before a send fails")
+	flag.DurationVar(&network.Dial.BaseDelay, "dial-backoff", network.Dial.BaseDelay, "Initial backoff between dial attempts")
+	flag.DurationVar(&network.Dial.MaxDelay, "dial-max-backoff", network.Dial.MaxDelay, "Maximum backoff between dial attempts")
+	flag.IntVar(&network.Connection.QueueSize, "send-queue", network.Connection.QueueSize, "Outbound frames queued per connection")
+	flag.DurationVar(&network.Connection.WriteTimeout, "write-timeout", network.Connection.WriteTimeout, "Deadline for writing a single frame")
+	flag.DurationVar(&network.Connection.KeepAlive, "keepalive", network.Connection.KeepAlive, "TCP keepalive period")
+	flag.DurationVar(&network.Connection.HandshakeTimeout, "handshake-timeout", network.Connection.HandshakeTimeout, "Time allowed for the HELLO exchange")
+	flag.DurationVar(&network.Connection.CallTimeout, "call-timeout", network.Connection.CallTimeout, "How long a call waits for its reply, and a message handler for what it sends")
+	maxFrameSize := flag.Uint("max-frame", uint(network.Connection.MaxFrameSize), "Largest frame payload accepted, in bytes")
+	flag.IntVar(&network.Connection.MaxProtocolErrors, "max-protocol-errors", network.Connection.MaxProtocolErrors, "Protocol errors tolerated per connection before disconnecting")
+	flag.DurationVar(&network.Connection.Quarantine, "quarantine", network.Connection.Quarantine, "How long a misbehaving sender is refused")
+	flag.DurationVar(&network.Connection.IdleTimeout, "idle-timeout", network.Connection.IdleTimeout, "Close outgoing connections idle for this long, 0 to disable")
+
+	dispatch := communication.DefaultDispatchOptions()
+	flag.IntVar(&dispatch.QueueSize, "dispatch-queue", dispatch.QueueSize, "Incoming messages queued per message type")
+	flag.IntVar(&dispatch.Workers, "dispatch-workers", dispatch.Workers, "Messages of one type handled at the same time")
+	overload := flag.String("overload", dispatch.Overload.String(), "What to do with a message whose queue is full: block or reject")
+
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file, enables mutual TLS")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	tlsCA := flag.String("tls-ca", "", "TLS CA bundle for verifying other nodes")
+
+	joinSecretFile := flag.String("join-secret-file", "", "File with the shared secret for signing and checking JOINs")
+	joinMaxSkew := flag.Duration("join-max-skew", 5*time.Minute, "Accepted clock difference for signed JOINs")
+
+	accessPolicyFile := flag.String("access-policy", "", "JSON access policy enforced by peers")
+	apiKeyID := flag.String("api-key-id", "", "API key ID clients sign requests with")
+	apiKeyFile := flag.String("api-key-file", "", "File with the API key secret")
+
+	storeEngine := flag.String("store-engine", "", "Object store: file or encrypted, defaults to encrypted when a store key file is given")
+	storeKeyFile := flag.String("store-key-file", "", "Key file for encrypting the object store at rest")
+	rotateStoreKey := flag.Bool("rotate-store-key", false, "Re-encrypt the object store with the newest key at startup")
+
+	stateDir := flag.String("state-dir", "", "Directory where the bootstrap persists the ring")
+	peerProbeTimeout := flag.Duration("peer-probe-timeout", 3*time.Second, "Time a recovered peer has to answer before it is dropped from the ring")
+
+	replicas := flag.String("replicas", "", "Bootstrap replicas as id=host:port, comma separated, including this one")
+	electionTimeout := flag.Duration("election-timeout", time.Second, "Time without a leader before bootstrap replicas hold an election")
+	replicaSecretFile := flag.String("replica-secret-file", "", "File with the secret bootstrap replicas share to authenticate each other without TLS")
+
+	seeds := flag.String("seeds", "", "Peer addresses (host[:port]) to join the ring through, comma separated")
+	stabilizeInterval := flag.Duration("stabilize-interval", time.Second, "How often peers check their links with their successor, 0 to disable")
+	gossipInterval := flag.Duration("gossip-interval", time.Second, "How often peers probe another member to gossip ring membership, 0 to disable")
+
+	entryPeers := flag.String("entry", "", "Peer addresses (host[:port]) clients send requests to instead of the bootstrap, comma separated")
+
+	routeCache := flag.Bool("route-cache", false, "Cache the ring layout in clients and send requests straight to the owning peer")
+
+	lookup := flag.String("lookup", "recursive", "How clients find the owner of an object: recursive or iterative")
+
+	trace := flag.Bool("trace", false, "Trace the peers each client request passes through and print the path with the result")
+
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "How long to finish in-flight work and leave the ring after SIGTERM")
+
+	logLevel := flag.String("log-level", "info", "Least severe log level written: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log format: text for logfmt, or json")
+	metricsAddress := flag.String("metrics-address", "", "Address to serve Prometheus metrics on at /metrics, such as :9090, empty to serve none")
 
 	// Parse command-line flags
 	flag.Parse()
+	if *configFile != "" {
+		if err := loadConfigFile(*configFile, flag.CommandLine); err != nil {
+			fmt.Fprintln(os.Stderr, "Error loading config:", err)
+			os.Exit(2)
+		}
+	}
+	network.Connection.MaxFrameSize = uint32(min(*maxFrameSize, math.MaxUint32))
+	// Handlers send under the same limit as calls, so a dead node can't hold up a worker for long
+	dispatch.Timeout = network.Connection.CallTimeout
+	var err error
+	if dispatch.Overload, err = communication.ParseOverloadPolicy(*overload); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config := Config{
+		ID:                *id,
+		ObjectFile:        *objectFile,
+		Delay:             *timeDelay,
+		Testcase:          *testcase,
+		ListenAddress:     communication.NormalizeAddress(*listenAddress),
+		AdvertiseAddress:  *advertiseAddress,
+		Network:           network,
+		Dispatch:          dispatch,
+		TLSCert:           *tlsCert,
+		TLSKey:            *tlsKey,
+		TLSCA:             *tlsCA,
+		JoinSecretFile:    *joinSecretFile,
+		JoinMaxSkew:       *joinMaxSkew,
+		AccessPolicyFile:  *accessPolicyFile,
+		APIKeyID:          *apiKeyID,
+		APIKeyFile:        *apiKeyFile,
+		StoreEngine:       *storeEngine,
+		StoreKeyFile:      *storeKeyFile,
+		RotateStoreKey:    *rotateStoreKey,
+		StateDir:          *stateDir,
+		PeerProbeTimeout:  *peerProbeTimeout,
+		Replicas:          *replicas,
+		ElectionTimeout:   *electionTimeout,
+		ReplicaSecretFile: *replicaSecretFile,
+		StabilizeInterval: *stabilizeInterval,
+		GossipInterval:    *gossipInterval,
+		RouteCache:        *routeCache,
+		Lookup:            *lookup,
+		Trace:             *trace,
+		ShutdownTimeout:   *shutdownTimeout,
+		LogLevel:          *logLevel,
+		LogFormat:         *logFormat,
+		MetricsAddress:    *metricsAddress,
+	}
+	config.BootstrapAddresses = splitAddresses(*bootstrap)
+	config.Seeds = splitAddresses(*seeds)
+	config.EntryPeers = splitAddresses(*entryPeers)
+	if config.StoreEngine == "" {
+		config.StoreEngine = "file"
+		if config.StoreKeyFile != "" {
+			config.StoreEngine = "encrypted"
+		}
+	}
+
+	if config.AdvertiseAddress == "" {
+		// Reuse the listen port under the node ID, which matches the container hostname
+		_, port, err := net.SplitHostPort(config.ListenAddress)
+		if err != nil {
+			port = communication.DefaultPort
+		}
+		config.AdvertiseAddress = net.JoinHostPort(config.ID, port)
+	} else {
+		config.AdvertiseAddress = communication.NormalizeAddress(config.AdvertiseAddress)
+	}
+
+	return config
+}
+
+// splitAddresses parses a comma separated list of addresses
+func splitAddresses(list string) []string {
+	var addresses []string
+	for _, address := range strings.Split(list, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, communication.NormalizeAddress(address))
+		}
+	}
+	return addresses
+}
+
+// IsClient reports whether the node runs as a client
+func (c Config) IsClient() bool {
+	return c.ID == "client"
+}
+
+// IsBootstrap reports whether the node runs as a bootstrap server, alone or as one of the replicas
+func (c Config) IsBootstrap() bool {
+	return c.ID == "bootstrap" || c.Replicas != ""
+}
+
+// ReplicaSet parses the bootstrap replica list, or returns nil when the bootstrap is not replicated.
+func (c Config) ReplicaSet() ([]communication.NodeInfo, error) {
+	var replicas []communication.NodeInfo
+	for _, replica := range strings.Split(c.Replicas, ",") {
+		if replica = strings.TrimSpace(replica); replica == "" {
+			continue
+		}
+		id, address, ok := strings.Cut(replica, "=")
+		if !ok || id == "" || address == "" {
+			return nil, fmt.Errorf("invalid replica %q, expected id=host:port", replica)
+		}
+		replicas = append(replicas, communication.NodeInfo{ID: id, Address: communication.NormalizeAddress(address)})
+	}
+	if len(replicas) > 0 && !slices.ContainsFunc(replicas, func(replica communication.NodeInfo) bool { return replica.ID == c.ID }) {
+		return nil, fmt.Errorf("node %s is not in the replica list", c.ID)
+	}
+	return replicas, nil
+}
+
+// JoinSecret reads the shared JOIN secret, or returns nil when none is configured.
+func (c Config) JoinSecret() ([]byte, error) {
+	return readSecretFile(c.JoinSecretFile)
+}
+
+// ReplicaSecret reads the secret bootstrap replicas share, or returns nil when none is configured.
+func (c Config) ReplicaSecret() ([]byte, error) {
+	return readSecretFile(c.ReplicaSecretFile)
+}
+
+// APIKeySecret reads the client's API key secret, or returns nil when none is configured.
+func (c Config) APIKeySecret() ([]byte, error) {
+	if c.APIKeyID != "" && c.APIKeyFile == "" {
+		return nil, fmt.Errorf("API key %s has no secret file", c.APIKeyID)
+	}
+	return readSecretFile(c.APIKeyFile)
+}
 
-	return *bootstrap, *objectFile, *timeDelay, *testcase
+// readSecretFile returns the trimmed contents of a secret file, or nil for an empty path.
+func readSecretFile(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret := strings.TrimSpace(string(content))
+	if secret == "" {
+		return nil, fmt.Errorf("secret file %s is empty", path)
+	}
+	return []byte(secret), nil
 }
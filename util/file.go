@@ -0,0 +1,190 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fileSettings maps each setting of a config file, by its dotted path, to the
+// flag it stands for. Values go through the flag's own parsing, so a file and
+// the command line accept exactly the same values.
+var fileSettings = map[string]string{
+	"id":    "id",
+	"delay": "d",
+
+	"addresses.listen":    "l",
+	"addresses.advertise": "a",
+	"addresses.bootstrap": "b",
+	"addresses.seeds":     "seeds",
+	"addresses.entry":     "entry",
+
+	"storage.engine":     "store-engine",
+	"storage.path":       "o",
+	"storage.key_file":   "store-key-file",
+	"storage.rotate_key": "rotate-store-key",
+
+	"replication.replicas":           "replicas",
+	"replication.state_dir":          "state-dir",
+	"replication.election_timeout":   "election-timeout",
+	"replication.secret_file":        "replica-secret-file",
+	"replication.peer_probe_timeout": "peer-probe-timeout",
+
+	"ring.stabilize_interval": "stabilize-interval",
+	"ring.gossip_interval":    "gossip-interval",
+
+	"network.dial_timeout":        "dial-timeout",
+	"network.dial_attempts":       "dial-attempts",
+	"network.dial_backoff":        "dial-backoff",
+	"network.dial_max_backoff":    "dial-max-backoff",
+	"network.send_queue":          "send-queue",
+	"network.write_timeout":       "write-timeout",
+	"network.keepalive":           "keepalive",
+	"network.handshake_timeout":   "handshake-timeout",
+	"network.call_timeout":        "call-timeout",
+	"network.idle_timeout":        "idle-timeout",
+	"network.max_frame":           "max-frame",
+	"network.max_protocol_errors": "max-protocol-errors",
+	"network.quarantine":          "quarantine",
+
+	"dispatch.queue":    "dispatch-queue",
+	"dispatch.workers":  "dispatch-workers",
+	"dispatch.overload": "overload",
+
+	"tls.cert": "tls-cert",
+	"tls.key":  "tls-key",
+	"tls.ca":   "tls-ca",
+
+	"security.join_secret_file": "join-secret-file",
+	"security.join_max_skew":    "join-max-skew",
+	"security.access_policy":    "access-policy",
+	"security.api_key_id":       "api-key-id",
+	"security.api_key_file":     "api-key-file",
+
+	"client.testcase":    "t",
+	"client.route_cache": "route-cache",
+	"client.lookup":      "lookup",
+	"client.trace":       "trace",
+
+	"log.level":  "log-level",
+	"log.format": "log-format",
+
+	"metrics.address": "metrics-address",
+
+	"shutdown_timeout": "shutdown-timeout",
+}
+
+// loadConfigFile applies the settings in the JSON config file at path to the
+// flags that were not given on the command line, which take precedence.
+func loadConfigFile(path string, flags *flag.FlagSet) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var settings map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&settings); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var errs []error
+	walkSettings("", settings, func(key string, value interface{}) {
+		name, ok := fileSettings[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown setting %q", key))
+			return
+		}
+		if explicit[name] {
+			return
+		}
+		text, err := settingText(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		} else if err := flags.Set(name, text); err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid value %q for -%s: %w", key, text, name, err))
+		}
+	})
+	if len(errs) > 0 {
+		return fmt.Errorf("%s: %w", path, errors.Join(errs...))
+	}
+	return nil
+}
+
+// walkSettings calls visit for every value in a settings tree, in key order,
+// with the dotted path leading to it.
+func walkSettings(prefix string, settings map[string]interface{}, visit func(key string, value interface{})) {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		if section, ok := settings[key].(map[string]interface{}); ok {
+			walkSettings(path, section, visit)
+		} else {
+			visit(path, settings[key])
+		}
+	}
+}
+
+// settingText turns a JSON value into the text the matching flag parses.
+// Lists become the comma separated form the address flags take.
+func settingText(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			text, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("expected a list of strings")
+			}
+			items = append(items, text)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
+
+// WriteFileAtomic replaces the file at path with content so that a crash
+// leaves either the old or the new file, never a mix of the two.
+func WriteFileAtomic(path string, content []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name()) // No-op once renamed
+	if _, err := temp.Write(content); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
@@ -0,0 +1,137 @@
+package util
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFlags holds a few flags of each kind a config file can set
+type testFlags struct {
+	set      *flag.FlagSet
+	id       *string
+	seeds    *string
+	workers  *int
+	timeout  *time.Duration
+	trace    *bool
+	overload *string
+}
+
+func newTestFlags() *testFlags {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.SetOutput(io.Discard)
+	return &testFlags{
+		set:      set,
+		id:       set.String("id", "host", ""),
+		seeds:    set.String("seeds", "", ""),
+		workers:  set.Int("dispatch-workers", 4, ""),
+		timeout:  set.Duration("call-timeout", time.Second, ""),
+		trace:    set.Bool("trace", false, ""),
+		overload: set.String("overload", "block", ""),
+	}
+}
+
+// writeConfig writes content to a config file and returns its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "node.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	flags := newTestFlags()
+	path := writeConfig(t, `{
+		"id": "n5",
+		"addresses": {"seeds": ["n1:8888", "n66:8888"]},
+		"dispatch": {"workers": 8, "overload": "reject"},
+		"network": {"call_timeout": "3s"},
+		"client": {"trace": true}
+	}`)
+	if err := loadConfigFile(path, flags.set); err != nil {
+		t.Fatal(err)
+	}
+	if *flags.id != "n5" || *flags.seeds != "n1:8888,n66:8888" || *flags.workers != 8 ||
+		*flags.overload != "reject" || *flags.timeout != 3*time.Second || !*flags.trace {
+		t.Errorf("loaded id=%s seeds=%s workers=%d overload=%s timeout=%v trace=%v",
+			*flags.id, *flags.seeds, *flags.workers, *flags.overload, *flags.timeout, *flags.trace)
+	}
+}
+
+func TestLoadConfigFileKeepsCommandLineFlags(t *testing.T) {
+	flags := newTestFlags()
+	if err := flags.set.Parse([]string{"-id", "n30"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(writeConfig(t, `{"id": "n5", "dispatch": {"workers": 8}}`), flags.set); err != nil {
+		t.Fatal(err)
+	}
+	if *flags.id != "n30" {
+		t.Errorf("id = %s, want the command line's n30", *flags.id)
+	}
+	if *flags.workers != 8 {
+		t.Errorf("workers = %d, want the file's 8", *flags.workers)
+	}
+}
+
+func TestLoadConfigFileRejectsInvalidSettings(t *testing.T) {
+	tests := map[string]struct{ content, problem string }{
+		"unknown setting":   {`{"dispatch": {"threads": 8}}`, `unknown setting "dispatch.threads"`},
+		"flag without file": {`{"config": "other.json"}`, `unknown setting "config"`},
+		"invalid value":     {`{"dispatch": {"workers": "many"}}`, "dispatch.workers"},
+		"invalid duration":  {`{"network": {"call_timeout": 3}}`, "network.call_timeout"},
+		"mixed list":        {`{"addresses": {"seeds": ["n1:8888", 8888]}}`, "expected a list of strings"},
+		"null":              {`{"id": null}`, "unsupported value"},
+		"not JSON":          {`id = "n5"`, "invalid character"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := loadConfigFile(writeConfig(t, test.content), newTestFlags().set)
+			if err == nil {
+				t.Fatal("loaded the config file")
+			}
+			if !strings.Contains(err.Error(), test.problem) {
+				t.Errorf("err = %v, want %s", err, test.problem)
+			}
+		})
+	}
+}
+
+func TestFileSettingsNameExistingFlags(t *testing.T) {
+	// ParseFlags defines its flags on the global set, which only takes them once
+	if flag.Lookup("id") == nil {
+		oldArgs := os.Args
+		defer func() { os.Args = oldArgs }()
+		os.Args = []string{"dht"}
+		ParseFlags()
+	}
+	for setting, name := range fileSettings {
+		if flag.Lookup(name) == nil {
+			t.Errorf("%s maps to -%s, which is not a flag", setting, name)
+		}
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ring.snapshot")
+	for _, content := range []string{"first", "second"} {
+		if err := WriteFileAtomic(path, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(path); err != nil || string(got) != content {
+			t.Errorf("file holds %q, %v, want %q", got, err, content)
+		}
+	}
+	if leftovers, _ := filepath.Glob(path + ".*"); len(leftovers) != 0 {
+		t.Errorf("left %v behind", leftovers)
+	}
+	if err := WriteFileAtomic(filepath.Join(path, "missing", "file"), nil); err == nil {
+		t.Error("wrote into a directory that does not exist")
+	}
+}
@@ -0,0 +1,22 @@
+package util
+
+import (
+	"io"
+	"log/slog"
+)
+
+// Logger returns the node's structured logger, writing to w at the configured
+// level and format. Every line carries the node ID.
+func (c Config) Logger(w io.Writer) *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.LogLevel)) // Checked by Validate
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if c.LogFormat == "json" {
+		handler = slog.NewJSONHandler(w, options)
+	} else {
+		handler = slog.NewTextHandler(w, options)
+	}
+	return slog.New(handler).With("node_id", c.ID)
+}
@@ -0,0 +1,99 @@
+package util
+
+import (
+	"dht/communication"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// Validate checks that the configuration makes sense for the node's role and
+// reports every problem it finds, not just the first.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.ID != "", "id: must not be empty")
+	if !c.IsBootstrap() && !c.IsClient() {
+		check(communication.ValidPeerID(c.ID), "id: %q is not bootstrap or client, so it must be a peer ID of the form n<number>", c.ID)
+		check(c.ObjectFile != "", "storage.path (-o): peers need a file to store objects in")
+	}
+	check(c.Delay >= 0, "delay (-d): must not be negative")
+
+	for _, address := range []struct{ setting, value string }{
+		{"addresses.listen (-l)", c.ListenAddress},
+		{"addresses.advertise (-a)", c.AdvertiseAddress},
+	} {
+		_, _, err := net.SplitHostPort(address.value)
+		check(err == nil, "%s: %q is not host:port", address.setting, address.value)
+	}
+	if c.MetricsAddress != "" {
+		_, _, err := net.SplitHostPort(c.MetricsAddress)
+		check(err == nil, "metrics.address (-metrics-address): %q is not host:port", c.MetricsAddress)
+	}
+
+	switch c.StoreEngine {
+	case "file":
+		check(c.StoreKeyFile == "", "storage.engine: a key file is set but the engine is file, use encrypted")
+	case "encrypted":
+		check(c.StoreKeyFile != "", "storage.key_file (-store-key-file): required by the encrypted engine")
+	default:
+		check(false, "storage.engine (-store-engine): unknown engine %q, expected file or encrypted", c.StoreEngine)
+	}
+	check(!c.RotateStoreKey || c.StoreEngine == "encrypted", "storage.rotate_key (-rotate-store-key): only the encrypted engine has keys to rotate")
+
+	if _, err := c.ReplicaSet(); err != nil {
+		check(false, "replication.replicas (-replicas): %v", err)
+	}
+
+	tlsSet := 0
+	for _, file := range []string{c.TLSCert, c.TLSKey, c.TLSCA} {
+		if file != "" {
+			tlsSet++
+		}
+	}
+	check(tlsSet == 0 || tlsSet == 3, "tls: cert, key and ca must be given together")
+	check(c.Replicas == "" || tlsSet == 3 || c.ReplicaSecretFile != "", "replication.secret_file (-replica-secret-file): replicas must authenticate each other with TLS or a shared secret")
+	check(c.APIKeyID == "" || c.APIKeyFile != "", "security.api_key_file (-api-key-file): required with an API key ID")
+
+	check(c.Lookup == "recursive" || c.Lookup == "iterative", "client.lookup (-lookup): unknown lookup mode %q, expected recursive or iterative", c.Lookup)
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.LogLevel)) == nil, "log.level (-log-level): unknown level %q, expected debug, info, warn or error", c.LogLevel)
+	check(c.LogFormat == "text" || c.LogFormat == "json", "log.format (-log-format): unknown format %q, expected text or json", c.LogFormat)
+
+	check(c.Network.Dial.MaxAttempts >= 1, "network.dial_attempts (-dial-attempts): must be at least 1")
+	check(c.Network.Connection.QueueSize >= 1, "network.send_queue (-send-queue): must be at least 1")
+	check(c.Dispatch.Workers >= 1, "dispatch.workers (-dispatch-workers): must be at least 1")
+	check(c.Dispatch.QueueSize >= 0, "dispatch.queue (-dispatch-queue): must not be negative")
+	for _, duration := range []struct {
+		setting string
+		value   time.Duration
+	}{
+		{"network.dial_timeout (-dial-timeout)", c.Network.Dial.Timeout},
+		{"network.dial_backoff (-dial-backoff)", c.Network.Dial.BaseDelay},
+		{"network.dial_max_backoff (-dial-max-backoff)", c.Network.Dial.MaxDelay},
+		{"network.write_timeout (-write-timeout)", c.Network.Connection.WriteTimeout},
+		{"network.keepalive (-keepalive)", c.Network.Connection.KeepAlive},
+		{"network.handshake_timeout (-handshake-timeout)", c.Network.Connection.HandshakeTimeout},
+		{"network.call_timeout (-call-timeout)", c.Network.Connection.CallTimeout},
+		{"network.idle_timeout (-idle-timeout)", c.Network.Connection.IdleTimeout},
+		{"network.quarantine (-quarantine)", c.Network.Connection.Quarantine},
+		{"security.join_max_skew (-join-max-skew)", c.JoinMaxSkew},
+		{"replication.election_timeout (-election-timeout)", c.ElectionTimeout},
+		{"replication.peer_probe_timeout (-peer-probe-timeout)", c.PeerProbeTimeout},
+		{"ring.stabilize_interval (-stabilize-interval)", c.StabilizeInterval},
+		{"ring.gossip_interval (-gossip-interval)", c.GossipInterval},
+		{"shutdown_timeout (-shutdown-timeout)", c.ShutdownTimeout},
+	} {
+		check(duration.value >= 0, "%s: must not be negative", duration.setting)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,116 @@
+package util
+
+import (
+	"dht/communication"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validPeer returns the configuration of a peer that passes validation
+func validPeer() Config {
+	return Config{
+		ID:               "n5",
+		ObjectFile:       "objects.txt",
+		ListenAddress:    ":8888",
+		AdvertiseAddress: "n5:8888",
+		Network:          communication.DefaultOptions(),
+		Dispatch:         communication.DefaultDispatchOptions(),
+		StoreEngine:      "file",
+		Lookup:           "recursive",
+		LogLevel:         "info",
+		LogFormat:        "text",
+	}
+}
+
+func TestValidateAcceptsDefaults(t *testing.T) {
+	if err := validPeer().Validate(); err != nil {
+		t.Error(err)
+	}
+	bootstrap := validPeer()
+	bootstrap.ID, bootstrap.ObjectFile = "bootstrap", ""
+	if err := bootstrap.Validate(); err != nil {
+		t.Errorf("bootstrap: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		setting string
+	}{
+		{"empty ID", func(c *Config) { c.ID = "" }, "id:"},
+		{"peer ID off the ring", func(c *Config) { c.ID = "peer5" }, "id:"},
+		{"peer without an object file", func(c *Config) { c.ObjectFile = "" }, "storage.path"},
+		{"negative delay", func(c *Config) { c.Delay = -1 }, "delay"},
+		{"listen address without a port", func(c *Config) { c.ListenAddress = "n5" }, "addresses.listen"},
+		{"metrics address without a port", func(c *Config) { c.MetricsAddress = "localhost" }, "metrics.address"},
+		{"unknown store engine", func(c *Config) { c.StoreEngine = "sqlite" }, "storage.engine"},
+		{"encrypted store without a key", func(c *Config) { c.StoreEngine = "encrypted" }, "storage.key_file"},
+		{"key file for the file store", func(c *Config) { c.StoreKeyFile = "store.key" }, "storage.engine"},
+		{"rotating the file store", func(c *Config) { c.RotateStoreKey = true }, "storage.rotate_key"},
+		{"malformed replica", func(c *Config) {
+			c.ID, c.Replicas, c.ReplicaSecretFile = "b1", "b1", "replica.secret"
+		}, "replication.replicas"},
+		{"replica list without this node", func(c *Config) {
+			c.ID, c.Replicas, c.ReplicaSecretFile = "b3", "b1=b1:8888,b2=b2:8888", "replica.secret"
+		}, "replication.replicas"},
+		{"replicas without authentication", func(c *Config) {
+			c.ID, c.Replicas = "b1", "b1=b1:8888,b2=b2:8888"
+		}, "replication.secret_file"},
+		{"partial TLS", func(c *Config) { c.TLSCert, c.TLSKey = "n5.pem", "n5.key" }, "tls:"},
+		{"API key without a secret", func(c *Config) { c.APIKeyID = "lab" }, "security.api_key_file"},
+		{"unknown lookup", func(c *Config) { c.Lookup = "flooding" }, "client.lookup"},
+		{"unknown log level", func(c *Config) { c.LogLevel = "verbose" }, "log.level"},
+		{"unknown log format", func(c *Config) { c.LogFormat = "xml" }, "log.format"},
+		{"no dial attempts", func(c *Config) { c.Network.Dial.MaxAttempts = 0 }, "network.dial_attempts"},
+		{"no send queue", func(c *Config) { c.Network.Connection.QueueSize = 0 }, "network.send_queue"},
+		{"no dispatch workers", func(c *Config) { c.Dispatch.Workers = 0 }, "dispatch.workers"},
+		{"negative dispatch queue", func(c *Config) { c.Dispatch.QueueSize = -1 }, "dispatch.queue"},
+		{"negative timeout", func(c *Config) { c.Network.Connection.CallTimeout = -time.Second }, "network.call_timeout"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := validPeer()
+			test.change(&config)
+			err := config.Validate()
+			if err == nil {
+				t.Fatal("Validate() accepted the config")
+			}
+			if !strings.Contains(err.Error(), test.setting) {
+				t.Errorf("Validate() = %v, want a problem with %s", err, test.setting)
+			}
+		})
+	}
+}
+
+func TestValidateAcceptsAuthenticatedReplicas(t *testing.T) {
+	withSecret := validPeer()
+	withSecret.ID, withSecret.Replicas, withSecret.ReplicaSecretFile = "b1", "b1=b1:8888,b2=b2:8888", "replica.secret"
+	if err := withSecret.Validate(); err != nil {
+		t.Errorf("shared secret: %v", err)
+	}
+	withTLS := validPeer()
+	withTLS.ID, withTLS.Replicas = "b1", "b1=b1:8888,b2=b2:8888"
+	withTLS.TLSCert, withTLS.TLSKey, withTLS.TLSCA = "b1.pem", "b1.key", "ca.pem"
+	if err := withTLS.Validate(); err != nil {
+		t.Errorf("TLS: %v", err)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	config := validPeer()
+	config.Delay = -1
+	config.Lookup = "flooding"
+	config.Dispatch.Workers = 0
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("Validate() accepted the config")
+	}
+	for _, setting := range []string{"delay", "client.lookup", "dispatch.workers"} {
+		if !strings.Contains(err.Error(), setting) {
+			t.Errorf("Validate() = %v, missing %s", err, setting)
+		}
+	}
+}